@@ -0,0 +1,183 @@
+package retryabledns
+
+import (
+	"context"
+	"iter"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultBatchConcurrency is the minimum number of concurrent jobs of a batch
+var DefaultBatchConcurrency = 10
+
+// Job is a batch query for the given record types of host, A if empty
+type Job struct {
+	Host  string
+	Types []uint16
+}
+
+// BatchResult is the outcome of a batch job
+type BatchResult struct {
+	// Index is the position of the job in the input
+	Index int
+	Job   Job
+	Data  *DNSData
+	Err   error
+}
+
+// BatchProgress contains the counters of a running batch
+type BatchProgress struct {
+	Submitted int
+	Completed int
+	Failed    int
+}
+
+// BatchOptions configures a batch
+type BatchOptions struct {
+	// Concurrency is the maximum number of jobs in flight, by default it's enough
+	// to keep every resolver connection pool busy
+	Concurrency int
+	// Ordered emits the results in input order instead of completion order
+	Ordered bool
+	// Progress is called after each completed job
+	Progress func(BatchProgress)
+}
+
+func (c *Client) batchConcurrency(options BatchOptions) int {
+	if options.Concurrency > 0 {
+		return options.Concurrency
+	}
+	return max(DefaultBatchConcurrency, len(c.resolvers)*max(c.options.ConnectionPoolThreads, 1))
+}
+
+// Batch resolves the jobs received from jobs and streams their results as they complete.
+// The returned channel is closed once jobs is closed and all the results are emitted, or
+// as soon as ctx is done, in which case pending results are dropped.
+func (c *Client) Batch(ctx context.Context, jobs <-chan Job, options BatchOptions) <-chan BatchResult {
+	return c.BatchSeq(ctx, func(yield func(Job) bool) {
+		for {
+			select {
+			case job, ok := <-jobs:
+				if !ok || !yield(job) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}, options)
+}
+
+// BatchSeq is like Batch but takes the jobs from an iterator
+func (c *Client) BatchSeq(ctx context.Context, jobs iter.Seq[Job], options BatchOptions) <-chan BatchResult {
+	out := make(chan BatchResult)
+	go c.runBatch(ctx, jobs, options, out)
+	return out
+}
+
+func (c *Client) runBatch(ctx context.Context, jobs iter.Seq[Job], options BatchOptions, out chan<- BatchResult) {
+	defer close(out)
+
+	// a slot is held from dispatch to emission, bounding both the jobs in flight
+	// and the results buffered for ordering
+	slots := make(chan struct{}, c.batchConcurrency(options))
+	completed := make(chan BatchResult)
+	var submitted atomic.Int64
+
+	go func() {
+		var wg sync.WaitGroup
+		defer close(completed)
+		defer wg.Wait()
+		index := 0
+		for job := range jobs {
+			// select picks at random among ready cases, so a free slot must not
+			// start a job once ctx is done
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			if ctx.Err() != nil {
+				<-slots
+				return
+			}
+			submitted.Add(1)
+			wg.Add(1)
+			go func(index int, job Job) {
+				defer wg.Done()
+				types := job.Types
+				if len(types) == 0 {
+					types = []uint16{dns.TypeA}
+				}
+				data, err := c.QueryMultipleContext(ctx, job.Host, types)
+				completed <- BatchResult{Index: index, Job: job, Data: data, Err: err}
+			}(index, job)
+			index++
+		}
+	}()
+
+	var (
+		progress BatchProgress
+		pending  = make(map[int]BatchResult)
+		next     int
+	)
+	emit := func(result BatchResult) {
+		if ctx.Err() == nil {
+			select {
+			case out <- result:
+			case <-ctx.Done():
+			}
+		}
+		<-slots
+	}
+	for result := range completed {
+		progress.Submitted = int(submitted.Load())
+		progress.Completed++
+		if result.Err != nil {
+			progress.Failed++
+		}
+		if options.Progress != nil {
+			options.Progress(progress)
+		}
+
+		if !options.Ordered {
+			emit(result)
+			continue
+		}
+		pending[result.Index] = result
+		for {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			emit(result)
+		}
+	}
+}
+
+// BatchIter is like BatchSeq but yields the result of each job along with its error as
+// they complete. Breaking out of the loop cancels the remaining jobs and waits for the
+// running ones to return.
+func (c *Client) BatchIter(ctx context.Context, jobs iter.Seq[Job], options BatchOptions) iter.Seq2[BatchResult, error] {
+	return func(yield func(BatchResult, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		results := c.BatchSeq(ctx, jobs, options)
+		for result := range results {
+			if !yield(result, result.Err) {
+				cancel()
+				// the channel is closed once every worker has returned
+				for range results {
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package retryabledns
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	addr, _ := runRcodeServer(t)
+	client, err := New([]string{addr}, 1)
+	require.NoError(t, err)
+
+	jobs := make(chan Job)
+	go func() {
+		defer close(jobs)
+		for i := 0; i < 50; i++ {
+			host := fmt.Sprintf("host%d.example.com", i)
+			if i%10 == 0 {
+				host = "servfail." + host
+			}
+			jobs <- Job{Host: host}
+		}
+	}()
+
+	var last BatchProgress
+	results := client.Batch(context.Background(), jobs, BatchOptions{
+		Concurrency: 4,
+		Ordered:     true,
+		Progress:    func(p BatchProgress) { last = p },
+	})
+	var indexes []int
+	for result := range results {
+		indexes = append(indexes, result.Index)
+		if result.Index%10 == 0 {
+			require.ErrorIs(t, result.Err, ErrRetriesExceeded)
+			continue
+		}
+		require.NoError(t, result.Err)
+		require.Equal(t, result.Job.Host, result.Data.Host)
+		require.Equal(t, []string{"127.0.0.9"}, result.Data.A)
+	}
+	require.Len(t, indexes, 50)
+	require.True(t, slices.IsSorted(indexes))
+	require.Equal(t, BatchProgress{Submitted: 50, Completed: 50, Failed: 5}, last)
+
+	// unordered batches from an iterator emit every result
+	seq := func(yield func(Job) bool) {
+		for i := 0; i < 20; i++ {
+			if !yield(Job{Host: fmt.Sprintf("seq%d.example.com", i), Types: []uint16{dns.TypeA, dns.TypeAAAA}}) {
+				return
+			}
+		}
+	}
+	var count int
+	for result := range client.BatchSeq(context.Background(), seq, BatchOptions{}) {
+		require.NoError(t, result.Err)
+		count++
+	}
+	require.Equal(t, 20, count)
+}
+
+func TestBatchCancellation(t *testing.T) {
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(50 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})
+	client, err := NewWithOptions(Options{BaseResolvers: []string{addr}, MaxRetries: 1, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+
+	// the job channel is never closed, the batch must end with the context
+	jobs := make(chan Job)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case jobs <- Job{Host: fmt.Sprintf("host%d.example.com", i)}:
+			case <-time.After(2 * time.Second):
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	for range client.Batch(ctx, jobs, BatchOptions{Concurrency: 2}) {
+	}
+	require.Less(t, time.Since(start), time.Second)
+
+	// a done context starts no job even while slots are free
+	done, cancelDone := context.WithCancel(context.Background())
+	cancelDone()
+	for i := 0; i < 20; i++ {
+		var pulled int
+		seq := func(yield func(Job) bool) {
+			for j := 0; j < 10; j++ {
+				pulled++
+				if !yield(Job{Host: fmt.Sprintf("host%d.example.com", j)}) {
+					return
+				}
+			}
+		}
+		for range client.BatchSeq(done, seq, BatchOptions{Concurrency: 10}) {
+		}
+		require.LessOrEqual(t, pulled, 1)
+	}
+}
+
+func TestBatchIter(t *testing.T) {
+	addr, _ := runRcodeServer(t)
+	client, err := New([]string{addr}, 1)
+	require.NoError(t, err)
+
+	jobs := func(yield func(Job) bool) {
+		for i := 0; ; i++ {
+			if !yield(Job{Host: fmt.Sprintf("iter%d.example.com", i)}) {
+				return
+			}
+		}
+	}
+	var count int
+	for result, err := range client.BatchIter(context.Background(), jobs, BatchOptions{Concurrency: 2}) {
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("iter%d.example.com", result.Index), result.Job.Host)
+		require.Equal(t, []string{"127.0.0.9"}, result.Data.A)
+		count++
+		if count == 5 {
+			break
+		}
+	}
+	require.Equal(t, 5, count)
+
+	// no job is left running once the loop has exited
+	var running atomic.Int32
+	slow := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(20 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})
+	client, err = New([]string{slow}, 1)
+	require.NoError(t, err)
+	tracked := func(yield func(Job) bool) {
+		for i := 0; ; i++ {
+			running.Add(1)
+			ok := yield(Job{Host: fmt.Sprintf("iter%d.example.com", i)})
+			if !ok {
+				running.Add(-1)
+				return
+			}
+		}
+	}
+	count = 0
+	for range client.BatchIter(context.Background(), tracked, BatchOptions{
+		Concurrency: 4,
+		Progress:    func(BatchProgress) { running.Add(-1) },
+	}) {
+		count++
+		if count == 2 {
+			break
+		}
+	}
+	require.Zero(t, running.Load())
+}
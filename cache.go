@@ -0,0 +1,215 @@
+package retryabledns
+
+import (
+	"container/list"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CacheStats contains the counters of the response cache
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	msg      *dns.Msg
+	resolver string
+	stored   time.Time
+	expires  time.Time
+}
+
+// responseCache is a ttl aware lru cache of dns responses
+type responseCache struct {
+	mu      sync.Mutex
+	maxSize int
+	minTTL  time.Duration
+	maxTTL  time.Duration
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	stats   CacheStats
+}
+
+func newResponseCache(maxSize int, minTTL, maxTTL time.Duration) *responseCache {
+	return &responseCache{
+		maxSize: maxSize,
+		minTTL:  minTTL,
+		maxTTL:  maxTTL,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func newCacheKey(question dns.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(dns.Fqdn(question.Name)), qtype: question.Qtype, qclass: question.Qclass}
+}
+
+// get returns a copy of the cached response for question with ttls decreased by
+// the time spent in the cache, along with the resolver that provided it
+func (rc *responseCache) get(question dns.Question) (*dns.Msg, string, bool) {
+	key := newCacheKey(question)
+	now := time.Now()
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	element, ok := rc.entries[key]
+	if !ok {
+		rc.stats.Misses++
+		return nil, "", false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		rc.removeElement(element)
+		rc.stats.Misses++
+		return nil, "", false
+	}
+	rc.lru.MoveToFront(element)
+	rc.stats.Hits++
+
+	msg := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return msg, entry.resolver, true
+}
+
+// set stores resp for its question if it's a cacheable positive or negative answer
+func (rc *responseCache) set(resp *dns.Msg, resolver string) {
+	if resp == nil || len(resp.Question) != 1 || resp.Truncated {
+		return
+	}
+	ttl, ok := cacheTTL(resp)
+	if !ok {
+		return
+	}
+	if ttl < rc.minTTL {
+		ttl = rc.minTTL
+	}
+	if rc.maxTTL > 0 && ttl > rc.maxTTL {
+		ttl = rc.maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	// the OPT record answers the EDNS of the request that got resp, it doesn't
+	// belong to the replies served to requests without EDNS
+	msg := resp.Copy()
+	msg.Extra = slices.DeleteFunc(msg.Extra, func(rr dns.RR) bool {
+		return rr.Header().Rrtype == dns.TypeOPT
+	})
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:      newCacheKey(resp.Question[0]),
+		msg:      msg,
+		resolver: resolver,
+		stored:   now,
+		expires:  now.Add(ttl),
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if element, ok := rc.entries[entry.key]; ok {
+		element.Value = entry
+		rc.lru.MoveToFront(element)
+		return
+	}
+	rc.entries[entry.key] = rc.lru.PushFront(entry)
+	for rc.maxSize > 0 && rc.lru.Len() > rc.maxSize {
+		rc.removeElement(rc.lru.Back())
+		rc.stats.Evictions++
+	}
+}
+
+func (rc *responseCache) removeElement(element *list.Element) {
+	rc.lru.Remove(element)
+	delete(rc.entries, element.Value.(*cacheEntry).key)
+}
+
+func (rc *responseCache) purge() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries = make(map[cacheKey]*list.Element)
+	rc.lru.Init()
+}
+
+func (rc *responseCache) getStats() CacheStats {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	stats := rc.stats
+	stats.Size = rc.lru.Len()
+	return stats
+}
+
+// cacheTTL returns for how long resp can be cached. Positive answers use the lowest
+// ttl of the answer section, while NXDOMAIN and NODATA answers use the SOA from the
+// authority section as described in RFC 2308 section 5.
+func cacheTTL(resp *dns.Msg) (time.Duration, bool) {
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return 0, false
+	}
+
+	if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0 {
+		minTTL := resp.Answer[0].Header().Ttl
+		for _, rr := range resp.Answer[1:] {
+			minTTL = min(minTTL, rr.Header().Ttl)
+		}
+		return time.Duration(minTTL) * time.Second, true
+	}
+
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// CacheStats returns the counters of the response cache
+func (c *Client) CacheStats() CacheStats {
+	if c.cache == nil {
+		return CacheStats{}
+	}
+	return c.cache.getStats()
+}
+
+// PurgeCache removes all the entries from the response cache
+func (c *Client) PurgeCache() {
+	if c.cache != nil {
+		c.cache.purge()
+	}
+}
+
+// cacheableRequest returns true if the replies cached by question fit the user built msg.
+// Messages with EDNS (e.g. DO set), CD set or RD unset expect other records or flags.
+func cacheableRequest(msg *dns.Msg) bool {
+	return len(msg.Question) == 1 && msg.RecursionDesired && !msg.CheckingDisabled && msg.IsEdns0() == nil
+}
@@ -0,0 +1,146 @@
+package retryabledns
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	var queries atomic.Int32
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch r.Question[0].Name {
+		case "nxdomain.example.com.":
+			m.Rcode = dns.RcodeNameError
+			soa, _ := dns.NewRR("example.com. 600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 86400 300")
+			m.Ns = append(m.Ns, soa)
+		default:
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 127.0.0.4")
+			m.Answer = append(m.Answer, rr)
+		}
+		_ = w.WriteMsg(m)
+	})
+
+	client, err := NewWithOptions(Options{BaseResolvers: []string{addr}, MaxRetries: 1, CacheSize: 2})
+	require.NoError(t, err)
+
+	d, err := client.A("www.example.com")
+	require.NoError(t, err)
+	require.False(t, d.FromCache)
+	d, err = client.A("WWW.example.com")
+	require.NoError(t, err)
+	require.True(t, d.FromCache)
+	require.Equal(t, []string{"127.0.0.4"}, d.A)
+	require.Equal(t, []string{addr}, d.Resolver)
+	require.EqualValues(t, 1, queries.Load())
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	resp, err := client.Do(msg)
+	require.NoError(t, err)
+	require.Equal(t, msg.Id, resp.Id)
+	require.EqualValues(t, 1, queries.Load())
+
+	// negative answers are cached with the soa minimum
+	_, _ = client.A("nxdomain.example.com")
+	d, _ = client.A("nxdomain.example.com")
+	require.True(t, d.FromCache)
+	require.Equal(t, "NXDOMAIN", d.StatusCode)
+	require.EqualValues(t, 2, queries.Load())
+
+	// www.example.com is the least recently used entry and gets evicted
+	_, _ = client.A("other.example.com")
+	d, err = client.A("www.example.com")
+	require.NoError(t, err)
+	require.False(t, d.FromCache)
+
+	stats := client.CacheStats()
+	require.EqualValues(t, 3, stats.Hits)
+	require.EqualValues(t, 2, stats.Evictions)
+	require.Equal(t, 2, stats.Size)
+
+	client.PurgeCache()
+	require.Zero(t, client.CacheStats().Size)
+}
+
+func TestCacheBypass(t *testing.T) {
+	var queries atomic.Int32
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 127.0.0.4")
+		m.Answer = append(m.Answer, rr)
+		if opt := r.IsEdns0(); opt != nil {
+			m.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		_ = w.WriteMsg(m)
+	})
+	client, err := NewWithOptions(Options{BaseResolvers: []string{addr}, MaxRetries: 1, CacheSize: 10})
+	require.NoError(t, err)
+	_, err = client.A("www.example.com")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, queries.Load())
+
+	// messages expecting dnssec records or other flags than the cached ones are sent
+	for _, edit := range []func(msg *dns.Msg){
+		func(msg *dns.Msg) { msg.SetEdns0(1232, true) },
+		func(msg *dns.Msg) { msg.CheckingDisabled = true },
+		func(msg *dns.Msg) { msg.RecursionDesired = false },
+	} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.com.", dns.TypeA)
+		edit(msg)
+		_, err := client.Do(msg)
+		require.NoError(t, err)
+	}
+	require.EqualValues(t, 4, queries.Load())
+
+	// cached replies honor the context too
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	_, err = client.DoContext(ctx, msg)
+	require.ErrorIs(t, err, context.Canceled)
+	resp, err := client.Do(msg)
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+	require.EqualValues(t, 4, queries.Load())
+	// the reply cached from an EDNS query carries no OPT record for a plain request
+	require.Nil(t, resp.IsEdns0())
+}
+
+func TestCacheTTL(t *testing.T) {
+	cache := newResponseCache(10, 0, 50*time.Millisecond)
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Response = true
+	rr, _ := dns.NewRR("example.com. 300 IN A 127.0.0.5")
+	resp.Answer = append(resp.Answer, rr)
+	cache.set(resp, "resolver")
+
+	_, _, ok := cache.get(resp.Question[0])
+	require.True(t, ok)
+	time.Sleep(100 * time.Millisecond)
+	_, _, ok = cache.get(resp.Question[0])
+	require.False(t, ok)
+
+	// no soa means the negative answer cannot be cached
+	noData := new(dns.Msg)
+	noData.SetQuestion("example.org.", dns.TypeA)
+	cache.set(noData, "resolver")
+	_, _, ok = cache.get(noData.Question[0])
+	require.False(t, ok)
+
+	ttl, ok := cacheTTL(&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}})
+	require.False(t, ok)
+	require.Zero(t, ttl)
+}
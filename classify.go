@@ -0,0 +1,79 @@
+package retryabledns
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Outcome is the classification of an attempt
+type Outcome int
+
+const (
+	// OutcomeRetry means the attempt did not produce a usable answer and should be retried
+	OutcomeRetry Outcome = iota
+	// OutcomeFinal means the answer is conclusive and must not be retried
+	OutcomeFinal
+)
+
+// Classifier decides whether the outcome of an attempt is final or should be retried
+type Classifier func(resp *dns.Msg, err error) Outcome
+
+// DefaultClassifier treats answers, NXDOMAIN and NODATA with a SOA in the authority section
+// (RFC 2308) as final, and retries network errors, timeouts, truncated responses,
+// SERVFAIL, REFUSED and any other error rcode.
+func DefaultClassifier(resp *dns.Msg, err error) Outcome {
+	if err != nil || resp == nil || resp.Truncated {
+		return OutcomeRetry
+	}
+	switch resp.Rcode {
+	case dns.RcodeNameError:
+		return OutcomeFinal
+	case dns.RcodeSuccess:
+		if len(resp.Answer) > 0 || hasSOA(resp.Ns) {
+			return OutcomeFinal
+		}
+	}
+	return OutcomeRetry
+}
+
+func hasSOA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.SOA); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) classify(resp *dns.Msg, err error) Outcome {
+	if c.options.RetryClassifier != nil {
+		return c.options.RetryClassifier(resp, err)
+	}
+	return DefaultClassifier(resp, err)
+}
+
+// RcodeError is returned along with ErrRetriesExceeded when the last attempt got
+// an error rcode, it tells which resolver answered what
+type RcodeError struct {
+	Rcode    int
+	Resolver string
+}
+
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("%s answered %s", e.Resolver, dns.RcodeToString[e.Rcode])
+}
+
+// retriesExceeded builds the error returned when no attempt got a final answer,
+// it carries the transport error or the rcode of the last attempt if any
+func retriesExceeded(resolver Resolver, resp *dns.Msg, err error) error {
+	switch {
+	case err != nil:
+		return errors.Join(ErrRetriesExceeded, err)
+	case resp != nil && resp.Rcode != dns.RcodeSuccess:
+		return errors.Join(ErrRetriesExceeded, &RcodeError{Rcode: resp.Rcode, Resolver: resolver.String()})
+	default:
+		return ErrRetriesExceeded
+	}
+}
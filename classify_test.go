@@ -0,0 +1,159 @@
+package retryabledns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// runRcodeServer starts a local server answering based on the first label of the name
+// and counting the queries it receives per name
+func runRcodeServer(t *testing.T) (string, func(name string) int) {
+	var mu sync.Mutex
+	queries := make(map[string]int)
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		name := r.Question[0].Name
+		mu.Lock()
+		queries[name]++
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		soa, _ := dns.NewRR("example.com. 600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 86400 300")
+		switch strings.Split(name, ".")[0] {
+		case "nxdomain":
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(m.Ns, soa)
+		case "nodata":
+			m.Ns = append(m.Ns, soa)
+		case "servfail":
+			m.Rcode = dns.RcodeServerFailure
+		case "refused":
+			m.Rcode = dns.RcodeRefused
+		case "empty":
+			// NOERROR without records and without SOA
+		default:
+			rr, _ := dns.NewRR(name + " 60 IN A 127.0.0.9")
+			m.Answer = append(m.Answer, rr)
+		}
+		_ = w.WriteMsg(m)
+	})
+	return addr, func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries[dns.Fqdn(name)]
+	}
+}
+
+func TestRetryClassification(t *testing.T) {
+	addr, queries := runRcodeServer(t)
+	client, err := New([]string{addr}, 3)
+	require.NoError(t, err)
+
+	d, err := client.A("nxdomain.example.com")
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, d.StatusCodeRaw)
+	require.Equal(t, 1, queries("nxdomain.example.com"))
+
+	d, err = client.A("nodata.example.com")
+	require.NoError(t, err)
+	require.Empty(t, d.A)
+	require.Equal(t, 1, queries("nodata.example.com"))
+
+	_, err = client.A("servfail.example.com")
+	require.ErrorIs(t, err, ErrRetriesExceeded)
+	var rcodeErr *RcodeError
+	require.True(t, errors.As(err, &rcodeErr))
+	require.Equal(t, dns.RcodeServerFailure, rcodeErr.Rcode)
+	require.Equal(t, addr, rcodeErr.Resolver)
+	require.Equal(t, 3, queries("servfail.example.com"))
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("nxdomain.do.example.com.", dns.TypeA)
+	resp, err := client.Do(msg)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, resp.Rcode)
+	require.Equal(t, 1, queries("nxdomain.do.example.com"))
+
+	msg.SetQuestion("refused.do.example.com.", dns.TypeA)
+	_, err = client.Do(msg)
+	require.True(t, errors.As(err, &rcodeErr))
+	require.Equal(t, dns.RcodeRefused, rcodeErr.Rcode)
+	require.Equal(t, 3, queries("refused.do.example.com"))
+
+	// empty answers are retried, the last one is returned without error by both paths
+	d, err = client.A("empty.example.com")
+	require.NoError(t, err)
+	require.Empty(t, d.A)
+	require.Equal(t, 3, queries("empty.example.com"))
+
+	msg.SetQuestion("empty.do.example.com.", dns.TypeA)
+	resp, err = client.Do(msg)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Equal(t, 3, queries("empty.do.example.com"))
+}
+
+func TestCustomRetryClassifier(t *testing.T) {
+	addr, queries := runRcodeServer(t)
+	client, err := NewWithOptions(Options{
+		BaseResolvers: []string{addr},
+		MaxRetries:    3,
+		RetryClassifier: func(resp *dns.Msg, err error) Outcome {
+			if resp != nil && resp.Rcode == dns.RcodeServerFailure {
+				return OutcomeFinal
+			}
+			return DefaultClassifier(resp, err)
+		},
+	})
+	require.NoError(t, err)
+
+	d, err := client.A("servfail.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "SERVFAIL", d.StatusCode)
+	require.Equal(t, 1, queries("servfail.example.com"))
+}
+
+func TestRetryClassifierTransportErrors(t *testing.T) {
+	// nothing listens on the port, every exchange is refused
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := conn.LocalAddr().String()
+	require.NoError(t, conn.Close())
+
+	var calls atomic.Int32
+	client, err := NewWithOptions(Options{
+		BaseResolvers: []string{addr},
+		MaxRetries:    3,
+		RetryClassifier: func(resp *dns.Msg, err error) Outcome {
+			if err != nil {
+				calls.Add(1)
+				return OutcomeFinal
+			}
+			return DefaultClassifier(resp, err)
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = client.A("example.com")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrRetriesExceeded)
+	var resolveErr *ResolveError
+	require.True(t, errors.As(err, &resolveErr))
+	require.Len(t, resolveErr.Attempts, 1)
+	require.Equal(t, int32(1), calls.Load())
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	_, err = client.Do(msg)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrRetriesExceeded)
+	require.True(t, errors.As(err, &resolveErr))
+	require.Len(t, resolveErr.Attempts, 1)
+	require.Equal(t, int32(2), calls.Load())
+}
@@ -7,12 +7,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"math/rand"
 	"net"
 	"net/url"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -57,6 +58,12 @@ type Client struct {
 	tcpProxy     proxy.Dialer
 	dotProxy     proxy.Dialer
 	knownHosts   map[string][]string
+	transports   sync.Map
+	cache        *responseCache
+	inflight     *queryGroup
+	health       *resolverHealth
+	rateLimiter  *rateLimiter
+	hedger       *hedger
 }
 
 // New creates a new dns client
@@ -69,7 +76,10 @@ func NewWithOptions(options Options) (*Client, error) {
 	if err := options.Validate(); err != nil {
 		return nil, err
 	}
-	parsedBaseResolvers := parseResolvers(sliceutil.Dedupe(options.BaseResolvers))
+	parsedBaseResolvers, err := parseResolvers(sliceutil.Dedupe(options.BaseResolvers))
+	if err != nil {
+		return nil, err
+	}
 	var knownHosts map[string][]string
 	if options.Hostsfile {
 		knownHosts, _ = hostsfile.ParseDefault()
@@ -79,11 +89,15 @@ func NewWithOptions(options Options) (*Client, error) {
 		options.MaxPerCNAMEFollows = DefaultMaxPerCNAMEFollows
 	}
 
-	httpClient := doh.NewHttpClient(
-		doh.WithTimeout(options.Timeout),
-		doh.WithInsecureSkipVerify(),
-		doh.WithProxy(options.Proxy), // no-op if empty
-	)
+	if options.QuarantineThreshold > 0 && options.QuarantineDuration == 0 {
+		options.QuarantineDuration = DefaultQuarantineDuration
+	}
+
+	if options.DoHHTTPVersion == "" {
+		options.DoHHTTPVersion = doh.HTTP2
+	}
+
+	httpClient := newDOHHTTPClient(options, options.TLS.config(""))
 
 	// If proxy is specified, force TCP for all resolvers
 	if options.Proxy != "" {
@@ -133,6 +147,17 @@ func NewWithOptions(options Options) (*Client, error) {
 		dotClient:  dotClient,
 		knownHosts: knownHosts,
 	}
+	client.health = newResolverHealth(options, parsedBaseResolvers)
+	client.rateLimiter = newRateLimiter(options)
+	client.hedger = newHedger(options)
+
+	if options.CacheSize > 0 {
+		client.cache = newResponseCache(options.CacheSize, options.CacheMinTTL, options.CacheMaxTTL)
+	}
+
+	if options.CoalesceQueries {
+		client.inflight = newQueryGroup()
+	}
 
 	if options.Proxy != "" {
 		proxyURL, err := url.Parse(options.Proxy)
@@ -162,6 +187,9 @@ func NewWithOptions(options Options) (*Client, error) {
 			Map: make(mapsutil.Map[string, *ConnPool]),
 		}
 		for _, resolver := range client.resolvers {
+			if _, ok := resolver.(*NetworkResolver); !ok {
+				continue
+			}
 			resolverHost, resolverPort, err := net.SplitHostPort(resolver.String())
 			if err != nil {
 				return nil, err
@@ -203,84 +231,102 @@ func (c *Client) ResolveWithSyscall(host string) (*DNSData, error) {
 // Resolve is the underlying resolve function that actually resolves a host
 // and gets the ip records for that host.
 func (c *Client) Resolve(host string) (*DNSData, error) {
-	return c.QueryMultiple(host, []uint16{dns.TypeA, dns.TypeAAAA})
+	return c.ResolveContext(context.Background(), host)
+}
+
+// ResolveContext is like Resolve but honors the cancellation and deadline of ctx
+func (c *Client) ResolveContext(ctx context.Context, host string) (*DNSData, error) {
+	return c.QueryMultipleContext(ctx, host, []uint16{dns.TypeA, dns.TypeAAAA})
 }
 
 // Do sends a provided dns request and return the raw native response
 func (c *Client) Do(msg *dns.Msg) (*dns.Msg, error) {
-	var resp *dns.Msg
-	var err error
+	return c.DoContext(context.Background(), msg)
+}
+
+// DoContext is like Do but honors the cancellation and deadline of ctx
+func (c *Client) DoContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	useCache := c.cache != nil && cacheableRequest(msg)
+	if useCache {
+		if ctx.Err() != nil {
+			return nil, contextError(ctx)
+		}
+		if cached, _, ok := c.cache.get(msg.Question[0]); ok {
+			cached.Id = msg.Id
+			return cached, nil
+		}
+	}
+
+	var (
+		resp     *dns.Msg
+		err      error
+		rtt      time.Duration
+		resolver Resolver
+		attempts []Attempt
+		host     string
+	)
+	if len(msg.Question) > 0 {
+		host = msg.Question[0].Name
+	}
 	for i := 0; i < c.options.MaxRetries; i++ {
-		index := atomic.AddUint32(&c.serversIndex, 1)
-		resolver := c.resolvers[index%uint32(len(c.resolvers))]
-
-		switch r := resolver.(type) {
-		case *NetworkResolver:
-			switch r.Protocol {
-			case TCP:
-				if c.tcpProxy != nil {
-					var tcpConn *dns.Conn
-					tcpConn, err = c.dialWithProxy(c.tcpProxy, "tcp", resolver.String())
-					if err != nil {
-						break
-					}
-					defer tcpConn.Close()
-					resp, _, err = c.tcpClient.ExchangeWithConn(msg, tcpConn)
-				} else {
-					resp, _, err = c.tcpClient.Exchange(msg, resolver.String())
-				}
-			case UDP:
-				if c.options.ConnectionPoolThreads > 1 {
-					if udpConnPool, ok := c.udpConnPool.Get(resolver.String()); ok {
-						resp, _, err = udpConnPool.Exchange(context.TODO(), c.udpClient, msg)
-					}
-				} else if c.udpProxy != nil {
-					var udpConn *dns.Conn
-					udpConn, err = c.dialWithProxy(c.udpProxy, "udp", resolver.String())
-					if err != nil {
-						break
-					}
-					defer udpConn.Close()
-					resp, _, err = c.udpClient.ExchangeWithConn(msg, udpConn)
-				} else {
-					resp, _, err = c.udpClient.Exchange(msg, resolver.String())
-				}
-			case DOT:
-				resp, _, err = c.dotClient.Exchange(msg, resolver.String())
-			}
-		case *DohResolver:
-			method := doh.MethodPost
-			if r.Protocol == GET {
-				method = doh.MethodGet
+		if ctx.Err() != nil {
+			return resp, newResolveError(host, attempts, contextError(ctx))
+		}
+		if i > 0 {
+			if err := c.waitRetry(ctx, i); err != nil {
+				return resp, newResolveError(host, attempts, err)
 			}
-			resp, err = c.dohClient.QueryWithDOHMsg(method, doh.Resolver{URL: r.URL}, msg)
 		}
+		if i == 0 || !c.options.RetryPolicy.SameResolver {
+			resolver = c.nextResolver()
+		}
+
+		result, losers := c.hedgedExchange(ctx, resolver, msg)
+		resolver, resp, rtt, err = result.resolver, result.resp, result.rtt, result.err
+
+		if ctx.Err() != nil {
+			return resp, newResolveError(host, attempts, contextError(ctx))
+		}
+		for _, loser := range losers {
+			attempts = append(attempts, newAttempt(loser.resolver, loser.rtt, loser.resp, loser.err))
+		}
+		attempts = append(attempts, newAttempt(resolver, rtt, resp, err))
 
+		outcome := c.classify(resp, err)
 		if err != nil || resp == nil {
+			// the classifier may deem a transport error conclusive
+			if err != nil && outcome == OutcomeFinal {
+				return resp, newResolveError(host, attempts, err)
+			}
 			continue
 		}
 
-		if resp.Rcode != dns.RcodeSuccess {
+		if useCache {
+			c.cache.set(resp, resolver.String())
+		}
+
+		if outcome == OutcomeRetry {
 			continue
 		}
 
-		// In case we get a non empty answer stop retrying
+		// In case we get a final answer stop retrying
 		return resp, nil
 	}
-	return resp, ErrRetriesExceeded
-}
-
-func (c *Client) dialWithProxy(dialer proxy.Dialer, network, addr string) (*dns.Conn, error) {
-	conn, err := dialer.Dial(network, addr)
-	if err != nil {
-		return nil, err
+	// answers without records and without SOA are retried but don't fail the query
+	if err == nil && resp != nil && resp.Rcode == dns.RcodeSuccess {
+		return resp, nil
 	}
-	return &dns.Conn{Conn: conn}, nil
+	return resp, newResolveError(host, attempts, retriesExceeded(resolver, resp, err))
 }
 
 // Query sends a provided dns request and return enriched response
 func (c *Client) Query(host string, requestType uint16) (*DNSData, error) {
-	return c.QueryMultiple(host, []uint16{requestType})
+	return c.QueryContext(context.Background(), host, requestType)
+}
+
+// QueryContext is like Query but honors the cancellation and deadline of ctx
+func (c *Client) QueryContext(ctx context.Context, host string, requestType uint16) (*DNSData, error) {
+	return c.QueryMultipleContext(ctx, host, []uint16{requestType})
 }
 
 // A helper function
@@ -334,12 +380,22 @@ func (c *Client) NS(host string) (*DNSData, error) {
 }
 
 func (c *Client) AXFR(host string) (*AXFRData, error) {
-	return c.axfr(host)
+	return c.AXFRContext(context.Background(), host)
+}
+
+// AXFRContext is like AXFR but honors the cancellation and deadline of ctx
+func (c *Client) AXFRContext(ctx context.Context, host string) (*AXFRData, error) {
+	return c.axfr(ctx, host)
 }
 
 // QueryMultiple sends a provided dns request and return the data with a specific resolver
 func (c *Client) QueryMultipleWithResolver(host string, requestTypes []uint16, resolver Resolver) (*DNSData, error) {
-	return c.queryMultiple(host, requestTypes, resolver)
+	return c.QueryMultipleWithResolverContext(context.Background(), host, requestTypes, resolver)
+}
+
+// QueryMultipleWithResolverContext is like QueryMultipleWithResolver but honors the cancellation and deadline of ctx
+func (c *Client) QueryMultipleWithResolverContext(ctx context.Context, host string, requestTypes []uint16, resolver Resolver) (*DNSData, error) {
+	return c.queryMultiple(ctx, host, requestTypes, resolver)
 }
 
 // CAA helper function
@@ -347,18 +403,85 @@ func (c *Client) CAA(host string) (*DNSData, error) {
 	return c.QueryMultiple(host, []uint16{dns.TypeCAA})
 }
 
+// HTTPS helper function
+func (c *Client) HTTPS(host string) (*DNSData, error) {
+	return c.QueryMultiple(host, []uint16{dns.TypeHTTPS})
+}
+
+// SVCB helper function
+func (c *Client) SVCB(host string) (*DNSData, error) {
+	return c.QueryMultiple(host, []uint16{dns.TypeSVCB})
+}
+
+// TLSA helper function, host is the service name e.g. _443._tcp.example.com
+func (c *Client) TLSA(host string) (*DNSData, error) {
+	return c.QueryMultiple(host, []uint16{dns.TypeTLSA})
+}
+
+// SSHFP helper function
+func (c *Client) SSHFP(host string) (*DNSData, error) {
+	return c.QueryMultiple(host, []uint16{dns.TypeSSHFP})
+}
+
+// DS helper function
+func (c *Client) DS(host string) (*DNSData, error) {
+	return c.QueryMultiple(host, []uint16{dns.TypeDS})
+}
+
+// DNSKEY helper function
+func (c *Client) DNSKEY(host string) (*DNSData, error) {
+	return c.QueryMultiple(host, []uint16{dns.TypeDNSKEY})
+}
+
+// NAPTR helper function
+func (c *Client) NAPTR(host string) (*DNSData, error) {
+	return c.QueryMultiple(host, []uint16{dns.TypeNAPTR})
+}
+
+// URI helper function
+func (c *Client) URI(host string) (*DNSData, error) {
+	return c.QueryMultiple(host, []uint16{dns.TypeURI})
+}
+
+// LOC helper function
+func (c *Client) LOC(host string) (*DNSData, error) {
+	return c.QueryMultiple(host, []uint16{dns.TypeLOC})
+}
+
+// HINFO helper function
+func (c *Client) HINFO(host string) (*DNSData, error) {
+	return c.QueryMultiple(host, []uint16{dns.TypeHINFO})
+}
+
 // QueryMultiple sends a provided dns request and return the data
 func (c *Client) QueryMultiple(host string, requestTypes []uint16) (*DNSData, error) {
-	return c.queryMultiple(host, requestTypes, nil)
+	return c.QueryMultipleContext(context.Background(), host, requestTypes)
+}
+
+// QueryMultipleContext is like QueryMultiple but honors the cancellation and deadline of ctx
+func (c *Client) QueryMultipleContext(ctx context.Context, host string, requestTypes []uint16) (*DNSData, error) {
+	if c.inflight != nil {
+		return c.inflight.do(ctx, queryGroupKey(host, requestTypes), func(ctx context.Context) (*DNSData, error) {
+			return c.queryMultiple(ctx, host, requestTypes, nil)
+		})
+	}
+	return c.queryMultiple(ctx, host, requestTypes, nil)
 }
 
 // QueryMultiple sends a provided dns request and return the data
-func (c *Client) queryMultiple(host string, requestTypes []uint16, resolver Resolver) (*DNSData, error) {
+func (c *Client) queryMultiple(ctx context.Context, host string, requestTypes []uint16, resolver Resolver) (*DNSData, error) {
 	var (
 		hasResolver bool = resolver != nil
 		dnsdata     DNSData
 		err         error
+		fromCache   bool = c.cache != nil && len(requestTypes) > 0
+		attempts    []Attempt
 	)
+	if c.options.RecordAttempts {
+		defer func() {
+			dnsdata.Attempts = attempts
+		}()
+	}
 
 	// integrate data with known hosts in case
 	if c.options.Hostsfile {
@@ -419,88 +542,84 @@ func (c *Client) queryMultiple(host string, requestTypes []uint16, resolver Reso
 			msg.Question[0] = question
 		}
 
+		useCache := c.cache != nil && !hasResolver && requestType != dns.TypeAXFR
+		if useCache {
+			if cached, cachedResolver, ok := c.cache.get(msg.Question[0]); ok {
+				_ = dnsdata.ParseFromMsg(cached)
+				dnsdata.RawResp = cached
+				dnsdata.Host = host
+				dnsdata.StatusCode = dns.RcodeToString[cached.Rcode]
+				dnsdata.StatusCodeRaw = cached.Rcode
+				dnsdata.Raw += cached.String()
+				dnsdata.Timestamp = time.Now()
+				dnsdata.Resolver = append(dnsdata.Resolver, cachedResolver)
+				dnsdata.dedupe()
+				continue
+			}
+		}
+		fromCache = false
+
 		var (
 			resp   *dns.Msg
 			trResp chan *dns.Envelope
 			i      int
 		)
 		for i = 0; i < c.options.MaxRetries; i++ {
-			index := atomic.AddUint32(&c.serversIndex, 1)
-			if !hasResolver {
-				resolver = c.resolvers[index%uint32(len(c.resolvers))]
-			}
-			switch r := resolver.(type) {
-			case *NetworkResolver:
-				if requestType == dns.TypeAXFR {
-					var dnsconn *dns.Conn
-					switch r.Protocol {
-					case TCP:
-						dnsconn, err = c.tcpClient.Dial(resolver.String())
-					case UDP:
-						dnsconn, err = c.udpClient.Dial(resolver.String())
-					case DOT:
-						dnsconn, err = c.dotClient.Dial(resolver.String())
-					default:
-						dnsconn, err = c.tcpClient.Dial(resolver.String())
-					}
-					if err != nil {
-						break
-					}
-					defer dnsconn.Close()
-					dnsTransfer := &dns.Transfer{Conn: dnsconn}
-					trResp, err = dnsTransfer.In(msg, resolver.String())
-				} else {
-					switch r.Protocol {
-					case TCP:
-						if c.tcpProxy != nil {
-							var tcpConn *dns.Conn
-							tcpConn, err = c.dialWithProxy(c.tcpProxy, "tcp", resolver.String())
-							if err != nil {
-								break
-							}
-							defer tcpConn.Close()
-							resp, _, err = c.tcpClient.ExchangeWithConn(msg, tcpConn)
-						} else {
-							resp, _, err = c.tcpClient.Exchange(msg, resolver.String())
-						}
-					case UDP:
-						if c.options.ConnectionPoolThreads > 1 {
-							if udpConnPool, ok := c.udpConnPool.Get(resolver.String()); ok {
-								resp, _, err = udpConnPool.Exchange(context.TODO(), c.udpClient, msg)
-							}
-						} else {
-							resp, _, err = c.udpClient.Exchange(msg, resolver.String())
-						}
-					case DOT:
-						resp, _, err = c.dotClient.Exchange(msg, resolver.String())
-					}
+			if ctx.Err() != nil {
+				return &dnsdata, newResolveError(host, attempts, contextError(ctx))
+			}
+			if i > 0 {
+				if err := c.waitRetry(ctx, i); err != nil {
+					return &dnsdata, newResolveError(host, attempts, err)
 				}
-			case *DohResolver:
-				method := doh.MethodPost
-				if r.Protocol == GET {
-					method = doh.MethodGet
+			}
+			if !hasResolver && (i == 0 || !c.options.RetryPolicy.SameResolver) {
+				resolver = c.nextResolver()
+			}
+			var (
+				rtt   time.Duration
+				start = time.Now()
+			)
+			switch {
+			case requestType == dns.TypeAXFR:
+				trResp, err = c.transfer(ctx, resolver, msg)
+			case hasResolver:
+				resp, rtt, err = c.exchange(ctx, resolver, msg)
+			default:
+				result, losers := c.hedgedExchange(ctx, resolver, msg)
+				resolver, resp, rtt, err = result.resolver, result.resp, result.rtt, result.err
+				for _, loser := range losers {
+					attempts = append(attempts, newAttempt(loser.resolver, loser.rtt, loser.resp, loser.err))
 				}
-				resp, err = c.dohClient.QueryWithDOHMsg(method, doh.Resolver{URL: r.URL}, msg)
+			}
+
+			if ctx.Err() != nil {
+				return &dnsdata, newResolveError(host, attempts, contextError(ctx))
 			}
 
 			if err != nil || (trResp == nil && resp == nil) {
+				attempts = append(attempts, newAttempt(resolver, rtt, resp, err))
+				// the classifier may deem a transport error conclusive
+				if err != nil && c.classify(resp, err) == OutcomeFinal {
+					return &dnsdata, newResolveError(host, attempts, err)
+				}
 				continue
 			}
 
-			// https://github.com/projectdiscovery/retryabledns/issues/25
-			if resp != nil && resp.Truncated && c.TCPFallback {
-				resp, _, err = c.tcpClient.Exchange(msg, resolver.String())
-				if err != nil || resp == nil {
-					continue
-				}
+			if useCache {
+				c.cache.set(resp, resolver.String())
 			}
 
-			switch requestType {
-			case dns.TypeAXFR:
+			// responses are parsed once accepted, so that the records, flags and rtt
+			// of retried ones don't mix with the final data
+			if requestType == dns.TypeAXFR {
 				err = dnsdata.ParseFromEnvelopeChan(trResp)
-			default:
-				err = dnsdata.ParseFromMsg(resp)
+				if ctx.Err() != nil {
+					return &dnsdata, newResolveError(host, attempts, contextError(ctx))
+				}
+				rtt = time.Since(start)
 			}
+			attempts = append(attempts, newAttempt(resolver, rtt, resp, err))
 
 			// Note: this will refer only to the last valid response
 			// the whole series of responses can be found in the dnsdata.Raw field
@@ -519,31 +638,47 @@ func (c *Client) queryMultiple(host string, requestTypes []uint16, resolver Reso
 			dnsdata.Timestamp = time.Now()
 			dnsdata.Resolver = append(dnsdata.Resolver, resolver.String())
 
-			if err != nil || !dnsdata.contains() {
+			if err != nil {
 				continue
 			}
-			dnsdata.dedupe()
-
-			// stop on success
-			if resp != nil && resp.Rcode == dns.RcodeSuccess {
-				break
+			// zone transfers are final once fully received
+			if resp != nil && c.classify(resp, err) == OutcomeRetry {
+				continue
 			}
-			if trResp != nil {
-				break
+			if resp != nil {
+				_ = dnsdata.ParseFromMsg(resp)
 			}
+			dnsdata.RTT += rtt
+			dnsdata.dedupe()
+			break
 		}
 		// Finished retry loop at limit, bail out
-		if i == c.options.MaxRetries && err != nil {
-			err = errors.Join(ErrRetriesExceeded, err)
-			break
+		if i == c.options.MaxRetries {
+			// answers without records and without SOA are retried but don't fail the query
+			if err != nil || (resp != nil && resp.Rcode != dns.RcodeSuccess) {
+				err = newResolveError(host, attempts, retriesExceeded(resolver, resp, err))
+				break
+			}
+			// the last of them, e.g. a referral, is kept
+			if resp != nil {
+				_ = dnsdata.ParseFromMsg(resp)
+				dnsdata.RTT += attempts[len(attempts)-1].RTT
+				dnsdata.dedupe()
+			}
 		}
 	}
+	dnsdata.FromCache = fromCache
 
 	return &dnsdata, err
 }
 
 // QueryParallel sends a provided dns request to multiple resolvers in parallel
 func (c *Client) QueryParallel(host string, requestType uint16, resolvers []string) ([]*DNSData, error) {
+	return c.QueryParallelContext(context.Background(), host, requestType, resolvers)
+}
+
+// QueryParallelContext is like QueryParallel but honors the cancellation and deadline of ctx
+func (c *Client) QueryParallelContext(ctx context.Context, host string, requestType uint16, resolvers []string) ([]*DNSData, error) {
 	msg := dns.Msg{}
 	msg.SetQuestion(dns.CanonicalName(host), requestType)
 
@@ -556,10 +691,11 @@ func (c *Client) QueryParallel(host string, requestType uint16, resolvers []stri
 		wg.Add(1)
 		go func(resolver string, dnsdata *DNSData) {
 			defer wg.Done()
-			resp, err := dns.Exchange(msg.Copy(), resolver)
+			resp, rtt, err := exchangeContext(ctx, new(dns.Client), msg.Copy(), resolver)
 			if err != nil {
 				return
 			}
+			dnsdata.RTT = rtt
 			err = dnsdata.ParseFromMsg(resp)
 			if err != nil {
 				return
@@ -577,12 +713,39 @@ func (c *Client) QueryParallel(host string, requestType uint16, resolvers []stri
 
 	wg.Wait()
 
+	if ctx.Err() != nil {
+		return dnsdatas, contextError(ctx)
+	}
+
 	return dnsdatas, nil
 }
 
 // Trace the requested domain with the provided query type
 func (c *Client) Trace(host string, requestType uint16, maxrecursion int) (*TraceData, error) {
+	return c.TraceContext(context.Background(), host, requestType, maxrecursion)
+}
+
+// TraceContext is like Trace but honors the cancellation and deadline of ctx
+func (c *Client) TraceContext(ctx context.Context, host string, requestType uint16, maxrecursion int) (*TraceData, error) {
 	var tracedata TraceData
+	for dnsdata, err := range c.TraceIter(ctx, host, requestType, maxrecursion) {
+		if err != nil {
+			return nil, err
+		}
+		tracedata.DNSData = append(tracedata.DNSData, dnsdata)
+	}
+	return &tracedata, nil
+}
+
+// TraceIter is like TraceContext but yields the answer of each delegation hop as soon
+// as it's received. Breaking out of the loop stops the trace.
+func (c *Client) TraceIter(ctx context.Context, host string, requestType uint16, maxrecursion int) iter.Seq2[*DNSData, error] {
+	return func(yield func(*DNSData, error) bool) {
+		c.trace(ctx, host, requestType, maxrecursion, yield)
+	}
+}
+
+func (c *Client) trace(ctx context.Context, host string, requestType uint16, maxrecursion int, yield func(*DNSData, error) bool) {
 	host = dns.CanonicalName(host)
 	msg := dns.Msg{}
 	msg.SetQuestion(host, requestType)
@@ -591,9 +754,10 @@ func (c *Client) Trace(host string, requestType uint16, maxrecursion int) (*Trac
 	seenCName := make(map[string]int)
 	for i := 1; i < maxrecursion; i++ {
 		msg.SetQuestion(host, requestType)
-		dnsdatas, err := c.QueryParallel(host, requestType, servers)
+		dnsdatas, err := c.QueryParallelContext(ctx, host, requestType, servers)
 		if err != nil {
-			return nil, err
+			yield(nil, err)
+			return
 		}
 
 		for _, server := range servers {
@@ -601,12 +765,14 @@ func (c *Client) Trace(host string, requestType uint16, maxrecursion int) (*Trac
 		}
 
 		if len(dnsdatas) == 0 {
-			return &tracedata, nil
+			return
 		}
 
 		for _, dnsdata := range dnsdatas {
 			if dnsdata != nil && len(dnsdata.Resolver) > 0 {
-				tracedata.DNSData = append(tracedata.DNSData, dnsdata)
+				if !yield(dnsdata, nil) {
+					return
+				}
 			}
 		}
 
@@ -615,7 +781,7 @@ func (c *Client) Trace(host string, requestType uint16, maxrecursion int) (*Trac
 		for _, d := range dnsdatas {
 			// Add ns records as new resolvers
 			for _, ns := range d.NS {
-				ips, err := net.LookupIP(ns)
+				ips, err := net.DefaultResolver.LookupIP(ctx, "ip", ns)
 				if err != nil {
 					continue
 				}
@@ -658,13 +824,110 @@ func (c *Client) Trace(host string, requestType uint16, maxrecursion int) (*Trac
 			host = nextCname
 		}
 	}
+}
 
-	return &tracedata, nil
+func (c *Client) axfr(ctx context.Context, host string) (*AXFRData, error) {
+	resolvers, err := c.axfrResolvers(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []*DNSData
+	// perform zone transfer for each ns
+	for _, resolver := range resolvers {
+		nsData, err := c.QueryMultipleWithResolverContext(ctx, host, []uint16{dns.TypeAXFR}, resolver)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		data = append(data, nsData)
+	}
+
+	return &AXFRData{Host: host, DNSData: data}, nil
 }
 
-func (c *Client) axfr(host string) (*AXFRData, error) {
+// AXFRIter is like AXFRContext but yields the records of each envelope of the zone
+// transfers as they arrive, so that large zones are never held in memory. Name servers
+// refusing the transfer are skipped, while an error in the middle of a transfer is
+// yielded before moving to the next name server. Breaking out of the loop closes the
+// transfer connection.
+func (c *Client) AXFRIter(ctx context.Context, host string) iter.Seq2[*DNSData, error] {
+	return func(yield func(*DNSData, error) bool) {
+		resolvers, err := c.axfrResolvers(ctx, host)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		msg := new(dns.Msg)
+		msg.SetAxfr(dns.Fqdn(host))
+		for _, resolver := range resolvers {
+			if !c.axfrStream(ctx, host, resolver, msg, yield) {
+				return
+			}
+		}
+	}
+}
+
+// axfrStream yields the envelopes of a zone transfer from resolver and returns false if the iteration must stop
+func (c *Client) axfrStream(ctx context.Context, host string, resolver Resolver, msg *dns.Msg, yield func(*DNSData, error) bool) bool {
+	transferCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	envelopes, err := c.transfer(transferCtx, resolver, msg)
+	if err != nil {
+		if ctx.Err() != nil {
+			yield(nil, contextError(ctx))
+			return false
+		}
+		return true
+	}
+	// unblock the transfer goroutine once the connection is closed
+	defer func() {
+		go func() {
+			for range envelopes {
+			}
+		}()
+	}()
+	first := true
+	for envelope := range envelopes {
+		if ctx.Err() != nil {
+			yield(nil, contextError(ctx))
+			return false
+		}
+		if envelope.Error != nil {
+			if first && isTransferRefusal(envelope.Error) {
+				return true
+			}
+			return yield(nil, fmt.Errorf("zone transfer from %s failed: %w", resolver.String(), envelope.Error))
+		}
+		first = false
+		data := &DNSData{Host: host, Resolver: []string{resolver.String()}, Timestamp: time.Now()}
+		if err := data.ParseFromRR(envelope.RR); err != nil {
+			return yield(nil, err)
+		}
+		if !yield(data, nil) {
+			return false
+		}
+	}
+	if ctx.Err() != nil {
+		yield(nil, contextError(ctx))
+		return false
+	}
+	return true
+}
+
+// isTransferRefusal tells whether err is the error rcode, e.g. REFUSED or NOTAUTH,
+// a name server answers a zone transfer with
+func isTransferRefusal(err error) bool {
+	var dnsErr *dns.Error
+	return errors.As(err, &dnsErr) && strings.HasPrefix(dnsErr.Error(), "dns: bad xfr rcode")
+}
+
+// axfrResolvers returns the name servers of host followed by the client resolvers
+func (c *Client) axfrResolvers(ctx context.Context, host string) ([]Resolver, error) {
 	// obtain ns servers
-	dnsData, err := c.NS(host)
+	dnsData, err := c.QueryContext(ctx, host, dns.TypeNS)
 	if err != nil {
 		return nil, err
 	}
@@ -672,8 +935,11 @@ func (c *Client) axfr(host string) (*AXFRData, error) {
 	var resolvers []Resolver
 
 	for _, ns := range dnsData.NS {
-		nsData, err := c.A(ns)
+		nsData, err := c.QueryContext(ctx, ns, dns.TypeA)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
 			continue
 		}
 		for _, a := range nsData.A {
@@ -681,19 +947,7 @@ func (c *Client) axfr(host string) (*AXFRData, error) {
 		}
 	}
 
-	resolvers = append(resolvers, c.resolvers...)
-
-	var data []*DNSData
-	// perform zone transfer for each ns
-	for _, resolver := range resolvers {
-		nsData, err := c.QueryMultipleWithResolver(host, []uint16{dns.TypeAXFR}, resolver)
-		if err != nil {
-			continue
-		}
-		data = append(data, nsData)
-	}
-
-	return &AXFRData{Host: host, DNSData: data}, nil
+	return append(resolvers, c.resolvers...), nil
 }
 
 func (c *Client) Close() {
@@ -701,34 +955,59 @@ func (c *Client) Close() {
 		connPool.Close()
 		return nil
 	})
+	c.transports.Range(func(_, t any) bool {
+		if closer, ok := t.(io.Closer); ok {
+			_ = closer.Close()
+		}
+		return true
+	})
 }
 
-// DNSData is the data for a DNS request response
+// DNSData is the data for a DNS request response, RTT is the total round
+// trip time of the responses whose records were parsed
 type DNSData struct {
-	Host           string     `json:"host,omitempty"`
-	TTL            uint32     `json:"ttl,omitempty"`
-	Resolver       []string   `json:"resolver,omitempty"`
-	A              []string   `json:"a,omitempty"`
-	AAAA           []string   `json:"aaaa,omitempty"`
-	CNAME          []string   `json:"cname,omitempty"`
-	MX             []string   `json:"mx,omitempty"`
-	PTR            []string   `json:"ptr,omitempty"`
-	SOA            []SOA      `json:"soa,omitempty"`
-	NS             []string   `json:"ns,omitempty"`
-	TXT            []string   `json:"txt,omitempty"`
-	SRV            []string   `json:"srv,omitempty"`
-	CAA            []string   `json:"caa,omitempty"`
-	AllRecords     []string   `json:"all,omitempty"`
-	Raw            string     `json:"raw,omitempty"`
-	HasInternalIPs bool       `json:"has_internal_ips,omitempty"`
-	InternalIPs    []string   `json:"internal_ips,omitempty"`
-	StatusCode     string     `json:"status_code,omitempty"`
-	StatusCodeRaw  int        `json:"status_code_raw,omitempty"`
-	TraceData      *TraceData `json:"trace,omitempty"`
-	AXFRData       *AXFRData  `json:"axfr,omitempty"`
-	RawResp        *dns.Msg   `json:"raw_resp,omitempty"`
-	Timestamp      time.Time  `json:"timestamp,omitempty"`
-	HostsFile      bool       `json:"hosts_file,omitempty"`
+	Host           string        `json:"host,omitempty"`
+	TTL            uint32        `json:"ttl,omitempty"`
+	Resolver       []string      `json:"resolver,omitempty"`
+	A              []string      `json:"a,omitempty"`
+	AAAA           []string      `json:"aaaa,omitempty"`
+	CNAME          []string      `json:"cname,omitempty"`
+	MX             []string      `json:"mx,omitempty"`
+	PTR            []string      `json:"ptr,omitempty"`
+	SOA            []SOA         `json:"soa,omitempty"`
+	NS             []string      `json:"ns,omitempty"`
+	TXT            []string      `json:"txt,omitempty"`
+	SRV            []string      `json:"srv,omitempty"`
+	CAA            []string      `json:"caa,omitempty"`
+	MXRecords      []MX          `json:"mx_records,omitempty"`
+	SRVRecords     []SRV         `json:"srv_records,omitempty"`
+	CAARecords     []CAA         `json:"caa_records,omitempty"`
+	HTTPS          []SVCB        `json:"https,omitempty"`
+	SVCB           []SVCB        `json:"svcb,omitempty"`
+	TLSA           []TLSA        `json:"tlsa,omitempty"`
+	SSHFP          []SSHFP       `json:"sshfp,omitempty"`
+	DS             []DS          `json:"ds,omitempty"`
+	DNSKEY         []DNSKEY      `json:"dnskey,omitempty"`
+	NAPTR          []NAPTR       `json:"naptr,omitempty"`
+	URI            []URI         `json:"uri,omitempty"`
+	LOC            []LOC         `json:"loc,omitempty"`
+	HINFO          []HINFO       `json:"hinfo,omitempty"`
+	Records        []Record      `json:"records,omitempty"`
+	Flags          *Flags        `json:"flags,omitempty"`
+	RTT            time.Duration `json:"rtt,omitempty"`
+	AllRecords     []string      `json:"all,omitempty"`
+	Raw            string        `json:"raw,omitempty"`
+	HasInternalIPs bool          `json:"has_internal_ips,omitempty"`
+	InternalIPs    []string      `json:"internal_ips,omitempty"`
+	StatusCode     string        `json:"status_code,omitempty"`
+	StatusCodeRaw  int           `json:"status_code_raw,omitempty"`
+	TraceData      *TraceData    `json:"trace,omitempty"`
+	AXFRData       *AXFRData     `json:"axfr,omitempty"`
+	RawResp        *dns.Msg      `json:"raw_resp,omitempty"`
+	Timestamp      time.Time     `json:"timestamp,omitempty"`
+	HostsFile      bool          `json:"hosts_file,omitempty"`
+	FromCache      bool          `json:"from_cache,omitempty"`
+	Attempts       []Attempt     `json:"attempts,omitempty"`
 }
 
 type SOA struct {
@@ -740,13 +1019,43 @@ type SOA struct {
 	Retry   uint32 `json:"retry,omitempty"`
 	Expire  uint32 `json:"expire,omitempty"`
 	Minttl  uint32 `json:"minttl,omitempty"`
+	TTL     uint32 `json:"ttl,omitempty"`
+}
+
+// MX is a mail exchange record
+type MX struct {
+	Preference uint16 `json:"preference"`
+	Host       string `json:"host,omitempty"`
+	TTL        uint32 `json:"ttl,omitempty"`
+}
+
+// SRV is a service location record
+type SRV struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Port     uint16 `json:"port"`
+	Target   string `json:"target,omitempty"`
+	TTL      uint32 `json:"ttl,omitempty"`
+}
+
+// CAA is a certification authority authorization record
+type CAA struct {
+	Flag  uint8  `json:"flag"`
+	Tag   string `json:"tag,omitempty"`
+	Value string `json:"value,omitempty"`
+	TTL   uint32 `json:"ttl,omitempty"`
 }
 
 // CheckInternalIPs when set to true returns if DNS response IPs
 // belong to internal IP ranges.
 var CheckInternalIPs = false
 
+// ParseFromRR parses the records as answer records
 func (d *DNSData) ParseFromRR(rrs []dns.RR) error {
+	return d.parseFromRR(rrs, SectionAnswer)
+}
+
+func (d *DNSData) parseFromRR(rrs []dns.RR, section Section) error {
 	for _, record := range rrs {
 		if d.TTL == 0 && record.Header().Ttl > 0 {
 			d.TTL = record.Header().Ttl
@@ -772,37 +1081,122 @@ func (d *DNSData) ParseFromRR(rrs []dns.RR) error {
 				Retry:   recordType.Retry,
 				Expire:  recordType.Expire,
 				Minttl:  recordType.Minttl,
+				TTL:     recordType.Hdr.Ttl,
 			},
 			)
 		case *dns.PTR:
 			d.PTR = append(d.PTR, trimChars(recordType.Ptr))
 		case *dns.MX:
 			d.MX = append(d.MX, trimChars(recordType.Mx))
+			d.MXRecords = append(d.MXRecords, MX{
+				Preference: recordType.Preference,
+				Host:       trimChars(recordType.Mx),
+				TTL:        recordType.Hdr.Ttl,
+			})
 		case *dns.CAA:
 			d.CAA = append(d.CAA, trimChars(recordType.Value))
+			d.CAARecords = append(d.CAARecords, CAA{
+				Flag:  recordType.Flag,
+				Tag:   recordType.Tag,
+				Value: recordType.Value,
+				TTL:   recordType.Hdr.Ttl,
+			})
 		case *dns.TXT:
 			// Per RFC 7208, a single TXT record can be broken up into multiple parts and "MUST be treated as if those strings are concatenated
 			// together without adding spaces"; see: https://www.rfc-editor.org/rfc/rfc7208
 			d.TXT = append(d.TXT, strings.Join(recordType.Txt, ""))
 		case *dns.SRV:
 			d.SRV = append(d.SRV, trimChars(recordType.Target))
+			d.SRVRecords = append(d.SRVRecords, SRV{
+				Priority: recordType.Priority,
+				Weight:   recordType.Weight,
+				Port:     recordType.Port,
+				Target:   trimChars(recordType.Target),
+				TTL:      recordType.Hdr.Ttl,
+			})
 		case *dns.AAAA:
 			if CheckInternalIPs && internalRangeCheckerInstance.ContainsIPv6(recordType.AAAA) {
 				d.HasInternalIPs = true
 				d.InternalIPs = append(d.InternalIPs, trimChars(recordType.AAAA.String()))
 			}
 			d.AAAA = append(d.AAAA, trimChars(recordType.AAAA.String()))
+		case *dns.HTTPS:
+			d.HTTPS = append(d.HTTPS, newSVCB(&recordType.SVCB))
+		case *dns.SVCB:
+			d.SVCB = append(d.SVCB, newSVCB(recordType))
+		case *dns.TLSA:
+			d.TLSA = append(d.TLSA, TLSA{
+				Usage:        recordType.Usage,
+				Selector:     recordType.Selector,
+				MatchingType: recordType.MatchingType,
+				Certificate:  recordType.Certificate,
+				TTL:          recordType.Hdr.Ttl,
+			})
+		case *dns.SSHFP:
+			d.SSHFP = append(d.SSHFP, SSHFP{
+				Algorithm:   recordType.Algorithm,
+				Type:        recordType.Type,
+				Fingerprint: recordType.FingerPrint,
+				TTL:         recordType.Hdr.Ttl,
+			})
+		case *dns.DS:
+			d.DS = append(d.DS, DS{
+				KeyTag:     recordType.KeyTag,
+				Algorithm:  recordType.Algorithm,
+				DigestType: recordType.DigestType,
+				Digest:     recordType.Digest,
+				TTL:        recordType.Hdr.Ttl,
+			})
+		case *dns.DNSKEY:
+			d.DNSKEY = append(d.DNSKEY, DNSKEY{
+				Flags:     recordType.Flags,
+				Protocol:  recordType.Protocol,
+				Algorithm: recordType.Algorithm,
+				PublicKey: recordType.PublicKey,
+				KeyTag:    recordType.KeyTag(),
+				TTL:       recordType.Hdr.Ttl,
+			})
+		case *dns.NAPTR:
+			d.NAPTR = append(d.NAPTR, NAPTR{
+				Order:       recordType.Order,
+				Preference:  recordType.Preference,
+				Flags:       recordType.Flags,
+				Service:     recordType.Service,
+				Regexp:      recordType.Regexp,
+				Replacement: trimChars(recordType.Replacement),
+				TTL:         recordType.Hdr.Ttl,
+			})
+		case *dns.URI:
+			d.URI = append(d.URI, URI{
+				Priority: recordType.Priority,
+				Weight:   recordType.Weight,
+				Target:   recordType.Target,
+				TTL:      recordType.Hdr.Ttl,
+			})
+		case *dns.LOC:
+			d.LOC = append(d.LOC, newLOC(recordType))
+		case *dns.HINFO:
+			d.HINFO = append(d.HINFO, HINFO{CPU: recordType.Cpu, OS: recordType.Os, TTL: recordType.Hdr.Ttl})
 		}
 		d.AllRecords = append(d.AllRecords, record.String())
+		// the OPT pseudo record carries EDNS options, not data
+		if record.Header().Rrtype != dns.TypeOPT {
+			d.Records = append(d.Records, newRecord(record, section))
+		}
 	}
 	return nil
 }
 
 // ParseFromMsg and enrich data
 func (d *DNSData) ParseFromMsg(msg *dns.Msg) error {
-	allRecords := append(msg.Answer, msg.Extra...)
-	allRecords = append(allRecords, msg.Ns...)
-	return d.ParseFromRR(allRecords)
+	d.Flags = d.Flags.merge(newFlags(msg))
+	if err := d.parseFromRR(msg.Answer, SectionAnswer); err != nil {
+		return err
+	}
+	if err := d.parseFromRR(msg.Extra, SectionAdditional); err != nil {
+		return err
+	}
+	return d.parseFromRR(msg.Ns, SectionAuthority)
 }
 
 func (d *DNSData) ParseFromEnvelopeChan(envChan chan *dns.Envelope) error {
@@ -816,10 +1210,6 @@ func (d *DNSData) ParseFromEnvelopeChan(envChan chan *dns.Envelope) error {
 	return d.ParseFromRR(allRecords)
 }
 
-func (d *DNSData) contains() bool {
-	return len(d.A) > 0 || len(d.AAAA) > 0 || len(d.CNAME) > 0 || len(d.MX) > 0 || len(d.NS) > 0 || len(d.PTR) > 0 || len(d.TXT) > 0 || len(d.SRV) > 0 || len(d.SOA) > 0 || len(d.CAA) > 0
-}
-
 // JSON returns the object as json string
 func (d *DNSData) JSON() (string, error) {
 	b, err := json.Marshal(&d)
@@ -842,6 +1232,21 @@ func (d *DNSData) dedupe() {
 	d.SRV = sliceutil.Dedupe(d.SRV)
 	d.SOA = d.dedupeSOA(d.SOA)
 	d.CAA = sliceutil.Dedupe(d.CAA)
+	// records returned by several resolvers only differ by their ttl
+	d.MXRecords = sliceutil.DedupeFunc(d.MXRecords, func(mx MX) any { mx.TTL = 0; return mx })
+	d.SRVRecords = sliceutil.DedupeFunc(d.SRVRecords, func(srv SRV) any { srv.TTL = 0; return srv })
+	d.CAARecords = sliceutil.DedupeFunc(d.CAARecords, func(caa CAA) any { caa.TTL = 0; return caa })
+	d.HTTPS = sliceutil.DedupeFunc(d.HTTPS, func(https SVCB) any { https.TTL = 0; return fmt.Sprintf("%+v", https) })
+	d.SVCB = sliceutil.DedupeFunc(d.SVCB, func(svcb SVCB) any { svcb.TTL = 0; return fmt.Sprintf("%+v", svcb) })
+	d.TLSA = sliceutil.DedupeFunc(d.TLSA, func(tlsa TLSA) any { tlsa.TTL = 0; return tlsa })
+	d.SSHFP = sliceutil.DedupeFunc(d.SSHFP, func(sshfp SSHFP) any { sshfp.TTL = 0; return sshfp })
+	d.DS = sliceutil.DedupeFunc(d.DS, func(ds DS) any { ds.TTL = 0; return ds })
+	d.DNSKEY = sliceutil.DedupeFunc(d.DNSKEY, func(dnskey DNSKEY) any { dnskey.TTL = 0; return dnskey })
+	d.NAPTR = sliceutil.DedupeFunc(d.NAPTR, func(naptr NAPTR) any { naptr.TTL = 0; return naptr })
+	d.URI = sliceutil.DedupeFunc(d.URI, func(uri URI) any { uri.TTL = 0; return uri })
+	d.LOC = sliceutil.DedupeFunc(d.LOC, func(loc LOC) any { loc.TTL = 0; return loc })
+	d.HINFO = sliceutil.DedupeFunc(d.HINFO, func(hinfo HINFO) any { hinfo.TTL = 0; return hinfo })
+	d.Records = sliceutil.DedupeFunc(d.Records, func(record Record) any { record.TTL = 0; return record })
 	d.AllRecords = sliceutil.Dedupe(d.AllRecords)
 }
 
@@ -1,7 +1,12 @@
 package retryabledns
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -143,9 +148,12 @@ func TestRetries(t *testing.T) {
 	}
 	msg.Question[0] = question
 
-	// Test with raw Do() interface as well
+	// Test with raw Do() interface as well, the sentinel is wrapped in a ResolveError
 	_, err = client.Do(msg)
-	require.True(t, err == ErrRetriesExceeded)
+	require.ErrorIs(t, err, ErrRetriesExceeded)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, err, &resolveErr)
+	require.Len(t, resolveErr.Attempts, 5)
 }
 
 func TestNoRecords(t *testing.T) {
@@ -257,3 +265,239 @@ func TestInternalIPDetectionJSONOutput(t *testing.T) {
 	assert.Contains(t, jsonOutput, `"internal_ips":["127.0.0.1"]`)
 	assert.Contains(t, jsonOutput, `"hosts_file":true`)
 }
+
+// runLocalDNSServer starts a dns server on a random local port for the given
+// network ("udp" or "tcp") and returns its address
+func runLocalDNSServer(t *testing.T, network string, handler dns.HandlerFunc) string {
+	t.Helper()
+	started := make(chan struct{})
+	server := &dns.Server{Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	var addr string
+	switch network {
+	case "tcp":
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		server.Listener = listener
+		addr = listener.Addr().String()
+	default:
+		packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		server.PacketConn = packetConn
+		addr = packetConn.LocalAddr().String()
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return addr
+}
+
+func TestContextCancellation(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	silent := func(w dns.ResponseWriter, r *dns.Msg) {
+		<-block
+	}
+	udpAddr := runLocalDNSServer(t, "udp", silent)
+	tcpAddr := runLocalDNSServer(t, "tcp", silent)
+
+	for _, resolver := range []string{"udp:" + udpAddr, "tcp:" + tcpAddr} {
+		t.Run(resolver, func(t *testing.T) {
+			client, err := NewWithOptions(Options{BaseResolvers: []string{resolver}, MaxRetries: 10, Timeout: 10 * time.Second})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			_, err = client.QueryContext(ctx, "example.com", dns.TypeA)
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+			require.Less(t, time.Since(start), 2*time.Second)
+
+			ctx, cancel = context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			_, err = client.DoContext(ctx, msg)
+			require.ErrorIs(t, err, context.Canceled)
+		})
+	}
+}
+
+func TestContextResolve(t *testing.T) {
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 127.0.0.2")
+		if r.Question[0].Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, rr)
+		}
+		_ = w.WriteMsg(m)
+	})
+	client, err := NewWithOptions(Options{BaseResolvers: []string{addr}, MaxRetries: 3, ConnectionPoolThreads: 2})
+	require.NoError(t, err)
+	defer client.Close()
+
+	d, err := client.ResolveContext(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.2"}, d.A)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.ResolveContext(ctx, "example.com")
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestConnPoolClose(t *testing.T) {
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})
+	resolver, err := parseResolver(addr)
+	require.NoError(t, err)
+	pool, err := NewConnPool(*resolver.(*NetworkResolver), 2)
+	require.NoError(t, err)
+	require.Len(t, pool.LocalAddrs(), 2)
+
+	conn, err := pool.getConnection(context.Background())
+	require.NoError(t, err)
+	pool.Close()
+	// exchanges finishing after close release their connection without blocking
+	pool.releaseConnection(conn)
+	_, err = pool.getConnection(context.Background())
+	require.ErrorIs(t, err, net.ErrClosed)
+	pool.Close()
+}
+
+func TestTraceIterCancelled(t *testing.T) {
+	client, err := New([]string{"127.0.0.1:53"}, 1)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var hops int
+	for data, err := range client.TraceIter(ctx, "example.com", dns.TypeA, 10) {
+		require.Nil(t, data)
+		require.ErrorIs(t, err, context.Canceled)
+		hops++
+	}
+	require.Equal(t, 1, hops)
+}
+
+func TestAXFRIter(t *testing.T) {
+	addr := runLocalDNSServer(t, "tcp", func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Qtype != dns.TypeAXFR {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			_ = w.WriteMsg(m)
+			return
+		}
+		soa, _ := dns.NewRR("example.test. 600 IN SOA ns.example.test. admin.example.test. 1 7200 3600 86400 300")
+		envelopes := make(chan *dns.Envelope)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_ = new(dns.Transfer).Out(w, r, envelopes)
+		}()
+		envelopes <- &dns.Envelope{RR: []dns.RR{soa}}
+		for i := 1; i <= 3; i++ {
+			rr, _ := dns.NewRR(fmt.Sprintf("host%d.example.test. 60 IN A 192.0.2.%d", i, i))
+			envelopes <- &dns.Envelope{RR: []dns.RR{rr}}
+		}
+		envelopes <- &dns.Envelope{RR: []dns.RR{soa}}
+		close(envelopes)
+		<-done
+		w.Hijack()
+	})
+	client, err := New([]string{"tcp:" + addr}, 1)
+	require.NoError(t, err)
+
+	var ips []string
+	for data, err := range client.AXFRIter(context.Background(), "example.test") {
+		require.NoError(t, err)
+		require.Equal(t, []string{addr}, data.Resolver)
+		ips = append(ips, data.A...)
+	}
+	require.Equal(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, ips)
+
+	// breaking out of the loop stops the transfer
+	var envelopes int
+	for _, err := range client.AXFRIter(context.Background(), "example.test") {
+		require.NoError(t, err)
+		envelopes++
+		break
+	}
+	require.Equal(t, 1, envelopes)
+
+	// name servers refusing the transfer are skipped
+	refusing := runLocalDNSServer(t, "tcp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeAXFR {
+			m.Rcode = dns.RcodeRefused
+		}
+		_ = w.WriteMsg(m)
+	})
+	client, err = New([]string{"tcp:" + refusing, "tcp:" + addr}, 1)
+	require.NoError(t, err)
+	ips = nil
+	for data, err := range client.AXFRIter(context.Background(), "example.test") {
+		require.NoError(t, err)
+		require.Equal(t, []string{addr}, data.Resolver)
+		ips = append(ips, data.A...)
+	}
+	require.Equal(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, ips)
+}
+
+func TestStructuredRecords(t *testing.T) {
+	var rrs []dns.RR
+	for _, record := range []string{
+		"example.test. 300 IN MX 10 mx1.example.test.",
+		"example.test. 300 IN MX 20 mx2.example.test.",
+		"example.test. 60 IN MX 10 mx1.example.test.",
+		"_sip._tcp.example.test. 120 IN SRV 0 5 5060 sip.example.test.",
+		"example.test. 3600 IN CAA 0 issue \"letsencrypt.org\"",
+		"example.test. 3600 IN CAA 128 iodef \"mailto:security@example.test\"",
+	} {
+		rr, err := dns.NewRR(record)
+		require.NoError(t, err)
+		rrs = append(rrs, rr)
+	}
+	data := &DNSData{}
+	require.NoError(t, data.ParseFromRR(rrs))
+	data.dedupe()
+
+	// the same record with another ttl is a duplicate
+	require.Equal(t, []MX{{Preference: 10, Host: "mx1.example.test", TTL: 300}, {Preference: 20, Host: "mx2.example.test", TTL: 300}}, data.MXRecords)
+	require.Equal(t, []SRV{{Priority: 0, Weight: 5, Port: 5060, Target: "sip.example.test", TTL: 120}}, data.SRVRecords)
+	require.Equal(t, []CAA{{Flag: 0, Tag: "issue", Value: "letsencrypt.org", TTL: 3600}, {Flag: 128, Tag: "iodef", Value: "mailto:security@example.test", TTL: 3600}}, data.CAARecords)
+
+	// the string fields are unchanged
+	require.Equal(t, []string{"mx1.example.test", "mx2.example.test"}, data.MX)
+	require.Equal(t, []string{"sip.example.test"}, data.SRV)
+	require.Equal(t, []string{"letsencrypt.org", "mailto:security@example.test"}, data.CAA)
+
+	b, err := json.Marshal(data)
+	require.NoError(t, err)
+	var fields map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(b, &fields))
+	require.JSONEq(t, `["mx1.example.test","mx2.example.test"]`, string(fields["mx"]))
+	require.JSONEq(t, `[{"priority":0,"weight":5,"port":5060,"target":"sip.example.test","ttl":120}]`, string(fields["srv_records"]))
+
+	// json produced before the structured records still decodes
+	var old DNSData
+	require.NoError(t, json.Unmarshal([]byte(`{"host":"example.test","mx":["mx1.example.test"],"srv":["sip.example.test"],"caa":["letsencrypt.org"]}`), &old))
+	require.Equal(t, []string{"mx1.example.test"}, old.MX)
+	require.Empty(t, old.MXRecords)
+
+	encoded, err := data.Marshal()
+	require.NoError(t, err)
+	decoded := &DNSData{}
+	require.NoError(t, decoded.Unmarshal(encoded))
+	require.Equal(t, data.MXRecords, decoded.MXRecords)
+	require.Equal(t, data.SRVRecords, decoded.SRVRecords)
+	require.Equal(t, data.CAARecords, decoded.CAARecords)
+}
@@ -11,11 +11,15 @@ import (
 )
 
 type ConnPool struct {
+	// items is only accessed by the coordinator goroutine
 	items      map[*dns.Conn]bool
+	conns      []*dns.Conn
 	newArrival chan *waitingClient
 	finished   chan *dns.Conn
 	clients    clientQueue
+	closed     <-chan struct{}
 	cancel     context.CancelFunc
+	done       chan struct{}
 	resolver   NetworkResolver
 }
 
@@ -25,7 +29,9 @@ func NewConnPool(resolver NetworkResolver, poolSize int) (*ConnPool, error) {
 		items:      make(map[*dns.Conn]bool, poolSize),
 		newArrival: make(chan *waitingClient),
 		finished:   make(chan *dns.Conn),
+		closed:     ctx.Done(),
 		cancel:     cancel,
+		done:       make(chan struct{}),
 		resolver:   resolver,
 	}
 	heap.Init(&pool.clients)
@@ -35,17 +41,16 @@ func NewConnPool(resolver NetworkResolver, poolSize int) (*ConnPool, error) {
 			return nil, fmt.Errorf("unable to create conn to %s: %w", resolver.String(), err)
 		}
 		pool.items[conn] = false
+		pool.conns = append(pool.conns, conn)
 	}
 	go pool.coordinate(ctx)
 	return pool, nil
 }
 
 func (cp *ConnPool) LocalAddrs() []*net.UDPAddr {
-	retval := make([]*net.UDPAddr, len(cp.items))
-	i := 0
-	for conn := range cp.items {
+	retval := make([]*net.UDPAddr, len(cp.conns))
+	for i, conn := range cp.conns {
 		retval[i] = conn.LocalAddr().(*net.UDPAddr)
-		i++
 	}
 	return retval
 }
@@ -60,17 +65,22 @@ func (cp *ConnPool) Exchange(ctx context.Context, client *dns.Client, msg *dns.M
 		return nil, time.Duration(0), err
 	}
 	defer cp.releaseConnection(conn)
-	return client.ExchangeWithConn(msg, conn)
+	return exchangeWithConnContext(ctx, client, msg, conn)
 }
 
+// Close stops the coordinator, which closes the connections on exit
 func (cp *ConnPool) Close() {
 	cp.cancel()
-	for conn := range cp.items {
-		conn.Close()
-	}
+	<-cp.done
 }
 
 func (cp *ConnPool) coordinate(ctx context.Context) {
+	defer func() {
+		for _, conn := range cp.conns {
+			_ = conn.Close()
+		}
+		close(cp.done)
+	}()
 	for {
 		select {
 		case <-ctx.Done():
@@ -106,15 +116,23 @@ func (cp *ConnPool) getConnection(ctx context.Context) (*dns.Conn, error) {
 	case cp.newArrival <- client:
 	case <-ctx.Done():
 		return nil, ctx.Err()
+	case <-cp.closed:
+		return nil, net.ErrClosed
 	}
 	select {
 	case conn := <-client.returnCh:
 		return conn, nil
 	case <-ctx.Done():
 		return nil, ctx.Err()
+	case <-cp.closed:
+		return nil, net.ErrClosed
 	}
 }
 
+// releaseConnection returns conn to the pool, exchanges finishing after Close don't block
 func (cp *ConnPool) releaseConnection(conn *dns.Conn) {
-	cp.finished <- conn
+	select {
+	case cp.finished <- conn:
+	case <-cp.closed:
+	}
 }
@@ -0,0 +1,218 @@
+package retryabledns
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// ConsensusPolicy defines how many resolvers must agree on an answer
+type ConsensusPolicy string
+
+const (
+	// ConsensusMajority requires more than half of the responding resolvers to agree
+	ConsensusMajority ConsensusPolicy = "majority"
+	// ConsensusUnanimous requires all the responding resolvers to agree
+	ConsensusUnanimous ConsensusPolicy = "unanimous"
+)
+
+func (p ConsensusPolicy) String() string {
+	return string(p)
+}
+
+var (
+	// ErrNoConsensus is returned when the resolvers answers don't satisfy the consensus policy
+	ErrNoConsensus = errors.New("resolvers did not reach consensus")
+	// ErrUnknownConsensusPolicy is returned when the consensus policy is not supported
+	ErrUnknownConsensusPolicy = errors.New("unknown consensus policy")
+)
+
+// ConsensusRecord is an answer record along with the resolvers that returned it
+type ConsensusRecord struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Value     string   `json:"value"`
+	Votes     int      `json:"votes"`
+	Resolvers []string `json:"resolvers"`
+	Agreed    bool     `json:"agreed"`
+}
+
+// ConsensusResult is the outcome of a question sent to multiple resolvers
+type ConsensusResult struct {
+	Host   string          `json:"host"`
+	Policy ConsensusPolicy `json:"policy"`
+	// Data is the agreed answer, its Resolver field lists the agreeing resolvers
+	Data *DNSData `json:"data,omitempty"`
+	// Records lists every distinct answer record with its agreement count
+	Records []ConsensusRecord `json:"records,omitempty"`
+	// Queried is the number of resolvers the question was sent to
+	Queried int `json:"queried"`
+	// Agreeing lists the resolvers that returned the agreed answer
+	Agreeing []string `json:"agreeing,omitempty"`
+	// Disagreeing lists the resolvers that returned a different answer
+	Disagreeing []string `json:"disagreeing,omitempty"`
+	// Failed lists the resolvers that didn't answer
+	Failed []string `json:"failed,omitempty"`
+}
+
+// consensusVote is the answer of a single resolver
+type consensusVote struct {
+	resolver string
+	data     *DNSData
+	records  []string
+	key      string
+}
+
+// recordKey returns the record with its ttl removed, so that answers cached for different times compare equal
+func recordKey(rr dns.RR) (string, ConsensusRecord) {
+	rr = dns.Copy(rr)
+	hdr := rr.Header()
+	hdr.Ttl = 0
+	hdr.Name = strings.ToLower(hdr.Name)
+	record := ConsensusRecord{
+		Name:  strings.TrimSuffix(hdr.Name, "."),
+		Type:  dns.TypeToString[hdr.Rrtype],
+		Value: strings.TrimSpace(strings.TrimPrefix(rr.String(), hdr.String())),
+	}
+	return rr.String(), record
+}
+
+// Consensus sends the question to multiple resolvers and returns the answer they agree on
+func (c *Client) Consensus(host string, requestType uint16) (*ConsensusResult, error) {
+	return c.ConsensusContext(context.Background(), host, requestType)
+}
+
+// ConsensusContext is like Consensus but honors the cancellation and deadline of ctx.
+// The question is sent to ConsensusResolvers resolvers (all of them by default) and the
+// answers are compared ignoring ttls and record order. When the answers don't satisfy
+// ConsensusPolicy the partial result is returned along with ErrNoConsensus.
+func (c *Client) ConsensusContext(ctx context.Context, host string, requestType uint16) (*ConsensusResult, error) {
+	policy := c.options.ConsensusPolicy
+	if policy == "" {
+		policy = ConsensusMajority
+	}
+	resolvers := c.consensusResolvers()
+	result := &ConsensusResult{Host: host, Policy: policy, Queried: len(resolvers)}
+
+	votes := make([]*consensusVote, len(resolvers))
+	var wg sync.WaitGroup
+	for i, resolver := range resolvers {
+		wg.Add(1)
+		go func(i int, resolver Resolver) {
+			defer wg.Done()
+			data, err := c.queryMultiple(ctx, host, []uint16{requestType}, resolver)
+			if err != nil || data == nil || data.RawResp == nil {
+				return
+			}
+			vote := &consensusVote{resolver: resolver.String(), data: data}
+			for _, rr := range data.RawResp.Answer {
+				key, _ := recordKey(rr)
+				vote.records = append(vote.records, key)
+			}
+			slices.Sort(vote.records)
+			vote.records = slices.Compact(vote.records)
+			vote.key = dns.RcodeToString[data.RawResp.Rcode] + "\n" + strings.Join(vote.records, "\n")
+			votes[i] = vote
+		}(i, resolver)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return result, contextError(ctx)
+	}
+
+	// count identical answer sets and individual records
+	var (
+		responded  int
+		setVotes   = make(map[string]int)
+		records    = make(map[string]*ConsensusRecord)
+		recordKeys []string
+	)
+	for i, vote := range votes {
+		if vote == nil {
+			result.Failed = append(result.Failed, resolvers[i].String())
+			continue
+		}
+		responded++
+		setVotes[vote.key]++
+		for _, rr := range vote.data.RawResp.Answer {
+			key, record := recordKey(rr)
+			existing, ok := records[key]
+			if !ok {
+				existing = &record
+				records[key] = existing
+				recordKeys = append(recordKeys, key)
+			}
+			if !slices.Contains(existing.Resolvers, vote.resolver) {
+				existing.Votes++
+				existing.Resolvers = append(existing.Resolvers, vote.resolver)
+			}
+		}
+	}
+	if responded == 0 {
+		return result, ErrNoConsensus
+	}
+
+	var winner *consensusVote
+	for _, vote := range votes {
+		if vote != nil && (winner == nil || setVotes[vote.key] > setVotes[winner.key]) {
+			winner = vote
+		}
+	}
+	for _, vote := range votes {
+		switch {
+		case vote == nil:
+		case vote.key == winner.key:
+			result.Agreeing = append(result.Agreeing, vote.resolver)
+		default:
+			result.Disagreeing = append(result.Disagreeing, vote.resolver)
+		}
+	}
+	for _, key := range recordKeys {
+		record := records[key]
+		_, record.Agreed = slices.BinarySearch(winner.records, key)
+		result.Records = append(result.Records, *record)
+	}
+	slices.SortStableFunc(result.Records, func(a, b ConsensusRecord) int {
+		return b.Votes - a.Votes
+	})
+
+	agreed := setVotes[winner.key]
+	switch policy {
+	case ConsensusUnanimous:
+		if agreed != responded {
+			return result, ErrNoConsensus
+		}
+	default:
+		if agreed*2 <= responded {
+			return result, ErrNoConsensus
+		}
+	}
+
+	result.Data = winner.data
+	result.Data.Resolver = result.Agreeing
+	return result, nil
+}
+
+// consensusResolvers returns the distinct resolvers a consensus question is sent to
+func (c *Client) consensusResolvers() []Resolver {
+	count := c.options.ConsensusResolvers
+	if count <= 0 || count >= len(c.resolvers) {
+		return c.resolvers
+	}
+	selected := make([]Resolver, 0, count)
+	seen := make(map[string]struct{}, count)
+	for i := 0; i < len(c.resolvers)*2 && len(selected) < count; i++ {
+		resolver := c.nextResolver()
+		if _, ok := seen[resolver.String()]; ok {
+			continue
+		}
+		seen[resolver.String()] = struct{}{}
+		selected = append(selected, resolver)
+	}
+	return selected
+}
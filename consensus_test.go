@@ -0,0 +1,91 @@
+package retryabledns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func runAnswerServer(t *testing.T, ttl string, ips ...string) string {
+	return runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, ip := range ips {
+			rr, _ := dns.NewRR(r.Question[0].Name + " " + ttl + " IN A " + ip)
+			m.Answer = append(m.Answer, rr)
+		}
+		_ = w.WriteMsg(m)
+	})
+}
+
+func TestConsensus(t *testing.T) {
+	honest1 := runAnswerServer(t, "60", "127.0.0.1", "127.0.0.2")
+	// same records with a different ttl and order
+	honest2 := runAnswerServer(t, "30", "127.0.0.2", "127.0.0.1")
+	poisoned := runAnswerServer(t, "60", "127.0.0.1", "6.6.6.6")
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	// the socket is kept open without answering so that queries time out
+	defer listener.Close()
+	silent := listener.LocalAddr().String()
+
+	options := Options{
+		BaseResolvers: []string{honest1, honest2, poisoned, silent},
+		MaxRetries:    1,
+		Timeout:       200 * time.Millisecond,
+	}
+	client, err := NewWithOptions(options)
+	require.NoError(t, err)
+
+	result, err := client.Consensus("example.com", dns.TypeA)
+	require.NoError(t, err)
+	require.Equal(t, ConsensusMajority, result.Policy)
+	require.Equal(t, 4, result.Queried)
+	require.ElementsMatch(t, []string{"127.0.0.1", "127.0.0.2"}, result.Data.A)
+	require.ElementsMatch(t, []string{honest1, honest2}, result.Agreeing)
+	require.ElementsMatch(t, []string{honest1, honest2}, result.Data.Resolver)
+	require.Equal(t, []string{poisoned}, result.Disagreeing)
+	require.Equal(t, []string{silent}, result.Failed)
+
+	votes := make(map[string]ConsensusRecord)
+	for _, record := range result.Records {
+		votes[record.Value] = record
+	}
+	require.Len(t, votes, 3)
+	require.Equal(t, 3, votes["127.0.0.1"].Votes)
+	require.True(t, votes["127.0.0.1"].Agreed)
+	require.Equal(t, 2, votes["127.0.0.2"].Votes)
+	require.Equal(t, 1, votes["6.6.6.6"].Votes)
+	require.False(t, votes["6.6.6.6"].Agreed)
+	require.Equal(t, []string{poisoned}, votes["6.6.6.6"].Resolvers)
+	require.Equal(t, "A", votes["6.6.6.6"].Type)
+	require.Equal(t, "example.com", votes["6.6.6.6"].Name)
+	require.Equal(t, 3, result.Records[0].Votes)
+
+	options.ConsensusPolicy = ConsensusUnanimous
+	client, err = NewWithOptions(options)
+	require.NoError(t, err)
+	result, err = client.Consensus("example.com", dns.TypeA)
+	require.ErrorIs(t, err, ErrNoConsensus)
+	require.Nil(t, result.Data)
+	require.Equal(t, []string{poisoned}, result.Disagreeing)
+
+	options.BaseResolvers = []string{honest1, honest2, poisoned}
+	options.ConsensusResolvers = 2
+	client, err = NewWithOptions(options)
+	require.NoError(t, err)
+	result, err = client.Consensus("example.com", dns.TypeA)
+	require.Equal(t, 2, result.Queried)
+	if len(result.Disagreeing) > 0 {
+		require.ErrorIs(t, err, ErrNoConsensus)
+	} else {
+		require.NoError(t, err)
+	}
+
+	options.ConsensusPolicy = "quorum"
+	require.ErrorIs(t, options.Validate(), ErrUnknownConsensusPolicy)
+}
@@ -0,0 +1,524 @@
+package retryabledns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+var (
+	// ErrDNSCryptCertificate is returned when a dnscrypt resolver publishes no valid certificate
+	ErrDNSCryptCertificate = errors.New("no valid dnscrypt certificate")
+	// ErrDNSCryptResponse is returned when a dnscrypt response can't be authenticated
+	ErrDNSCryptResponse = errors.New("invalid dnscrypt response")
+)
+
+// DNSCryptResolver is a DNSCrypt v2 resolver (https://dnscrypt.info/protocol)
+type DNSCryptResolver struct {
+	Host string
+	Port string
+	// ProviderName is the name the resolver certificates are published at,
+	// e.g. 2.dnscrypt-cert.example.com
+	ProviderName string
+	// PublicKey is the provider key signing the resolver certificates
+	PublicKey ed25519.PublicKey
+}
+
+// Scheme returns the transport registry key of the resolver
+func (r DNSCryptResolver) Scheme() string {
+	return DNSCrypt.String()
+}
+
+func (r DNSCryptResolver) String() string {
+	return net.JoinHostPort(r.Host, r.Port)
+}
+
+// parseDNSCryptResolver parses either a stamp or host[:port]#provider-name/hex-public-key
+func parseDNSCryptResolver(r string) (*DNSCryptResolver, error) {
+	if strings.HasPrefix(r, stampScheme) {
+		st, err := decodeStamp(r)
+		if err != nil {
+			return nil, err
+		}
+		if st.protocol != stampDNSCrypt {
+			return nil, fmt.Errorf("%w: not a dnscrypt stamp", ErrInvalidResolver)
+		}
+		return newDNSCryptResolver(st.addr, st.providerName, st.publicKey)
+	}
+	addr, provider, ok := strings.Cut(r, "#")
+	providerName, publicKey, ok2 := strings.Cut(provider, "/")
+	if !ok || !ok2 {
+		return nil, fmt.Errorf("%w: dnscrypt resolvers need a provider name and public key", ErrInvalidResolver)
+	}
+	key, err := hex.DecodeString(strings.ReplaceAll(publicKey, ":", ""))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid dnscrypt public key", ErrInvalidResolver)
+	}
+	return newDNSCryptResolver(addr, providerName, key)
+}
+
+func newDNSCryptResolver(addr, providerName string, publicKey []byte) (*DNSCryptResolver, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: invalid dnscrypt public key", ErrInvalidResolver)
+	}
+	if _, ok := dns.IsDomainName(providerName); !ok || providerName == "" {
+		return nil, fmt.Errorf("%w: invalid dnscrypt provider name %q", ErrInvalidResolver, providerName)
+	}
+	networkResolver := &NetworkResolver{Protocol: DNSCrypt}
+	if err := parseHostPort(networkResolver, addr); err != nil {
+		return nil, err
+	}
+	return &DNSCryptResolver{
+		Host:         networkResolver.Host,
+		Port:         networkResolver.Port,
+		ProviderName: providerName,
+		PublicKey:    ed25519.PublicKey(publicKey),
+	}, nil
+}
+
+// dnscryptConstruction is the encryption system of a certificate
+type dnscryptConstruction uint16
+
+const (
+	dnscryptXSalsa20Poly1305  dnscryptConstruction = 1
+	dnscryptXChaCha20Poly1305 dnscryptConstruction = 2
+)
+
+const (
+	dnscryptCertSize      = 124
+	dnscryptKeySize       = 32
+	dnscryptMagicSize     = 8
+	dnscryptNonceSize     = 24
+	dnscryptHalfNonceSize = dnscryptNonceSize / 2
+	// dnscryptMinQuerySize is the minimum size of udp queries, responses larger than
+	// the query are truncated by the resolver
+	dnscryptMinQuerySize = 256
+	dnscryptPaddingBlock = 64
+)
+
+var (
+	dnscryptCertMagic     = []byte("DNSC")
+	dnscryptResolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+)
+
+// dnscryptCert is a verified resolver certificate
+type dnscryptCert struct {
+	construction dnscryptConstruction
+	resolverKey  [dnscryptKeySize]byte
+	clientMagic  [dnscryptMagicSize]byte
+	serial       uint32
+	notBefore    time.Time
+	notAfter     time.Time
+}
+
+// parseDNSCryptCert verifies the signature of a certificate with the provider key
+func parseDNSCryptCert(data []byte, providerKey ed25519.PublicKey) (*dnscryptCert, error) {
+	if len(data) < dnscryptCertSize || !bytes.Equal(data[:4], dnscryptCertMagic) {
+		return nil, errors.New("malformed certificate")
+	}
+	cert := &dnscryptCert{construction: dnscryptConstruction(binary.BigEndian.Uint16(data[4:6]))}
+	if cert.construction != dnscryptXSalsa20Poly1305 && cert.construction != dnscryptXChaCha20Poly1305 {
+		return nil, fmt.Errorf("unsupported construction %d", cert.construction)
+	}
+	signature, signed := data[8:72], data[72:]
+	if !ed25519.Verify(providerKey, signed, signature) {
+		return nil, errors.New("invalid certificate signature")
+	}
+	copy(cert.resolverKey[:], signed[0:32])
+	copy(cert.clientMagic[:], signed[32:40])
+	cert.serial = binary.BigEndian.Uint32(signed[40:44])
+	cert.notBefore = time.Unix(int64(binary.BigEndian.Uint32(signed[44:48])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(signed[48:52])), 0)
+	return cert, nil
+}
+
+func (cert *dnscryptCert) valid(now time.Time) bool {
+	return !now.Before(cert.notBefore) && now.Before(cert.notAfter)
+}
+
+// sharedKey derives the key shared by the client secret key and the resolver key
+func (cert *dnscryptCert) sharedKey(clientKey *ecdh.PrivateKey) (*[dnscryptKeySize]byte, error) {
+	var key [dnscryptKeySize]byte
+	if cert.construction == dnscryptXSalsa20Poly1305 {
+		var secret [dnscryptKeySize]byte
+		copy(secret[:], clientKey.Bytes())
+		box.Precompute(&key, &cert.resolverKey, &secret)
+		return &key, nil
+	}
+	resolverKey, err := ecdh.X25519().NewPublicKey(cert.resolverKey[:])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := clientKey.ECDH(resolverKey)
+	if err != nil {
+		return nil, err
+	}
+	subKey, err := chacha20.HChaCha20(shared, make([]byte, 16))
+	if err != nil {
+		return nil, err
+	}
+	copy(key[:], subKey)
+	return &key, nil
+}
+
+func (c dnscryptConstruction) seal(message []byte, nonce *[dnscryptNonceSize]byte, key *[dnscryptKeySize]byte) []byte {
+	if c == dnscryptXSalsa20Poly1305 {
+		return secretbox.Seal(nil, message, nonce, key)
+	}
+	return xsecretboxSeal(message, nonce, key)
+}
+
+func (c dnscryptConstruction) open(sealed []byte, nonce *[dnscryptNonceSize]byte, key *[dnscryptKeySize]byte) ([]byte, bool) {
+	if c == dnscryptXSalsa20Poly1305 {
+		return secretbox.Open(nil, sealed, nonce, key)
+	}
+	return xsecretboxOpen(sealed, nonce, key)
+}
+
+// xsecretboxSeal is the secretbox construction using XChaCha20 in place of XSalsa20,
+// as libsodium crypto_box_curve25519xchacha20poly1305: the first 32 bytes of the
+// key stream are the poly1305 key, the rest encrypts the message and the tag
+// precedes the ciphertext
+func xsecretboxSeal(message []byte, nonce *[dnscryptNonceSize]byte, key *[dnscryptKeySize]byte) []byte {
+	cipher, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var polyKey [32]byte
+	cipher.XORKeyStream(polyKey[:], polyKey[:])
+
+	// the message is encrypted with the key stream following the poly1305 key
+	out := make([]byte, poly1305.TagSize+len(message))
+	ciphertext := out[poly1305.TagSize:]
+	cipher.XORKeyStream(ciphertext, message)
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, ciphertext, &polyKey)
+	copy(out, tag[:])
+	return out
+}
+
+func xsecretboxOpen(sealed []byte, nonce *[dnscryptNonceSize]byte, key *[dnscryptKeySize]byte) ([]byte, bool) {
+	if len(sealed) < poly1305.TagSize {
+		return nil, false
+	}
+	cipher, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var polyKey [32]byte
+	cipher.XORKeyStream(polyKey[:], polyKey[:])
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], sealed)
+	ciphertext := sealed[poly1305.TagSize:]
+	if !poly1305.Verify(&tag, ciphertext, &polyKey) {
+		return nil, false
+	}
+	message := make([]byte, len(ciphertext))
+	cipher.XORKeyStream(message, ciphertext)
+	return message, true
+}
+
+// dnscryptPad pads message to a multiple of the padding block of at least minSize bytes
+// with the ISO/IEC 7816-4 scheme
+func dnscryptPad(message []byte, minSize int) []byte {
+	size := max(minSize, (len(message)+1+dnscryptPaddingBlock-1)/dnscryptPaddingBlock*dnscryptPaddingBlock)
+	padded := make([]byte, size)
+	copy(padded, message)
+	padded[len(message)] = 0x80
+	return padded
+}
+
+func dnscryptUnpad(padded []byte) ([]byte, bool) {
+	trimmed := bytes.TrimRight(padded, "\x00")
+	if len(trimmed) == 0 || trimmed[len(trimmed)-1] != 0x80 {
+		return nil, false
+	}
+	return trimmed[:len(trimmed)-1], true
+}
+
+// dnscryptTransport exchanges messages with a DNSCrypt resolver over udp, falling
+// back to tcp for truncated responses or when a proxy is used
+type dnscryptTransport struct {
+	client   *Client
+	resolver *DNSCryptResolver
+	addr     string
+
+	mu   sync.Mutex
+	cert *dnscryptCert
+}
+
+func newDNSCryptTransport(client *Client, resolver Resolver) (Transport, error) {
+	r, ok := resolver.(*DNSCryptResolver)
+	if !ok {
+		return nil, fmt.Errorf("invalid dnscrypt resolver: %s", resolver.String())
+	}
+	return &dnscryptTransport{client: client, resolver: r, addr: r.String()}, nil
+}
+
+// certificate returns the certificate of the resolver, fetching it again once expired
+func (t *dnscryptTransport) certificate(ctx context.Context) (*dnscryptCert, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cert != nil && t.cert.valid(time.Now()) {
+		return t.cert, nil
+	}
+	cert, err := t.fetchCertificate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t.cert = cert
+	return cert, nil
+}
+
+// fetchCertificate queries the certificates published as TXT records of the provider
+// name and returns the valid one with the highest serial
+func (t *dnscryptTransport) fetchCertificate(ctx context.Context) (*dnscryptCert, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(t.resolver.ProviderName), dns.TypeTXT)
+	var plain Transport = &udpTransport{client: t.client, addr: t.addr}
+	if t.client.tcpProxy != nil {
+		plain = &tcpTransport{client: t.client, addr: t.addr}
+	}
+	resp, _, err := plain.Exchange(ctx, msg)
+	if err == nil && resp.Truncated {
+		resp, _, err = (&tcpTransport{client: t.client, addr: t.addr}).Exchange(ctx, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		best    *dnscryptCert
+		lastErr error
+		now     = time.Now()
+	)
+	for _, rr := range resp.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		cert, err := parseDNSCryptCert(unescapeTXT(strings.Join(txt.Txt, "")), t.resolver.PublicKey)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !cert.valid(now) {
+			lastErr = errors.New("expired certificate")
+			continue
+		}
+		if best == nil || cert.serial > best.serial ||
+			(cert.serial == best.serial && cert.construction == dnscryptXChaCha20Poly1305) {
+			best = cert
+		}
+	}
+	if best == nil {
+		if lastErr != nil {
+			return nil, fmt.Errorf("%w from %s: %v", ErrDNSCryptCertificate, t.resolver.ProviderName, lastErr)
+		}
+		return nil, fmt.Errorf("%w from %s", ErrDNSCryptCertificate, t.resolver.ProviderName)
+	}
+	return best, nil
+}
+
+// unescapeTXT returns the bytes of a TXT string in presentation format
+func unescapeTXT(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			out = append(out, s[i])
+			continue
+		}
+		if i+3 < len(s) {
+			if n, err := strconv.Atoi(s[i+1 : i+4]); err == nil && n < 256 {
+				out = append(out, byte(n))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i+1])
+		i++
+	}
+	return out
+}
+
+func (t *dnscryptTransport) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if t.client.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.client.options.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	cert, err := t.certificate(ctx)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start = time.Now()
+	tcp := t.client.tcpProxy != nil
+	resp, err := t.exchange(ctx, cert, packed, tcp)
+	if err == nil && resp.Truncated && !tcp {
+		resp, err = t.exchange(ctx, cert, packed, true)
+	}
+	// a response that can't be opened may come from a rotated key, the certificate
+	// is fetched again by the next query
+	if errors.Is(err, ErrDNSCryptResponse) {
+		t.forgetCertificate(cert)
+	}
+	return resp, time.Since(start), err
+}
+
+// forgetCertificate drops cert unless it was already replaced
+func (t *dnscryptTransport) forgetCertificate(cert *dnscryptCert) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cert == cert {
+		t.cert = nil
+	}
+}
+
+// exchange encrypts packed with a new key pair, sends it and decrypts the response
+func (t *dnscryptTransport) exchange(ctx context.Context, cert *dnscryptCert, packed []byte, tcp bool) (*dns.Msg, error) {
+	clientKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cert.sharedKey(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [dnscryptNonceSize]byte
+	if _, err := rand.Read(nonce[:dnscryptHalfNonceSize]); err != nil {
+		return nil, err
+	}
+
+	minSize := dnscryptMinQuerySize
+	if tcp {
+		minSize = 0
+	}
+	query := make([]byte, 0, dnscryptMagicSize+dnscryptKeySize+dnscryptHalfNonceSize+minSize+poly1305.TagSize)
+	query = append(query, cert.clientMagic[:]...)
+	query = append(query, clientKey.PublicKey().Bytes()...)
+	query = append(query, nonce[:dnscryptHalfNonceSize]...)
+	query = append(query, cert.construction.seal(dnscryptPad(packed, minSize), &nonce, key)...)
+
+	var data []byte
+	if tcp {
+		data, err = t.roundTripTCP(ctx, query)
+	} else {
+		data, err = t.roundTripUDP(ctx, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	headerSize := dnscryptMagicSize + dnscryptNonceSize
+	if len(data) < headerSize+poly1305.TagSize || !bytes.Equal(data[:dnscryptMagicSize], dnscryptResolverMagic) {
+		return nil, fmt.Errorf("%w: malformed response", ErrDNSCryptResponse)
+	}
+	if !bytes.Equal(data[dnscryptMagicSize:dnscryptMagicSize+dnscryptHalfNonceSize], nonce[:dnscryptHalfNonceSize]) {
+		return nil, fmt.Errorf("%w: unexpected nonce", ErrDNSCryptResponse)
+	}
+	copy(nonce[:], data[dnscryptMagicSize:headerSize])
+	padded, ok := cert.construction.open(data[headerSize:], &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("%w: authentication failed", ErrDNSCryptResponse)
+	}
+	body, ok := dnscryptUnpad(padded)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid padding", ErrDNSCryptResponse)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// dial opens a connection to the resolver bound to ctx
+func (t *dnscryptTransport) dial(ctx context.Context, network string) (net.Conn, func() bool, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch {
+	case network == "tcp" && t.client.tcpProxy != nil:
+		var dnsConn *dns.Conn
+		dnsConn, err = t.client.dialWithProxy(ctx, t.client.tcpProxy, network, t.addr)
+		if dnsConn != nil {
+			conn = dnsConn.Conn
+		}
+	case network == "tcp":
+		conn, err = t.client.tcpClient.Dialer.DialContext(ctx, network, t.addr)
+	default:
+		conn, err = t.client.udpClient.Dialer.DialContext(ctx, network, t.addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	return conn, stop, nil
+}
+
+func (t *dnscryptTransport) roundTripUDP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, stop, err := t.dial(ctx, "udp")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stop()
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (t *dnscryptTransport) roundTripTCP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, stop, err := t.dial(ctx, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stop()
+	buf := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(buf, uint16(len(query)))
+	copy(buf[2:], query)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,263 @@
+package retryabledns
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+const testProviderName = "2.dnscrypt-cert.example.test."
+
+// dnscryptServer is a stub DNSCrypt resolver answering every A query with 127.0.0.6,
+// queries for names starting with "big." are truncated over udp
+type dnscryptServer struct {
+	addr        string
+	providerKey ed25519.PrivateKey
+	resolverKey *ecdh.PrivateKey
+	cert        *dnscryptCert
+	rawCert     []byte
+	certQueries atomic.Int32
+	tcpQueries  atomic.Int32
+	// corrupt makes the next responses fail authentication
+	corrupt atomic.Bool
+}
+
+func newDNSCryptCert(t *testing.T, providerKey ed25519.PrivateKey, resolverKey *ecdh.PrivateKey, construction dnscryptConstruction, notAfter time.Time) []byte {
+	t.Helper()
+	signed := make([]byte, 52)
+	copy(signed, resolverKey.PublicKey().Bytes())
+	copy(signed[32:40], "testmagi")
+	binary.BigEndian.PutUint32(signed[40:], 1)
+	binary.BigEndian.PutUint32(signed[44:], uint32(time.Now().Add(-time.Hour).Unix()))
+	binary.BigEndian.PutUint32(signed[48:], uint32(notAfter.Unix()))
+	cert := append([]byte("DNSC"), 0, byte(construction), 0, 0)
+	cert = append(cert, ed25519.Sign(providerKey, signed)...)
+	return append(cert, signed...)
+}
+
+func runDNSCryptServer(t *testing.T, construction dnscryptConstruction, notAfter time.Time) *dnscryptServer {
+	t.Helper()
+	_, providerKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	resolverKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	s := &dnscryptServer{providerKey: providerKey, resolverKey: resolverKey}
+	s.rawCert = newDNSCryptCert(t, providerKey, resolverKey, construction, notAfter)
+	s.cert = &dnscryptCert{construction: construction}
+	copy(s.cert.clientMagic[:], "testmagi")
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = packetConn.Close()
+		_ = listener.Close()
+	})
+	s.addr = packetConn.LocalAddr().String()
+
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := s.handle(buf[:n], false); resp != nil {
+				_, _ = packetConn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := s.handle(query, true)
+				out := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+				_, _ = conn.Write(append(out, resp...))
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *dnscryptServer) handle(query []byte, tcp bool) []byte {
+	if !strings.HasPrefix(string(query), string(s.cert.clientMagic[:])) {
+		return s.handleCertQuery(query)
+	}
+	if tcp {
+		s.tcpQueries.Add(1)
+	}
+	query = query[dnscryptMagicSize:]
+	// the shared key is symmetric, the client key takes the place of the resolver one
+	peer := &dnscryptCert{construction: s.cert.construction}
+	copy(peer.resolverKey[:], query[:dnscryptKeySize])
+	key, err := peer.sharedKey(s.resolverKey)
+	if err != nil {
+		return nil
+	}
+	var nonce [dnscryptNonceSize]byte
+	copy(nonce[:], query[dnscryptKeySize:dnscryptKeySize+dnscryptHalfNonceSize])
+	padded, ok := s.cert.construction.open(query[dnscryptKeySize+dnscryptHalfNonceSize:], &nonce, key)
+	if !ok {
+		return nil
+	}
+	packed, ok := dnscryptUnpad(padded)
+	if !ok {
+		return nil
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if strings.HasPrefix(req.Question[0].Name, "big.") && !tcp {
+		m.Truncated = true
+	} else {
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.6")
+		m.Answer = append(m.Answer, rr)
+	}
+	packed, _ = m.Pack()
+
+	_, _ = rand.Read(nonce[dnscryptHalfNonceSize:])
+	resp := append([]byte{}, dnscryptResolverMagic...)
+	resp = append(resp, nonce[:]...)
+	resp = append(resp, s.cert.construction.seal(dnscryptPad(packed, 0), &nonce, key)...)
+	if s.corrupt.Load() {
+		resp[len(resp)-1] ^= 0xff
+	}
+	return resp
+}
+
+func (s *dnscryptServer) handleCertQuery(query []byte) []byte {
+	req := new(dns.Msg)
+	if err := req.Unpack(query); err != nil {
+		return nil
+	}
+	s.certQueries.Add(1)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if req.Question[0].Name == testProviderName && req.Question[0].Qtype == dns.TypeTXT {
+		var escaped strings.Builder
+		for _, b := range s.rawCert {
+			if b >= 0x20 && b < 0x7f && b != '"' && b != '\\' {
+				escaped.WriteByte(b)
+			} else {
+				fmt.Fprintf(&escaped, "\\%03d", b)
+			}
+		}
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: testProviderName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{escaped.String()},
+		})
+	}
+	packed, _ := m.Pack()
+	return packed
+}
+
+func (s *dnscryptServer) resolver() string {
+	return "dnscrypt:" + s.addr + "#" + testProviderName + "/" + hex.EncodeToString(s.providerKey.Public().(ed25519.PublicKey))
+}
+
+func (s *dnscryptServer) stamp() string {
+	data := []byte{byte(stampDNSCrypt), 0, 0, 0, 0, 0, 0, 0, 0}
+	data = append(append(data, byte(len(s.addr))), s.addr...)
+	publicKey := s.providerKey.Public().(ed25519.PublicKey)
+	data = append(append(data, byte(len(publicKey))), publicKey...)
+	data = append(append(data, byte(len(testProviderName))), testProviderName...)
+	return stampScheme + base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestDNSCrypt(t *testing.T) {
+	for _, construction := range []dnscryptConstruction{dnscryptXChaCha20Poly1305, dnscryptXSalsa20Poly1305} {
+		t.Run(fmt.Sprint(construction), func(t *testing.T) {
+			server := runDNSCryptServer(t, construction, time.Now().Add(time.Hour))
+			for _, resolver := range []string{server.resolver(), server.stamp()} {
+				client, err := NewWithOptions(Options{BaseResolvers: []string{resolver}, MaxRetries: 1, Timeout: 2 * time.Second})
+				require.NoError(t, err)
+				for i := 0; i < 3; i++ {
+					data, err := client.A("example.com")
+					require.NoError(t, err)
+					require.Equal(t, []string{"127.0.0.6"}, data.A)
+				}
+			}
+			// the certificate is fetched once per client
+			require.Equal(t, int32(2), server.certQueries.Load())
+
+			// truncated responses are retried over tcp
+			client, err := NewWithOptions(Options{BaseResolvers: []string{server.resolver()}, MaxRetries: 1, Timeout: 2 * time.Second})
+			require.NoError(t, err)
+			data, err := client.A("big.example.com")
+			require.NoError(t, err)
+			require.Equal(t, []string{"127.0.0.6"}, data.A)
+			require.Equal(t, int32(1), server.tcpQueries.Load())
+		})
+	}
+}
+
+func TestDNSCryptInvalidResponse(t *testing.T) {
+	server := runDNSCryptServer(t, dnscryptXChaCha20Poly1305, time.Now().Add(time.Hour))
+	client, err := NewWithOptions(Options{BaseResolvers: []string{server.resolver()}, MaxRetries: 1, Timeout: 2 * time.Second})
+	require.NoError(t, err)
+	_, err = client.A("example.com")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), server.certQueries.Load())
+
+	server.corrupt.Store(true)
+	_, err = client.A("example.com")
+	require.ErrorIs(t, err, ErrDNSCryptResponse)
+
+	// the certificate is fetched again after a response fails authentication
+	server.corrupt.Store(false)
+	data, err := client.A("example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.6"}, data.A)
+	require.Equal(t, int32(2), server.certQueries.Load())
+}
+
+func TestDNSCryptInvalidCertificate(t *testing.T) {
+	expired := runDNSCryptServer(t, dnscryptXChaCha20Poly1305, time.Now().Add(-time.Minute))
+	client, err := NewWithOptions(Options{BaseResolvers: []string{expired.resolver()}, MaxRetries: 1, Timeout: 2 * time.Second})
+	require.NoError(t, err)
+	_, err = client.A("example.com")
+	require.ErrorIs(t, err, ErrDNSCryptCertificate)
+
+	// certificates signed by another provider key are rejected
+	server := runDNSCryptServer(t, dnscryptXChaCha20Poly1305, time.Now().Add(time.Hour))
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	resolver := "dnscrypt:" + server.addr + "#" + testProviderName + "/" + hex.EncodeToString(otherKey)
+	client, err = NewWithOptions(Options{BaseResolvers: []string{resolver}, MaxRetries: 1, Timeout: 2 * time.Second})
+	require.NoError(t, err)
+	_, err = client.A("example.com")
+	require.ErrorIs(t, err, ErrDNSCryptCertificate)
+
+	_, err = parseResolver("dnscrypt:127.0.0.1#" + testProviderName + "/00")
+	require.ErrorIs(t, err, ErrInvalidResolver)
+}
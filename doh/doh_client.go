@@ -2,29 +2,50 @@ package doh
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 
 	"github.com/miekg/dns"
+	"github.com/projectdiscovery/retryabledns/internal/inflight"
 )
 
+// StatusError is returned when the server answers with a non 200 http status code
+type StatusError struct {
+	StatusCode int
+	// Proto is the negotiated http version, e.g. "HTTP/2.0"
+	Proto string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected http status code %d (%s)", e.StatusCode, e.Proto)
+}
+
 type Client struct {
 	DefaultResolver Resolver
 	httpClient      *http.Client
+	// odohConfigs caches the configs of the oblivious targets, the fetch is shared by the
+	// concurrent queries to a target and detached from their contexts
+	odohConfigs inflight.Group[*odohConfig]
 }
 
 func NewWithOptions(options Options) *Client {
-	return &Client{DefaultResolver: options.DefaultResolver, httpClient: options.HttpClient}
+	return &Client{
+		DefaultResolver: options.DefaultResolver,
+		httpClient:      options.HttpClient,
+		odohConfigs:     inflight.Group[*odohConfig]{Timeout: DefaultTimeout, Keep: true},
+	}
 }
 
+// New returns a client querying Cloudflare. The certificates of the resolvers are
+// verified, NewWithOptions with an http client built with WithInsecureSkipVerify
+// opts out of the verification.
 func New() *Client {
-	httpClient := NewHttpClient(
-		WithTimeout(DefaultTimeout),
-		WithInsecureSkipVerify(),
-	)
+	httpClient := NewHttpClient(WithTimeout(DefaultTimeout))
 	return NewWithOptions(Options{DefaultResolver: Cloudflare, HttpClient: httpClient})
 }
 
@@ -37,11 +58,17 @@ func (c *Client) QueryWithResolver(r Resolver, name string, question QuestionTyp
 }
 
 func (c *Client) QueryWithJsonAPI(r Resolver, name string, question QuestionType) (*Response, error) {
-	req, err := http.NewRequest(http.MethodGet, r.URL, nil)
+	return c.QueryWithJsonAPIContext(context.Background(), r, name, question)
+}
+
+// QueryWithJsonAPIContext is like QueryWithJsonAPI but the http request is bound to ctx
+func (c *Client) QueryWithJsonAPIContext(ctx context.Context, r Resolver, name string, question QuestionType) (*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.URL, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Accept", "application/dns-json")
+	r.setHeaders(req)
 	q := req.URL.Query()
 	q.Add("name", name)
 	q.Add("type", question.ToString())
@@ -53,6 +80,10 @@ func (c *Client) QueryWithJsonAPI(r Resolver, name string, question QuestionType
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Proto: resp.Proto}
+	}
+
 	if resp.Body == nil {
 		return nil, errors.New("empty response body")
 	}
@@ -61,13 +92,39 @@ func (c *Client) QueryWithJsonAPI(r Resolver, name string, question QuestionType
 
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid %s response: %w", resp.Proto, err)
 	}
 
 	return &response, nil
 }
 
+// QueryWithJsonAPIMsgContext sends the question of msg to the json api of the resolver
+// and converts the answer to a dns message
+func (c *Client) QueryWithJsonAPIMsgContext(ctx context.Context, r Resolver, msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) != 1 {
+		return nil, errors.New("json api queries must have exactly one question")
+	}
+	question := msg.Question[0]
+	qtype, ok := dns.TypeToString[question.Qtype]
+	if !ok {
+		qtype = fmt.Sprint(question.Qtype)
+	}
+	response, err := c.QueryWithJsonAPIContext(ctx, r, question.Name, QuestionType(qtype))
+	if err != nil {
+		return nil, err
+	}
+	respMsg := response.ToMsg()
+	respMsg.Id = msg.Id
+	respMsg.Question = []dns.Question{question}
+	return respMsg, nil
+}
+
 func (c *Client) QueryWithDOH(method Method, r Resolver, name string, question uint16) (*dns.Msg, error) {
+	return c.QueryWithDOHContext(context.Background(), method, r, name, question)
+}
+
+// QueryWithDOHContext is like QueryWithDOH but the http request is bound to ctx
+func (c *Client) QueryWithDOHContext(ctx context.Context, method Method, r Resolver, name string, question uint16) (*dns.Msg, error) {
 	msg := &dns.Msg{}
 	msg.Id = 0
 	msg.Question = make([]dns.Question, 1)
@@ -76,10 +133,15 @@ func (c *Client) QueryWithDOH(method Method, r Resolver, name string, question u
 		Qtype:  question,
 		Qclass: dns.ClassINET,
 	}
-	return c.QueryWithDOHMsg(method, r, msg)
+	return c.QueryWithDOHMsgContext(ctx, method, r, msg)
 }
 
 func (c *Client) QueryWithDOHMsg(method Method, r Resolver, msg *dns.Msg) (*dns.Msg, error) {
+	return c.QueryWithDOHMsgContext(context.Background(), method, r, msg)
+}
+
+// QueryWithDOHMsgContext is like QueryWithDOHMsg but the http request is bound to ctx
+func (c *Client) QueryWithDOHMsgContext(ctx context.Context, method Method, r Resolver, msg *dns.Msg) (*dns.Msg, error) {
 	packedMsg, err := msg.Pack()
 	if err != nil {
 		return nil, err
@@ -97,11 +159,12 @@ func (c *Client) QueryWithDOHMsg(method Method, r Resolver, msg *dns.Msg) (*dns.
 	default:
 		return nil, errors.New("unsupported method")
 	}
-	req, err := http.NewRequest(string(method), r.URL, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, string(method), r.URL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Accept", "application/dns-message")
+	r.setHeaders(req)
 	if dnsParam != "" {
 		q := req.URL.Query()
 		q.Add("dns", dnsParam)
@@ -116,18 +179,22 @@ func (c *Client) QueryWithDOHMsg(method Method, r Resolver, msg *dns.Msg) (*dns.
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Proto: resp.Proto}
+	}
+
 	if resp.Body == nil {
 		return nil, errors.New("empty response body")
 	}
 
 	respBodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid %s response: %w", resp.Proto, err)
 	}
 
 	respMsg := &dns.Msg{}
 	if err := respMsg.Unpack(respBodyBytes); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid %s response: %w", resp.Proto, err)
 	}
 	return respMsg, nil
 }
@@ -1,9 +1,16 @@
 package doh
 
 import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/stretchr/testify/require"
 )
 
@@ -30,3 +37,113 @@ func TestResolvers(t *testing.T) {
 	require.Nil(t, err, "could not resolve dns")
 	require.NotNil(t, d, "could not retrieve data")
 }
+
+func TestResponseToMsg(t *testing.T) {
+	response := Response{
+		Status:   dns.RcodeSuccess,
+		RD:       true,
+		RA:       true,
+		Question: []Question{{Name: "example.com.", Type: int(dns.TypeTXT)}},
+		Answer: []Answer{
+			{Name: "example.com.", Type: int(dns.TypeTXT), TTL: 300, Data: "v=spf1 -all"},
+			{Name: "example.com.", Type: int(dns.TypeTXT), TTL: 300, Data: `"quoted"`},
+			{Name: "example.com.", Type: int(dns.TypeTXT), TTL: 300, Data: "a\tb \"c\" \\ café"},
+			{Name: "example.com.", Type: 65000, TTL: 300, Data: "unknown"},
+		},
+		Authority: []Answer{{Name: "example.com", Type: int(dns.TypeNS), TTL: 3600, Data: "a.iana-servers.net."}},
+	}
+	msg := response.ToMsg()
+	require.True(t, msg.Response)
+	require.True(t, msg.RecursionAvailable)
+	require.Equal(t, dns.TypeTXT, msg.Question[0].Qtype)
+	require.Len(t, msg.Answer, 3)
+	require.Equal(t, []string{"v=spf1 -all"}, msg.Answer[0].(*dns.TXT).Txt)
+	require.Equal(t, []string{"quoted"}, msg.Answer[1].(*dns.TXT).Txt)
+	// raw data is escaped the way dns presents it, so that it packs back to the same bytes
+	require.Equal(t, []string{`a\009b \"c\" \\ caf\195\169`}, msg.Answer[2].(*dns.TXT).Txt)
+	require.Equal(t, uint32(300), msg.Answer[0].Header().Ttl)
+	require.Len(t, msg.Ns, 1)
+	require.Equal(t, "a.iana-servers.net.", msg.Ns[0].(*dns.NS).Ns)
+}
+
+// dohHandler answers wire format queries with 127.0.0.1, or 502 for names starting with "fail"
+func dohHandler(t *testing.T, protos chan<- string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.Proto + " " + r.Header.Get("User-Agent") + " " + r.Header.Get("X-Api-Key")
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if strings.HasPrefix(req.Question[0].Name, "fail") {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.1")
+		resp.Answer = append(resp.Answer, rr)
+		packed, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(packed)
+	}
+}
+
+func TestHTTPVersions(t *testing.T) {
+	protos := make(chan string, 10)
+	server := httptest.NewUnstartedServer(dohHandler(t, protos))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	// an HTTP/3 server sharing the certificate of the https server
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	h3Server := &http3.Server{Handler: dohHandler(t, protos), TLSConfig: http3.ConfigureTLSConfig(server.TLS)}
+	go func() { _ = h3Server.Serve(packetConn) }()
+	defer h3Server.Close()
+
+	tests := []struct {
+		version HTTPVersion
+		url     string
+		proto   string
+	}{
+		{HTTP1, server.URL, "HTTP/1.1"},
+		{HTTP2, server.URL, "HTTP/2.0"},
+		{HTTP3, "https://" + packetConn.LocalAddr().String(), "HTTP/3.0"},
+	}
+	for _, test := range tests {
+		t.Run(test.version.String(), func(t *testing.T) {
+			httpClient := NewHttpClient(
+				WithTimeout(DefaultTimeout),
+				WithInsecureSkipVerify(),
+				WithIdleConns(10, 2, time.Minute),
+				WithHTTPVersion(test.version),
+			)
+			client := NewWithOptions(Options{HttpClient: httpClient})
+			resolver := Resolver{
+				URL:       test.url,
+				Headers:   http.Header{"X-Api-Key": []string{"secret"}},
+				UserAgent: "retryabledns-test",
+			}
+
+			resp, err := client.QueryWithDOH(MethodPost, resolver, "example.com", dns.TypeA)
+			require.NoError(t, err)
+			require.Len(t, resp.Answer, 1)
+			require.Equal(t, test.proto+" retryabledns-test secret", <-protos)
+
+			_, err = client.QueryWithDOH(MethodPost, resolver, "fail.example.com", dns.TypeA)
+			var statusErr *StatusError
+			require.ErrorAs(t, err, &statusErr)
+			require.Equal(t, http.StatusBadGateway, statusErr.StatusCode)
+			require.Equal(t, test.proto, statusErr.Proto)
+			require.Contains(t, err.Error(), test.proto)
+			<-protos
+		})
+	}
+}
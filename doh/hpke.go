@@ -0,0 +1,186 @@
+package doh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// HPKE (RFC 9180) identifiers of the supported suites, the KEM is always DHKEM(X25519, HKDF-SHA256)
+const (
+	hpkeKEMX25519HKDFSHA256 uint16 = 0x0020
+	hpkeKDFHKDFSHA256       uint16 = 0x0001
+	hpkeAEADAES128GCM       uint16 = 0x0001
+	hpkeAEADAES256GCM       uint16 = 0x0002
+	hpkeAEADChaCha20Poly    uint16 = 0x0003
+)
+
+const (
+	hpkeNh      = sha256.Size
+	hpkeNn      = 12
+	hpkeModBase = 0x00
+)
+
+var errUnsupportedHPKESuite = errors.New("unsupported hpke suite")
+
+// hpkeSuite is a HPKE cipher suite in base mode
+type hpkeSuite struct {
+	kemID  uint16
+	kdfID  uint16
+	aeadID uint16
+}
+
+func (s hpkeSuite) supported() bool {
+	if s.kemID != hpkeKEMX25519HKDFSHA256 || s.kdfID != hpkeKDFHKDFSHA256 {
+		return false
+	}
+	switch s.aeadID {
+	case hpkeAEADAES128GCM, hpkeAEADAES256GCM, hpkeAEADChaCha20Poly:
+		return true
+	}
+	return false
+}
+
+// nk returns the key size of the AEAD
+func (s hpkeSuite) nk() int {
+	if s.aeadID == hpkeAEADAES128GCM {
+		return 16
+	}
+	return 32
+}
+
+func (s hpkeSuite) aead(key []byte) (cipher.AEAD, error) {
+	switch s.aeadID {
+	case hpkeAEADAES128GCM, hpkeAEADAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case hpkeAEADChaCha20Poly:
+		return chacha20poly1305.New(key)
+	}
+	return nil, errUnsupportedHPKESuite
+}
+
+func (s hpkeSuite) id() []byte {
+	id := []byte("HPKE")
+	id = binary.BigEndian.AppendUint16(id, s.kemID)
+	id = binary.BigEndian.AppendUint16(id, s.kdfID)
+	return binary.BigEndian.AppendUint16(id, s.aeadID)
+}
+
+func kemID() []byte {
+	return binary.BigEndian.AppendUint16([]byte("KEM"), hpkeKEMX25519HKDFSHA256)
+}
+
+func labeledExtract(suiteID []byte, salt []byte, label string, ikm []byte) []byte {
+	labeled := append([]byte("HPKE-v1"), suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, ikm...)
+	prk, _ := hkdf.Extract(sha256.New, labeled, salt)
+	return prk
+}
+
+func labeledExpand(suiteID []byte, prk []byte, label string, info []byte, length int) []byte {
+	labeled := binary.BigEndian.AppendUint16(nil, uint16(length))
+	labeled = append(labeled, "HPKE-v1"...)
+	labeled = append(labeled, suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, info...)
+	key, _ := hkdf.Expand(sha256.New, prk, string(labeled), length)
+	return key
+}
+
+// sharedSecret is ExtractAndExpand of DHKEM(X25519, HKDF-SHA256)
+func sharedSecret(dh, enc, pkR []byte) []byte {
+	eaePRK := labeledExtract(kemID(), nil, "eae_prk", dh)
+	return labeledExpand(kemID(), eaePRK, "shared_secret", append(append([]byte{}, enc...), pkR...), hpkeNh)
+}
+
+// hpkeContext is the encryption context of a single message exchange
+type hpkeContext struct {
+	suite          hpkeSuite
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+}
+
+func (s hpkeSuite) keySchedule(shared, info []byte) (*hpkeContext, error) {
+	suiteID := s.id()
+	pskIDHash := labeledExtract(suiteID, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(suiteID, nil, "info_hash", info)
+	keyScheduleContext := append([]byte{hpkeModBase}, pskIDHash...)
+	keyScheduleContext = append(keyScheduleContext, infoHash...)
+
+	secret := labeledExtract(suiteID, shared, "secret", nil)
+	aead, err := s.aead(labeledExpand(suiteID, secret, "key", keyScheduleContext, s.nk()))
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{
+		suite:          s,
+		aead:           aead,
+		baseNonce:      labeledExpand(suiteID, secret, "base_nonce", keyScheduleContext, hpkeNn),
+		exporterSecret: labeledExpand(suiteID, secret, "exp", keyScheduleContext, hpkeNh),
+	}, nil
+}
+
+// setupBaseS encapsulates a new key for the recipient public key pkR
+func (s hpkeSuite) setupBaseS(pkR, info []byte) ([]byte, *hpkeContext, error) {
+	if !s.supported() {
+		return nil, nil, errUnsupportedHPKESuite
+	}
+	publicKey, err := ecdh.X25519().NewPublicKey(pkR)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid hpke public key: %w", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := ephemeral.ECDH(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := ephemeral.PublicKey().Bytes()
+	ctx, err := s.keySchedule(sharedSecret(dh, enc, pkR), info)
+	return enc, ctx, err
+}
+
+// setupBaseR decapsulates enc with the recipient private key skR
+func (s hpkeSuite) setupBaseR(enc []byte, skR *ecdh.PrivateKey, info []byte) (*hpkeContext, error) {
+	if !s.supported() {
+		return nil, errUnsupportedHPKESuite
+	}
+	publicKey, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := skR.ECDH(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return s.keySchedule(sharedSecret(dh, enc, skR.PublicKey().Bytes()), info)
+}
+
+// seal and open encrypt the first message of the context, whose nonce is the base nonce
+func (c *hpkeContext) seal(aad, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.baseNonce, plaintext, aad)
+}
+
+func (c *hpkeContext) open(aad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.baseNonce, ciphertext, aad)
+}
+
+func (c *hpkeContext) export(exporterContext []byte, length int) []byte {
+	return labeledExpand(c.suite.id(), c.exporterSecret, "sec", exporterContext, length)
+}
@@ -0,0 +1,314 @@
+package doh
+
+import (
+	"bytes"
+	"context"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// ErrNoODoHConfig is returned when a target publishes no supported ObliviousDoHConfig
+	ErrNoODoHConfig = errors.New("no supported oblivious doh config")
+	// ErrInvalidODoHMessage is returned when an oblivious response can't be decrypted
+	ErrInvalidODoHMessage = errors.New("invalid oblivious doh message")
+	// ErrNoODoHRelay is returned when an oblivious query has no relay to be sent through
+	ErrNoODoHRelay = errors.New("no oblivious doh relay")
+)
+
+const (
+	// ODoHContentType is the media type of oblivious doh messages
+	ODoHContentType = "application/oblivious-dns-message"
+	// ODoHConfigsPath is the well known path targets publish their configs at
+	ODoHConfigsPath = "/.well-known/odohconfigs"
+
+	odohVersion         = 0x0001
+	odohMessageQuery    = 0x01
+	odohMessageResponse = 0x02
+	// odohPaddingBlock is the size the plaintext queries are padded to a multiple of
+	odohPaddingBlock = 128
+)
+
+// odohConfig is an ObliviousDoHConfigContents (RFC 9230 section 6.1)
+type odohConfig struct {
+	suite     hpkeSuite
+	publicKey []byte
+	keyID     []byte
+}
+
+// parseODoHConfigs returns the first supported config of an ObliviousDoHConfigs list
+func parseODoHConfigs(data []byte) (*odohConfig, error) {
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return nil, fmt.Errorf("%w: malformed configs", ErrNoODoHConfig)
+	}
+	data = data[2:]
+	for len(data) >= 4 {
+		version, length := binary.BigEndian.Uint16(data), int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			break
+		}
+		contents := data[4 : 4+length]
+		data = data[4+length:]
+		if version != odohVersion || len(contents) < 8 {
+			continue
+		}
+		config := &odohConfig{suite: hpkeSuite{
+			kemID:  binary.BigEndian.Uint16(contents),
+			kdfID:  binary.BigEndian.Uint16(contents[2:]),
+			aeadID: binary.BigEndian.Uint16(contents[4:]),
+		}}
+		keyLength := int(binary.BigEndian.Uint16(contents[6:]))
+		if !config.suite.supported() || len(contents) != 8+keyLength {
+			continue
+		}
+		config.publicKey = contents[8:]
+		prk, _ := hkdf.Extract(sha256.New, contents, nil)
+		config.keyID, _ = hkdf.Expand(sha256.New, prk, "odoh key id", hpkeNh)
+		return config, nil
+	}
+	return nil, ErrNoODoHConfig
+}
+
+// odohMessage serializes an ObliviousDoHMessage
+func odohMessage(messageType byte, keyID, encrypted []byte) []byte {
+	out := []byte{messageType}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(keyID)))
+	out = append(out, keyID...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(encrypted)))
+	return append(out, encrypted...)
+}
+
+// parseODoHMessage returns the type, key id and encrypted message of an ObliviousDoHMessage
+func parseODoHMessage(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 3 {
+		return 0, nil, nil, ErrInvalidODoHMessage
+	}
+	messageType, data := data[0], data[1:]
+	keyLength := int(binary.BigEndian.Uint16(data))
+	if len(data) < 4+keyLength {
+		return 0, nil, nil, ErrInvalidODoHMessage
+	}
+	keyID, data := data[2:2+keyLength], data[2+keyLength:]
+	if int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return 0, nil, nil, ErrInvalidODoHMessage
+	}
+	return messageType, keyID, data[2:], nil
+}
+
+// odohPlaintext serializes an ObliviousDoHMessagePlaintext padded to odohPaddingBlock
+func odohPlaintext(packed []byte) []byte {
+	padding := (odohPaddingBlock - (len(packed)+4)%odohPaddingBlock) % odohPaddingBlock
+	out := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+	out = append(out, packed...)
+	out = binary.BigEndian.AppendUint16(out, uint16(padding))
+	return append(out, make([]byte, padding)...)
+}
+
+// parseODoHPlaintext returns the dns message of an ObliviousDoHMessagePlaintext
+func parseODoHPlaintext(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, ErrInvalidODoHMessage
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 4+length || int(binary.BigEndian.Uint16(data[2+length:])) != len(data)-4-length {
+		return nil, ErrInvalidODoHMessage
+	}
+	return data[2 : 2+length], nil
+}
+
+// odohResponseKey derives the key and nonce of the response (RFC 9230 section 6.4)
+func odohResponseKey(ctx *hpkeContext, queryPlaintext, responseNonce []byte) ([]byte, []byte) {
+	secret := ctx.export([]byte("odoh response"), ctx.suite.nk())
+	salt := append(append([]byte{}, queryPlaintext...), binary.BigEndian.AppendUint16(nil, uint16(len(responseNonce)))...)
+	salt = append(salt, responseNonce...)
+	prk, _ := hkdf.Extract(sha256.New, secret, salt)
+	key, _ := hkdf.Expand(sha256.New, prk, "odoh key", ctx.suite.nk())
+	nonce, _ := hkdf.Expand(sha256.New, prk, "odoh nonce", hpkeNn)
+	return key, nonce
+}
+
+func odohResponseAAD(responseNonce []byte) []byte {
+	aad := binary.BigEndian.AppendUint16([]byte{odohMessageResponse}, uint16(len(responseNonce)))
+	return append(aad, responseNonce...)
+}
+
+// odohConfigsURL returns the well known configs URL of the target of r
+func odohConfigsURL(r Resolver) (string, error) {
+	target, err := url.Parse(r.URL)
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: target.Scheme, Host: target.Host, Path: ODoHConfigsPath}).String(), nil
+}
+
+// odohConfig returns the config of the target of r, fetching it on first use. The fetch
+// is shared by the concurrent queries to the target and detached from their contexts,
+// so that a cancelled query doesn't fail the others.
+func (c *Client) odohConfig(ctx context.Context, r Resolver) (*odohConfig, error) {
+	configsURL, err := odohConfigsURL(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.odohConfigs.Do(ctx, configsURL, func(ctx context.Context) (*odohConfig, error) {
+		return c.fetchODoHConfig(ctx, r, configsURL)
+	})
+}
+
+func (c *Client) fetchODoHConfig(ctx context.Context, r Resolver, configsURL string) (*odohConfig, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, configsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.setHeaders(req)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Proto: resp.Proto}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s response: %w", resp.Proto, err)
+	}
+	return parseODoHConfigs(body)
+}
+
+// forgetODoHConfig drops the cached config of the target of r, e.g. after a key rotation
+func (c *Client) forgetODoHConfig(r Resolver) {
+	configsURL, err := odohConfigsURL(r)
+	if err != nil {
+		return
+	}
+	c.odohConfigs.Forget(configsURL)
+}
+
+// QueryWithODoHMsgContext sends msg to the target URL of r with Oblivious DoH (RFC 9230).
+// The query is encrypted with the public key published by the target and sent through
+// r.Relay, which is required, so that the target doesn't learn the client address and
+// the relay doesn't learn the query. The target configs are fetched directly from the target.
+func (c *Client) QueryWithODoHMsgContext(ctx context.Context, r Resolver, msg *dns.Msg) (*dns.Msg, error) {
+	if r.Relay == "" {
+		return nil, ErrNoODoHRelay
+	}
+	config, err := c.odohConfig(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.queryODoH(ctx, r, config, msg)
+	if err != nil {
+		if staleODoHConfig(err) {
+			c.forgetODoHConfig(r)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// staleODoHConfig returns true if err means the target rotated its key. Other errors, e.g.
+// a relay failure, keep the config as fetching it again is a direct request to the target.
+func staleODoHConfig(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusUnauthorized
+	}
+	return errors.Is(err, ErrInvalidODoHMessage)
+}
+
+func (c *Client) queryODoH(ctx context.Context, r Resolver, config *odohConfig, msg *dns.Msg) (*dns.Msg, error) {
+	// the id is zero as with doh, the original one is restored in the response
+	query := msg.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	plaintext := odohPlaintext(packed)
+	enc, hpkeCtx, err := config.suite.setupBaseS(config.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, err
+	}
+	aad := binary.BigEndian.AppendUint16([]byte{odohMessageQuery}, uint16(len(config.keyID)))
+	aad = append(aad, config.keyID...)
+	encrypted := append(enc, hpkeCtx.seal(aad, plaintext)...)
+	body := odohMessage(odohMessageQuery, config.keyID, encrypted)
+
+	req, err := c.newODoHRequest(ctx, r, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Proto: resp.Proto}
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s response: %w", resp.Proto, err)
+	}
+
+	messageType, responseNonce, sealed, err := parseODoHMessage(respBody)
+	if err != nil || messageType != odohMessageResponse {
+		return nil, ErrInvalidODoHMessage
+	}
+	key, nonce := odohResponseKey(hpkeCtx, plaintext, responseNonce)
+	aead, err := config.suite.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	opened, err := aead.Open(nil, nonce, sealed, odohResponseAAD(responseNonce))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidODoHMessage, err)
+	}
+	respPacked, err := parseODoHPlaintext(opened)
+	if err != nil {
+		return nil, err
+	}
+	respMsg := new(dns.Msg)
+	if err := respMsg.Unpack(respPacked); err != nil {
+		return nil, fmt.Errorf("invalid %s response: %w", resp.Proto, err)
+	}
+	respMsg.Id = msg.Id
+	return respMsg, nil
+}
+
+// newODoHRequest returns the request sent to the relay, queries are never sent
+// to the target directly as it would learn the client address
+func (c *Client) newODoHRequest(ctx context.Context, r Resolver, body []byte) (*http.Request, error) {
+	if r.Relay == "" {
+		return nil, ErrNoODoHRelay
+	}
+	target, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := url.Parse(r.Relay)
+	if err != nil {
+		return nil, err
+	}
+	q := relay.Query()
+	q.Set("targethost", target.Host)
+	q.Set("targetpath", target.EscapedPath())
+	relay.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, relay.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ODoHContentType)
+	req.Header.Set("Accept", ODoHContentType)
+	r.setHeaders(req)
+	return req, nil
+}
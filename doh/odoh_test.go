@@ -0,0 +1,256 @@
+package doh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHPKE checks the key schedule against the test vector A.1.1 of RFC 9180
+func TestHPKE(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		require.NoError(t, err)
+		return b
+	}
+	skR, err := ecdh.X25519().NewPrivateKey(decode("4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	require.NoError(t, err)
+	suite := hpkeSuite{kemID: hpkeKEMX25519HKDFSHA256, kdfID: hpkeKDFHKDFSHA256, aeadID: hpkeAEADAES128GCM}
+	ctx, err := suite.setupBaseR(decode("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"), skR, []byte("Ode on a Grecian Urn"))
+	require.NoError(t, err)
+	require.Equal(t, decode("56d890e5accaaf011cff4b7d"), ctx.baseNonce)
+	require.Equal(t, decode("45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8"), ctx.exporterSecret)
+
+	// a message sealed for the recipient can be opened with its private key
+	enc, sender, err := suite.setupBaseS(skR.PublicKey().Bytes(), []byte("info"))
+	require.NoError(t, err)
+	receiver, err := suite.setupBaseR(enc, skR, []byte("info"))
+	require.NoError(t, err)
+	plaintext, err := receiver.open([]byte("aad"), sender.seal([]byte("aad"), []byte("message")))
+	require.NoError(t, err)
+	require.Equal(t, []byte("message"), plaintext)
+	require.Equal(t, sender.export([]byte("ctx"), 16), receiver.export([]byte("ctx"), 16))
+}
+
+// odohTarget is a stub oblivious target answering every A query with 127.0.0.4
+type odohTarget struct {
+	key           *ecdh.PrivateKey
+	suite         hpkeSuite
+	keyID         []byte
+	queries       atomic.Int32
+	configQueries atomic.Int32
+}
+
+func (target *odohTarget) configs() []byte {
+	contents := binary.BigEndian.AppendUint16(nil, target.suite.kemID)
+	contents = binary.BigEndian.AppendUint16(contents, target.suite.kdfID)
+	contents = binary.BigEndian.AppendUint16(contents, target.suite.aeadID)
+	publicKey := target.key.PublicKey().Bytes()
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(publicKey)))
+	contents = append(contents, publicKey...)
+	config := binary.BigEndian.AppendUint16(nil, odohVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+	// an unsupported version precedes the supported config
+	unsupported := []byte{0xff, 0x03, 0x00, 0x00}
+	configs := binary.BigEndian.AppendUint16(nil, uint16(len(unsupported)+len(config)))
+	return append(append(configs, unsupported...), config...)
+}
+
+func (target *odohTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == ODoHConfigsPath {
+		target.configQueries.Add(1)
+		_, _ = w.Write(target.configs())
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	messageType, keyID, encrypted, err := parseODoHMessage(body)
+	if err != nil || messageType != odohMessageQuery || r.Header.Get("Content-Type") != ODoHContentType {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !bytes.Equal(keyID, target.keyID) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	target.queries.Add(1)
+	enc, sealed := encrypted[:32], encrypted[32:]
+	ctx, err := target.suite.setupBaseR(enc, target.key, []byte("odoh query"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	aad := binary.BigEndian.AppendUint16([]byte{odohMessageQuery}, uint16(len(keyID)))
+	plaintext, err := ctx.open(append(aad, keyID...), sealed)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	packed, err := parseODoHPlaintext(plaintext)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil || req.Id != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.4")
+	m.Answer = append(m.Answer, rr)
+	respPacked, _ := m.Pack()
+
+	// the target side of RFC 9230 section 6.4
+	responseNonce := make([]byte, max(hpkeNn, target.suite.nk()))
+	_, _ = rand.Read(responseNonce)
+	key, nonce := odohResponseKey(ctx, plaintext, responseNonce)
+	aead, _ := target.suite.aead(key)
+	respSealed := aead.Seal(nil, nonce, odohPlaintext(respPacked), odohResponseAAD(responseNonce))
+	w.Header().Set("Content-Type", ODoHContentType)
+	_, _ = w.Write(odohMessage(odohMessageResponse, responseNonce, respSealed))
+}
+
+func TestODoH(t *testing.T) {
+	for _, aeadID := range []uint16{hpkeAEADAES128GCM, hpkeAEADChaCha20Poly} {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		target := &odohTarget{key: key, suite: hpkeSuite{kemID: hpkeKEMX25519HKDFSHA256, kdfID: hpkeKDFHKDFSHA256, aeadID: aeadID}}
+		config, err := parseODoHConfigs(target.configs())
+		require.NoError(t, err)
+		target.keyID = config.keyID
+
+		targetServer := httptest.NewTLSServer(target)
+		defer targetServer.Close()
+
+		// the relay forwards the queries to the target named in the url
+		var relayed atomic.Int32
+		relayServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/down" {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			relayed.Add(1)
+			targetURL := "https://" + r.URL.Query().Get("targethost") + r.URL.Query().Get("targetpath")
+			req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, targetURL, r.Body)
+			req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+			resp, err := targetServer.Client().Do(req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			_, _ = io.Copy(w, resp.Body)
+		}))
+		defer relayServer.Close()
+
+		client := NewWithOptions(Options{HttpClient: NewHttpClient(WithInsecureSkipVerify())})
+		resolver := Resolver{URL: targetServer.URL + "/dns-query", Relay: relayServer.URL + "/proxy"}
+		for i := 0; i < 2; i++ {
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			resp, err := client.QueryWithODoHMsgContext(t.Context(), resolver, msg)
+			require.NoError(t, err)
+			require.Equal(t, msg.Id, resp.Id)
+			require.Len(t, resp.Answer, 1)
+			require.Equal(t, "127.0.0.4", resp.Answer[0].(*dns.A).A.String())
+		}
+		require.Equal(t, int32(2), relayed.Load())
+		require.Equal(t, int32(2), target.queries.Load())
+
+		// a rotated key is rejected by the target and the config fetched again
+		target.keyID = []byte("rotated")
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		_, err = client.QueryWithODoHMsgContext(t.Context(), resolver, msg)
+		var statusErr *StatusError
+		require.ErrorAs(t, err, &statusErr)
+		require.Equal(t, http.StatusUnauthorized, statusErr.StatusCode)
+		target.keyID = config.keyID
+		_, err = client.QueryWithODoHMsgContext(t.Context(), resolver, msg)
+		require.NoError(t, err)
+		require.Equal(t, int32(2), target.configQueries.Load())
+
+		// relay failures keep the config
+		_, err = client.QueryWithODoHMsgContext(t.Context(), Resolver{URL: resolver.URL, Relay: relayServer.URL + "/down"}, msg)
+		require.Error(t, err)
+		_, err = client.QueryWithODoHMsgContext(t.Context(), resolver, msg)
+		require.NoError(t, err)
+		require.Equal(t, int32(2), target.configQueries.Load())
+
+		// queries are never sent to the target directly
+		queries := target.queries.Load()
+		_, err = client.QueryWithODoHMsgContext(t.Context(), Resolver{URL: resolver.URL}, msg)
+		require.ErrorIs(t, err, ErrNoODoHRelay)
+		_, err = client.newODoHRequest(t.Context(), Resolver{URL: resolver.URL}, nil)
+		require.ErrorIs(t, err, ErrNoODoHRelay)
+		require.Equal(t, queries, target.queries.Load())
+	}
+}
+
+func TestParseODoHConfigs(t *testing.T) {
+	_, err := parseODoHConfigs([]byte{0x00})
+	require.ErrorIs(t, err, ErrNoODoHConfig)
+	// a config with an unsupported kem is skipped
+	contents := []byte{0x00, 0x10, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x04}
+	config := append([]byte{0x00, 0x01, 0x00, byte(len(contents))}, contents...)
+	_, err = parseODoHConfigs(append([]byte{0x00, byte(len(config))}, config...))
+	require.ErrorIs(t, err, ErrNoODoHConfig)
+}
+
+func TestODoHConfigFetch(t *testing.T) {
+	newTarget := func() *odohTarget {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		return &odohTarget{key: key, suite: hpkeSuite{kemID: hpkeKEMX25519HKDFSHA256, kdfID: hpkeKDFHKDFSHA256, aeadID: hpkeAEADAES128GCM}}
+	}
+	release := make(chan struct{})
+	slow := newTarget()
+	slowServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		slow.ServeHTTP(w, r)
+	}))
+	defer slowServer.Close()
+	fast := newTarget()
+	fastServer := httptest.NewTLSServer(fast)
+	defer fastServer.Close()
+
+	client := NewWithOptions(Options{HttpClient: NewHttpClient(WithInsecureSkipVerify())})
+	slowResolver := Resolver{URL: slowServer.URL + "/dns-query"}
+
+	// a cancelled caller doesn't fail the other callers waiting on the same fetch
+	cancelled, cancel := context.WithCancel(t.Context())
+	cancelledErr := make(chan error)
+	go func() {
+		_, err := client.odohConfig(cancelled, slowResolver)
+		cancelledErr <- err
+	}()
+	waiting := make(chan error)
+	go func() {
+		_, err := client.odohConfig(t.Context(), slowResolver)
+		waiting <- err
+	}()
+	cancel()
+	require.ErrorIs(t, <-cancelledErr, context.Canceled)
+
+	// a slow target doesn't block the queries to the other targets
+	_, err := client.odohConfig(t.Context(), Resolver{URL: fastServer.URL + "/dns-query"})
+	require.NoError(t, err)
+
+	close(release)
+	require.NoError(t, <-waiting)
+	require.Equal(t, int32(1), slow.configQueries.Load())
+}
@@ -3,7 +3,10 @@ package doh
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 var DefaultTimeout = 5 * time.Second
@@ -16,6 +19,23 @@ type Options struct {
 type Resolver struct {
 	Name string
 	URL  string
+	// Headers are added to each request sent to the resolver
+	Headers http.Header
+	// UserAgent overrides the default user agent
+	UserAgent string
+	// Relay is the oblivious doh relay URL queries are sent through, see QueryWithODoHMsgContext.
+	// The target configs are fetched directly from the target, not through the relay.
+	Relay string
+}
+
+// setHeaders adds the resolver headers and user agent to req
+func (r Resolver) setHeaders(req *http.Request) {
+	for key, values := range r.Headers {
+		req.Header[http.CanonicalHeaderKey(key)] = values
+	}
+	if r.UserAgent != "" {
+		req.Header.Set("User-Agent", r.UserAgent)
+	}
 }
 
 var (
@@ -44,15 +64,17 @@ const (
 )
 
 type Response struct {
-	Status   int        `json:"Status"`
-	TC       bool       `json:"TC"`
-	RD       bool       `json:"RD"`
-	RA       bool       `json:"RA"`
-	AD       bool       `json:"AD"`
-	CD       bool       `json:"CD"`
-	Question []Question `json:"Question"`
-	Answer   []Answer   `json:"Answer"`
-	Comment  string
+	Status     int        `json:"Status"`
+	TC         bool       `json:"TC"`
+	RD         bool       `json:"RD"`
+	RA         bool       `json:"RA"`
+	AD         bool       `json:"AD"`
+	CD         bool       `json:"CD"`
+	Question   []Question `json:"Question"`
+	Answer     []Answer   `json:"Answer"`
+	Authority  []Answer   `json:"Authority"`
+	Additional []Answer   `json:"Additional"`
+	Comment    string
 }
 
 type Question struct {
@@ -72,3 +94,70 @@ const (
 	MethodGet  Method = http.MethodGet
 	MethodPost Method = http.MethodPost
 )
+
+// ToMsg converts the json response to a dns message, records that can't be parsed are skipped
+func (r *Response) ToMsg() *dns.Msg {
+	msg := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response:           true,
+			Rcode:              r.Status,
+			Truncated:          r.TC,
+			RecursionDesired:   r.RD,
+			RecursionAvailable: r.RA,
+			AuthenticatedData:  r.AD,
+			CheckingDisabled:   r.CD,
+		},
+	}
+	for _, question := range r.Question {
+		msg.Question = append(msg.Question, dns.Question{Name: dns.Fqdn(question.Name), Qtype: uint16(question.Type), Qclass: dns.ClassINET})
+	}
+	msg.Answer = toRRs(r.Answer)
+	msg.Ns = toRRs(r.Authority)
+	msg.Extra = toRRs(r.Additional)
+	return msg
+}
+
+func toRRs(answers []Answer) []dns.RR {
+	var rrs []dns.RR
+	for _, answer := range answers {
+		if rr, err := answer.ToRR(); err == nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// ToRR converts the json record to a dns resource record
+func (a Answer) ToRR() (dns.RR, error) {
+	rrtype := uint16(a.Type)
+	data := a.Data
+	// some providers return txt data without quotes
+	if (rrtype == dns.TypeTXT || rrtype == dns.TypeSPF) && !strings.HasPrefix(data, `"`) {
+		data = quoteTXT(data)
+	}
+	typeName, ok := dns.TypeToString[rrtype]
+	if !ok {
+		return nil, fmt.Errorf("unknown record type %d", a.Type)
+	}
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(a.Name), a.TTL, typeName, data))
+}
+
+// quoteTXT quotes the raw character string s in zone file format, with the escapes
+// of RFC 1035 section 5.1 rather than the go ones
+func quoteTXT(s string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case b == '"' || b == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(b)
+		case b < ' ' || b > '~':
+			fmt.Fprintf(&quoted, "\\%03d", b)
+		default:
+			quoted.WriteByte(b)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
@@ -1,10 +1,15 @@
 package doh
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 )
 
 // ClientOption defines a function type for configuring an http.Client
@@ -17,7 +22,8 @@ func WithTimeout(timeout time.Duration) ClientOption {
 	}
 }
 
-// WithInsecureSkipVerify sets the InsecureSkipVerify option for the TLS config
+// WithInsecureSkipVerify sets the InsecureSkipVerify option for the TLS config, the
+// certificates of the resolvers are then accepted without any verification
 func WithInsecureSkipVerify() ClientOption {
 	return func(c *http.Client) {
 		transport, ok := c.Transport.(*http.Transport)
@@ -32,6 +38,14 @@ func WithInsecureSkipVerify() ClientOption {
 	}
 }
 
+// WithTLSConfig sets the TLS config used to reach the resolvers, it must come
+// before WithHTTPVersion
+func WithTLSConfig(config *tls.Config) ClientOption {
+	return func(c *http.Client) {
+		httpTransport(c).TLSClientConfig = config
+	}
+}
+
 // WithProxy sets a proxy for the http.Client
 func WithProxy(proxyURL string) ClientOption {
 	return func(c *http.Client) {
@@ -53,6 +67,115 @@ func WithProxy(proxyURL string) ClientOption {
 	}
 }
 
+// HTTPVersion is the http version used to reach doh resolvers
+type HTTPVersion string
+
+const (
+	// HTTP1 only uses HTTP/1.1
+	HTTP1 HTTPVersion = "http/1.1"
+	// HTTP2 prefers HTTP/2 and falls back to HTTP/1.1 if the server doesn't support it
+	HTTP2 HTTPVersion = "h2"
+	// HTTP3 uses HTTP/3 over QUIC, proxies are not supported
+	HTTP3 HTTPVersion = "h3"
+)
+
+func (v HTTPVersion) String() string {
+	return string(v)
+}
+
+var (
+	// DefaultHTTP2PingInterval is the idle time after which a ping checks an HTTP/2 connection is still alive
+	DefaultHTTP2PingInterval = 30 * time.Second
+	// DefaultHTTP2PingTimeout is the time after which a connection is closed if a ping is not answered
+	DefaultHTTP2PingTimeout = 15 * time.Second
+)
+
+// httpTransport returns the *http.Transport of the client, replacing any other round tripper
+func httpTransport(c *http.Client) *http.Transport {
+	transport, ok := c.Transport.(*http.Transport)
+	if !ok {
+		transport = &http.Transport{}
+		c.Transport = transport
+	}
+	return transport
+}
+
+// WithHTTPVersion selects the http version. HTTP3 replaces the transport, so it must
+// come after the options configuring tls.
+func WithHTTPVersion(version HTTPVersion) ClientOption {
+	return func(c *http.Client) {
+		switch version {
+		case HTTP1:
+			protocols := new(http.Protocols)
+			protocols.SetHTTP1(true)
+			httpTransport(c).Protocols = protocols
+		case HTTP2:
+			transport := httpTransport(c)
+			protocols := new(http.Protocols)
+			protocols.SetHTTP1(true)
+			protocols.SetHTTP2(true)
+			transport.Protocols = protocols
+			transport.ForceAttemptHTTP2 = true
+			transport.HTTP2 = &http.HTTP2Config{
+				SendPingTimeout: DefaultHTTP2PingInterval,
+				PingTimeout:     DefaultHTTP2PingTimeout,
+			}
+		case HTTP3:
+			var tlsConfig *tls.Config
+			if transport, ok := c.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+				tlsConfig = transport.TLSClientConfig.Clone()
+			}
+			c.Transport = &http3.Transport{TLSClientConfig: tlsConfig}
+		}
+	}
+}
+
+// WithDialAddress dials addr for the connections to hostport instead of resolving its
+// host, it must come after WithHTTPVersion
+func WithDialAddress(hostport, addr string) ClientOption {
+	return func(c *http.Client) {
+		if addr == "" {
+			return
+		}
+		redirect := func(address string) string {
+			if address == hostport {
+				return addr
+			}
+			return address
+		}
+		if transport, ok := c.Transport.(*http3.Transport); ok {
+			transport.Dial = func(ctx context.Context, address string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+				return quic.DialAddrEarly(ctx, redirect(address), tlsConfig, config)
+			}
+			return
+		}
+		// the proxy, if any, is dialed unchanged
+		dialer := &net.Dialer{}
+		httpTransport(c).DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, redirect(address))
+		}
+	}
+}
+
+// WithIdleConns sets the idle connections limits, zero values keep the defaults
+func WithIdleConns(maxIdleConns, maxIdleConnsPerHost int, idleConnTimeout time.Duration) ClientOption {
+	return func(c *http.Client) {
+		transport, ok := c.Transport.(*http.Transport)
+		if !ok {
+			return
+		}
+		if maxIdleConns > 0 {
+			transport.MaxIdleConns = maxIdleConns
+		}
+		if maxIdleConnsPerHost > 0 {
+			transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+		}
+		if idleConnTimeout > 0 {
+			transport.IdleConnTimeout = idleConnTimeout
+		}
+	}
+}
+
 // NewHttpClient creates a new http.Client with the given options
 func NewHttpClient(opts ...ClientOption) *http.Client {
 	client := &http.Client{}
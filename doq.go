@@ -0,0 +1,234 @@
+package retryabledns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/projectdiscovery/retryabledns/internal/inflight"
+	"github.com/quic-go/quic-go"
+)
+
+var (
+	// ErrDOQProxyUnsupported is returned when a doq resolver is used along with a proxy
+	ErrDOQProxyUnsupported = errors.New("doq resolvers can't be used through a proxy")
+)
+
+// DoQ error codes from RFC 9250 section 4.3
+const (
+	doqNoError          = 0x0
+	doqInternalError    = 0x1
+	doqRequestCancelled = 0x3
+)
+
+// doqALPN is the application protocol negotiated by DNS over QUIC
+const doqALPN = "doq"
+
+// doqTransport exchanges messages over a DNS over QUIC connection (RFC 9250). Each
+// query is sent on its own stream of a connection shared by all the queries.
+type doqTransport struct {
+	client     *Client
+	addr       string
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+
+	mu        sync.Mutex
+	transport *quic.Transport
+	conn      *quic.Conn
+	// dials shares the dial of the connection between the queries waiting for it
+	dials inflight.Group[*quic.Conn]
+}
+
+func newDOQTransport(client *Client, resolver Resolver) (Transport, error) {
+	if client.options.Proxy != "" {
+		return nil, ErrDOQProxyUnsupported
+	}
+	r, ok := resolver.(*NetworkResolver)
+	if !ok {
+		return nil, fmt.Errorf("invalid doq resolver: %s", resolver.String())
+	}
+	// the session cache of the config allows queries to be sent as 0-RTT data on reconnection
+	tlsConfig := client.tlsConfig(r)
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = r.Host
+	}
+	tlsConfig.NextProtos = []string{doqALPN}
+	return &doqTransport{
+		client:    client,
+		addr:      r.String(),
+		tlsConfig: tlsConfig,
+		quicConfig: &quic.Config{
+			HandshakeIdleTimeout: client.options.Timeout,
+		},
+		dials: inflight.Group[*quic.Conn]{Timeout: client.options.Timeout},
+	}, nil
+}
+
+// connection returns the shared connection, dialing it if needed. The dial runs outside
+// the lock and isn't bound to the context of the query that started it, so that a query
+// giving up doesn't fail the others waiting for the connection.
+func (t *doqTransport) connection(ctx context.Context) (*quic.Conn, error) {
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+	if conn != nil && conn.Context().Err() == nil {
+		return conn, nil
+	}
+	return t.dials.Do(ctx, t.addr, t.dial)
+}
+
+// dial connects to the resolver and stores the connection for the next queries
+func (t *doqTransport) dial(ctx context.Context) (*quic.Conn, error) {
+	t.mu.Lock()
+	// another dial may have completed since the connection was checked
+	if t.conn != nil && t.conn.Context().Err() == nil {
+		conn := t.conn
+		t.mu.Unlock()
+		return conn, nil
+	}
+	if t.transport == nil {
+		udpConn, err := net.ListenUDP("udp", toUDPAddr(t.client.options.GetLocalAddr(UDP)))
+		if err != nil {
+			t.mu.Unlock()
+			return nil, err
+		}
+		t.transport = &quic.Transport{Conn: udpConn}
+	}
+	transport := t.transport
+	t.mu.Unlock()
+
+	addr, err := net.ResolveUDPAddr("udp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := transport.DialEarly(ctx, addr, t.tlsConfig, t.quicConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// the transport was closed while dialing
+	if t.transport != transport {
+		_ = conn.CloseWithError(doqNoError, "")
+		return nil, net.ErrClosed
+	}
+	t.conn = conn
+	return conn, nil
+}
+
+// dropConnection discards conn so that the next exchange dials a new one
+func (t *doqTransport) dropConnection(conn *quic.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == conn {
+		_ = conn.CloseWithError(doqNoError, "")
+		t.conn = nil
+	}
+}
+
+func toUDPAddr(addr net.Addr) *net.UDPAddr {
+	udpAddr, _ := addr.(*net.UDPAddr)
+	return udpAddr
+}
+
+func (t *doqTransport) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if t.client.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.client.options.Timeout)
+		defer cancel()
+	}
+
+	// the message id must be zero as streams already tell queries apart
+	query := msg.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	resp, err := t.exchange(ctx, packed)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	resp.Id = msg.Id
+	return resp, time.Since(start), nil
+}
+
+// exchange sends packed on a new stream, redialing once if the shared connection went away
+func (t *doqTransport) exchange(ctx context.Context, packed []byte) (*dns.Msg, error) {
+	for retry := 0; ; retry++ {
+		conn, err := t.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := exchangeStream(ctx, conn, packed)
+		if err != nil && ctx.Err() == nil && conn.Context().Err() != nil && retry == 0 {
+			t.dropConnection(conn)
+			continue
+		}
+		return resp, err
+	}
+}
+
+func exchangeStream(ctx context.Context, conn *quic.Conn, packed []byte) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+	})
+	defer stop()
+
+	buf := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	copy(buf[2:], packed)
+	if _, err := stream.Write(buf); err != nil {
+		return nil, err
+	}
+	// closing the send side tells the server the query is complete
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		stream.CancelRead(doqInternalError)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Close closes the shared connection and its socket
+func (t *doqTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		_ = t.conn.CloseWithError(doqNoError, "")
+		t.conn = nil
+	}
+	if t.transport != nil {
+		err := t.transport.Close()
+		t.transport = nil
+		return err
+	}
+	return nil
+}
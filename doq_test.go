@@ -0,0 +1,192 @@
+package retryabledns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+// generateTestCertificate returns a self signed certificate valid for 127.0.0.1 and
+// localhost along with a pool trusting it
+func generateTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// runDOQServer starts a local DoQ server answering every A query with 127.0.0.5
+// and returns its address along with the number of accepted connections
+func runDOQServer(t *testing.T, cert tls.Certificate) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{doqALPN},
+	}, &quic.Config{Allow0RTT: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go serveDOQStream(stream)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), &conns
+}
+
+func serveDOQStream(stream *quic.Stream) {
+	defer stream.Close()
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return
+	}
+	body := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(body); err != nil || req.Id != 0 {
+		stream.CancelRead(doqInternalError)
+		return
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.5")
+	resp.Answer = append(resp.Answer, rr)
+	packed, _ := resp.Pack()
+	out := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(out, uint16(len(packed)))
+	copy(out[2:], packed)
+	_, _ = stream.Write(out)
+}
+
+// trustDOQTransport replaces the doq transport with one trusting pool
+func trustDOQTransport(t *testing.T, pool *x509.CertPool) {
+	RegisterTransport(DOQ.String(), func(client *Client, resolver Resolver) (Transport, error) {
+		transport, err := newDOQTransport(client, resolver)
+		if err != nil {
+			return nil, err
+		}
+		transport.(*doqTransport).tlsConfig.RootCAs = pool
+		return transport, nil
+	})
+	t.Cleanup(func() { RegisterTransport(DOQ.String(), newDOQTransport) })
+}
+
+func TestDOQ(t *testing.T) {
+	cert, pool := generateTestCertificate(t)
+	addr, conns := runDOQServer(t, cert)
+	trustDOQTransport(t, pool)
+
+	resolver := mustParseResolver(t, "doq:"+addr)
+	require.Equal(t, &NetworkResolver{Protocol: DOQ, Host: "127.0.0.1", Port: addr[len("127.0.0.1:"):]}, resolver)
+	require.Equal(t, &NetworkResolver{Protocol: DOQ, Host: "dns.adguard-dns.com", Port: "853"}, mustParseResolver(t, "doq:dns.adguard-dns.com"))
+
+	client, err := NewWithOptions(Options{
+		BaseResolvers: []string{"doq:" + addr},
+		MaxRetries:    1,
+		Timeout:       2 * time.Second,
+		LocalAddrIP:   net.ParseIP("127.0.0.1"),
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		d, err := client.A("example.com")
+		require.NoError(t, err)
+		require.Equal(t, []string{"127.0.0.5"}, d.A)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	resp, err := client.Do(msg)
+	require.NoError(t, err)
+	require.Equal(t, msg.Id, resp.Id)
+	// all the queries share a single connection
+	require.Equal(t, int32(1), conns.Load())
+
+	// a closed connection is dialed again, once for all the concurrent queries
+	client.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.A("example.com")
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(2), conns.Load())
+
+	// quic can't be tunnelled through the supported proxies
+	_, err = NewWithOptions(Options{BaseResolvers: []string{"doq:" + addr}, MaxRetries: 1, Proxy: "socks5://127.0.0.1:1080"})
+	require.ErrorIs(t, err, ErrDOQProxyUnsupported)
+
+	// resolvers given at query time are only checked when used
+	client, err = NewWithOptions(Options{BaseResolvers: []string{"udp:" + addr}, MaxRetries: 1, Proxy: "socks5://127.0.0.1:1080"})
+	require.NoError(t, err)
+	_, err = client.QueryMultipleWithResolver("example.com", []uint16{dns.TypeA}, &NetworkResolver{Protocol: DOQ, Host: "127.0.0.1", Port: "853"})
+	require.ErrorIs(t, err, ErrDOQProxyUnsupported)
+}
+
+func TestDOQUntrustedCertificate(t *testing.T) {
+	cert, _ := generateTestCertificate(t)
+	addr, _ := runDOQServer(t, cert)
+
+	client, err := NewWithOptions(Options{BaseResolvers: []string{"doq:" + addr}, MaxRetries: 1, Timeout: 2 * time.Second})
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.A("example.com")
+	require.Error(t, err)
+	var resolveErr *ResolveError
+	require.ErrorAs(t, err, &resolveErr)
+	require.Equal(t, CategoryTLS, resolveErr.Attempts[0].Category)
+}
@@ -0,0 +1,150 @@
+package retryabledns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/projectdiscovery/retryabledns/doh"
+)
+
+// ErrorCategory classifies why an attempt failed
+type ErrorCategory string
+
+const (
+	CategoryTimeout           ErrorCategory = "timeout"
+	CategoryConnectionRefused ErrorCategory = "connection-refused"
+	CategoryConnectionReset   ErrorCategory = "connection-reset"
+	CategoryTLS               ErrorCategory = "tls"
+	CategoryHTTPStatus        ErrorCategory = "http-status"
+	CategoryRcode             ErrorCategory = "rcode"
+	CategoryRateLimited       ErrorCategory = "rate-limited"
+	CategoryCanceled          ErrorCategory = "canceled"
+	CategoryNetwork           ErrorCategory = "network"
+	CategoryOther             ErrorCategory = "other"
+)
+
+func (c ErrorCategory) String() string {
+	return string(c)
+}
+
+// Attempt is the outcome of a single exchange with a resolver
+type Attempt struct {
+	Resolver      string        `json:"resolver,omitempty"`
+	Protocol      string        `json:"protocol,omitempty"`
+	RTT           time.Duration `json:"rtt,omitempty"`
+	StatusCode    string        `json:"status_code,omitempty"`
+	StatusCodeRaw int           `json:"status_code_raw,omitempty"`
+	Category      ErrorCategory `json:"category,omitempty"`
+	Error         string        `json:"error,omitempty"`
+
+	err error
+}
+
+// Err returns the error of the attempt, if any
+func (a Attempt) Err() error {
+	return a.err
+}
+
+func newAttempt(resolver Resolver, rtt time.Duration, resp *dns.Msg, err error) Attempt {
+	attempt := Attempt{
+		Resolver: resolver.String(),
+		Protocol: resolverScheme(resolver),
+		RTT:      rtt,
+		err:      err,
+	}
+	if resp != nil {
+		attempt.StatusCode = dns.RcodeToString[resp.Rcode]
+		attempt.StatusCodeRaw = resp.Rcode
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			attempt.Category = CategoryRcode
+		}
+	}
+	if err != nil {
+		attempt.Category = categorize(err)
+		attempt.Error = err.Error()
+	}
+	return attempt
+}
+
+// categorize returns the category of a transport error
+func categorize(err error) ErrorCategory {
+	var (
+		netErr         net.Error
+		statusErr      *doh.StatusError
+		certErr        *tls.CertificateVerificationError
+		recordErr      tls.RecordHeaderError
+		alertErr       tls.AlertError
+		unknownAuthErr x509.UnknownAuthorityError
+		hostnameErr    x509.HostnameError
+		invalidCertErr x509.CertificateInvalidError
+	)
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return CategoryCanceled
+	case errors.Is(err, ErrRateLimited):
+		return CategoryRateLimited
+	case errors.As(err, &statusErr):
+		return CategoryHTTPStatus
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &alertErr),
+		errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr), errors.As(err, &invalidCertErr),
+		errors.Is(err, ErrSPKIPinMismatch), errors.Is(err, ErrCertificateHashMismatch):
+		return CategoryTLS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CategoryConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return CategoryConnectionReset
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return CategoryTimeout
+	case errors.As(err, &netErr):
+		return CategoryNetwork
+	default:
+		return CategoryOther
+	}
+}
+
+// ResolveError is returned when a query fails, it carries every attempt made to resolve it
+type ResolveError struct {
+	Host     string
+	Attempts []Attempt
+	Err      error
+}
+
+func (e *ResolveError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "could not resolve %s: %v", e.Host, e.Err)
+	if len(e.Attempts) > 0 {
+		fmt.Fprintf(&sb, " (%d attempts:", len(e.Attempts))
+		for i, attempt := range e.Attempts {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(&sb, " %s/%s", attempt.Protocol, attempt.Resolver)
+			switch {
+			case attempt.Error != "":
+				fmt.Fprintf(&sb, " %s", attempt.Category)
+			case attempt.StatusCode != "":
+				fmt.Fprintf(&sb, " %s", attempt.StatusCode)
+			}
+		}
+		sb.WriteByte(')')
+	}
+	return sb.String()
+}
+
+// Unwrap returns the final error, the errors of the attempts are found in Attempts
+func (e *ResolveError) Unwrap() error {
+	return e.Err
+}
+
+func newResolveError(host string, attempts []Attempt, err error) error {
+	return &ResolveError{Host: strings.TrimSuffix(host, "."), Attempts: attempts, Err: err}
+}
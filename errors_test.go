@@ -0,0 +1,91 @@
+package retryabledns
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/projectdiscovery/retryabledns/doh"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveError(t *testing.T) {
+	addr, _ := runRcodeServer(t)
+
+	// reserve a tcp port and release it so that connections to it are refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	client, err := NewWithOptions(Options{
+		BaseResolvers:  []string{addr, "tcp:" + closedAddr},
+		MaxRetries:     2,
+		RecordAttempts: true,
+	})
+	require.NoError(t, err)
+
+	d, err := client.A("servfail.example.com")
+	require.ErrorIs(t, err, ErrRetriesExceeded)
+	var resolveErr *ResolveError
+	require.True(t, errors.As(err, &resolveErr))
+	require.Equal(t, "servfail.example.com", resolveErr.Host)
+	require.Len(t, resolveErr.Attempts, 2)
+	require.Equal(t, resolveErr.Attempts, d.Attempts)
+	// only the final error is unwrapped, the others are found in the attempts
+	require.Equal(t, resolveErr.Err, errors.Unwrap(err))
+	var refused int
+	for _, attempt := range resolveErr.Attempts {
+		if errors.Is(attempt.Err(), syscall.ECONNREFUSED) {
+			refused++
+		}
+	}
+	require.Equal(t, 1, refused)
+
+	categories := make(map[string]Attempt)
+	for _, attempt := range resolveErr.Attempts {
+		categories[attempt.Protocol] = attempt
+	}
+	require.Equal(t, CategoryRcode, categories["udp"].Category)
+	require.Equal(t, "SERVFAIL", categories["udp"].StatusCode)
+	require.Equal(t, addr, categories["udp"].Resolver)
+	require.Positive(t, categories["udp"].RTT)
+	require.Equal(t, CategoryConnectionRefused, categories["tcp"].Category)
+	require.Equal(t, closedAddr, categories["tcp"].Resolver)
+	require.NotEmpty(t, categories["tcp"].Error)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("servfail.do.example.com.", dns.TypeA)
+	_, err = client.Do(msg)
+	require.True(t, errors.As(err, &resolveErr))
+	require.Equal(t, "servfail.do.example.com", resolveErr.Host)
+	require.Len(t, resolveErr.Attempts, 2)
+
+	client, err = NewWithOptions(Options{BaseResolvers: []string{addr}, MaxRetries: 2})
+	require.NoError(t, err)
+	d, err = client.A("ok.example.com")
+	require.NoError(t, err)
+	require.Empty(t, d.Attempts)
+}
+
+func TestCategorize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := doh.NewWithOptions(doh.Options{DefaultResolver: doh.Resolver{URL: server.URL}, HttpClient: server.Client()})
+	_, err := client.Query("example.com", doh.A)
+	var statusErr *doh.StatusError
+	require.True(t, errors.As(err, &statusErr))
+	require.Equal(t, http.StatusBadGateway, statusErr.StatusCode)
+	require.Equal(t, CategoryHTTPStatus, categorize(err))
+
+	require.Equal(t, CategoryRateLimited, categorize(ErrRateLimited))
+	require.Equal(t, CategoryConnectionReset, categorize(&net.OpError{Op: "read", Err: syscall.ECONNRESET}))
+	require.Equal(t, CategoryOther, categorize(errors.New("boom")))
+}
@@ -4,17 +4,23 @@ go 1.24.0
 
 require (
 	github.com/miekg/dns v1.1.62
+	github.com/quic-go/quic-go v0.54.0
 	github.com/stretchr/testify v1.11.1
+	golang.org/x/crypto v0.46.0
+	golang.org/x/time v0.14.0
 )
 
 require (
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/projectdiscovery/blackrock v0.0.1 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
 	github.com/tidwall/gjson v1.18.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
+	go.uber.org/mock v0.5.0 // indirect
 	golang.org/x/exp v0.0.0-20250106191152-7588d65b2ba8 // indirect
 	golang.org/x/sync v0.19.0 // indirect
+	golang.org/x/text v0.32.0 // indirect
 )
 
 require (
@@ -0,0 +1,230 @@
+package retryabledns
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// ErrInvalidHedge is returned when the hedging options are negative
+	ErrInvalidHedge = errors.New("hedge delay and max requests must not be negative")
+
+	// DefaultHedgeDelay is the hedge delay used by dynamic hedging until enough rtt samples are collected
+	DefaultHedgeDelay = 100 * time.Millisecond
+	// DefaultHedgeMaxRequests is the default number of concurrent exchanges of a hedged attempt
+	DefaultHedgeMaxRequests = 3
+)
+
+const (
+	// hedgeWindow is the number of recent rtt samples used to compute the dynamic hedge delay
+	hedgeWindow = 256
+	// hedgeMinSamples is the number of samples required before the dynamic delay is used
+	hedgeMinSamples = 20
+	// hedgePercentile is the rtt percentile used as dynamic hedge delay
+	hedgePercentile = 0.95
+)
+
+// HedgeStats contains the counters of hedged requests
+type HedgeStats struct {
+	// Requests is the number of hedged attempts
+	Requests uint64
+	// Fired is the number of additional exchanges sent to other resolvers
+	Fired uint64
+	// Won is the number of hedged attempts answered first by an additional exchange
+	Won uint64
+}
+
+// hedger keeps the state of hedged requests
+type hedger struct {
+	delay       time.Duration
+	dynamic     bool
+	maxRequests int
+
+	requests atomic.Uint64
+	fired    atomic.Uint64
+	won      atomic.Uint64
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+// newHedger returns nil if hedging is disabled
+func newHedger(options Options) *hedger {
+	if options.HedgeDelay <= 0 && !options.HedgeDynamicDelay {
+		return nil
+	}
+	h := &hedger{
+		delay:       options.HedgeDelay,
+		dynamic:     options.HedgeDynamicDelay,
+		maxRequests: options.HedgeMaxRequests,
+		samples:     make([]time.Duration, 0, hedgeWindow),
+	}
+	if h.maxRequests == 0 {
+		h.maxRequests = DefaultHedgeMaxRequests
+	}
+	return h
+}
+
+// observe adds the rtt of a successful exchange to the samples window
+func (h *hedger) observe(rtt time.Duration) {
+	if !h.dynamic {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < hedgeWindow {
+		h.samples = append(h.samples, rtt)
+		return
+	}
+	h.samples[h.next] = rtt
+	h.next = (h.next + 1) % hedgeWindow
+}
+
+// hedgeDelay returns how long to wait for an answer before sending the next exchange
+func (h *hedger) hedgeDelay() time.Duration {
+	if h.dynamic {
+		h.mu.Lock()
+		samples := slices.Clone(h.samples)
+		h.mu.Unlock()
+		if len(samples) >= hedgeMinSamples {
+			slices.Sort(samples)
+			return samples[int(float64(len(samples)-1)*hedgePercentile)]
+		}
+		if h.delay <= 0 {
+			return DefaultHedgeDelay
+		}
+	}
+	return h.delay
+}
+
+func (h *hedger) stats() HedgeStats {
+	return HedgeStats{
+		Requests: h.requests.Load(),
+		Fired:    h.fired.Load(),
+		Won:      h.won.Load(),
+	}
+}
+
+// exchangeResult is the outcome of an exchange with a resolver
+type exchangeResult struct {
+	resolver Resolver
+	resp     *dns.Msg
+	rtt      time.Duration
+	err      error
+	hedged   bool
+}
+
+// acceptable tells whether the exchange ends the attempt, either with a final answer
+// or with an error the classifier deems conclusive
+func (r exchangeResult) acceptable(c *Client) bool {
+	if r.err == nil && r.resp == nil {
+		return false
+	}
+	return c.classify(r.resp, r.err) == OutcomeFinal
+}
+
+// hedgedExchange sends msg to resolver and, if no acceptable answer is received within
+// the hedge delay or the exchange fails, to the next resolvers up to the configured
+// maximum. The first acceptable answer wins and the pending exchanges are cancelled.
+// It returns the winning exchange, or the last completed one if none was acceptable,
+// along with the other exchanges that completed. Without hedging it's a plain exchange.
+func (c *Client) hedgedExchange(ctx context.Context, resolver Resolver, msg *dns.Msg) (exchangeResult, []exchangeResult) {
+	h := c.hedger
+	if h == nil {
+		resp, rtt, err := c.exchange(ctx, resolver, msg)
+		return exchangeResult{resolver: resolver, resp: resp, rtt: rtt, err: err}, nil
+	}
+
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	maxRequests := min(h.maxRequests, len(c.resolvers))
+	results := make(chan exchangeResult, maxRequests)
+	used := make(map[string]struct{}, maxRequests)
+	launch := func(r Resolver, hedged bool) {
+		used[r.String()] = struct{}{}
+		go func() {
+			resp, rtt, err := c.exchange(hedgeCtx, r, msg.Copy())
+			results <- exchangeResult{resolver: r, resp: resp, rtt: rtt, err: err, hedged: hedged}
+		}()
+	}
+	// hedge sends the question to the next resolver in the client order not used yet by
+	// this attempt. Targets are chosen without advancing the shared round robin index and
+	// quarantined resolvers are skipped, their probes are left to the regular selection.
+	sent, pending := 1, 1
+	next := slices.IndexFunc(c.resolvers, func(r Resolver) bool { return r.String() == resolver.String() }) + 1
+	hedge := func() {
+		if sent >= maxRequests {
+			return
+		}
+		for range c.resolvers {
+			r := c.resolvers[next%len(c.resolvers)]
+			next++
+			if _, ok := used[r.String()]; ok || c.health.isQuarantined(r) {
+				continue
+			}
+			launch(r, true)
+			sent++
+			pending++
+			h.fired.Add(1)
+			return
+		}
+	}
+
+	h.requests.Add(1)
+	launch(resolver, false)
+	delay := h.hedgeDelay()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var completed []exchangeResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			hedge()
+			timer.Reset(delay)
+		case result := <-results:
+			pending--
+			if result.acceptable(c) {
+				if result.err == nil {
+					if result.hedged {
+						h.won.Add(1)
+					}
+					h.observe(result.rtt)
+				}
+				return result, completed
+			}
+			completed = append(completed, result)
+			if ctx.Err() == nil {
+				// don't wait for the delay once an exchange has failed
+				hedge()
+			}
+		}
+	}
+
+	// no acceptable answer, prefer the last exchange that got a response
+	last := len(completed) - 1
+	for i := last; i >= 0; i-- {
+		if completed[i].resp != nil {
+			last = i
+			break
+		}
+	}
+	result := completed[last]
+	return result, slices.Delete(completed, last, last+1)
+}
+
+// HedgeStats returns the counters of hedged requests
+func (c *Client) HedgeStats() HedgeStats {
+	if c.hedger == nil {
+		return HedgeStats{}
+	}
+	return c.hedger.stats()
+}
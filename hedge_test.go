@@ -0,0 +1,129 @@
+package retryabledns
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// registerSleepTransport registers a transport for scheme that answers after sleeping
+// for the duration encoded in the resolver address and records cancelled exchanges
+func registerSleepTransport(t *testing.T, scheme string) func() int {
+	t.Helper()
+	var (
+		mu        sync.Mutex
+		cancelled int
+	)
+	RegisterTransport(scheme, func(client *Client, resolver Resolver) (Transport, error) {
+		delay, err := time.ParseDuration(resolver.String())
+		if err != nil {
+			return nil, err
+		}
+		return TransportFunc(func(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				mu.Lock()
+				cancelled++
+				mu.Unlock()
+				return nil, 0, ctx.Err()
+			}
+			resp := new(dns.Msg)
+			resp.SetReply(msg)
+			rr, _ := dns.NewRR(msg.Question[0].Name + " 60 IN A 127.0.0.8")
+			resp.Answer = append(resp.Answer, rr)
+			return resp, delay, nil
+		}), nil
+	})
+	t.Cleanup(func() { RegisterTransport(scheme, nil) })
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return cancelled
+	}
+}
+
+func TestHedgedRequests(t *testing.T) {
+	cancelled := registerSleepTransport(t, "sleep")
+
+	client, err := NewWithOptions(Options{
+		BaseResolvers:  []string{"sleep:2s", "sleep:10ms"},
+		MaxRetries:     1,
+		HedgeDelay:     20 * time.Millisecond,
+		RecordAttempts: true,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		d, err := client.A("example.com")
+		require.NoError(t, err)
+		require.Equal(t, []string{"127.0.0.8"}, d.A)
+		require.Equal(t, []string{"10ms"}, d.Resolver)
+		require.Less(t, time.Since(start), time.Second)
+	}
+
+	stats := client.HedgeStats()
+	require.Equal(t, uint64(2), stats.Requests)
+	// the second query starts on the slow resolver and is won by the hedge
+	require.Equal(t, uint64(1), stats.Fired)
+	require.Equal(t, uint64(1), stats.Won)
+	require.Eventually(t, func() bool { return cancelled() == 1 }, time.Second, 10*time.Millisecond)
+	// hedges don't advance the round robin index
+	require.Equal(t, uint32(2), atomic.LoadUint32(&client.serversIndex))
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	resp, err := client.Do(msg)
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+}
+
+func TestHedgeSkipsQuarantined(t *testing.T) {
+	registerSleepTransport(t, "sleep")
+
+	client, err := NewWithOptions(Options{
+		BaseResolvers:       []string{"sleep:2s", "sleep:10ms", "sleep:50ms"},
+		MaxRetries:          1,
+		HedgeDelay:          20 * time.Millisecond,
+		QuarantineThreshold: 1,
+	})
+	require.NoError(t, err)
+	quarantined := client.resolvers[1]
+	state := client.health.states[healthKey(quarantined)]
+	until := time.Now().Add(-time.Second)
+	state.quarantinedUntil = until
+	client.health.quarantined.Add(1)
+
+	// the attempt on the last resolver hedges to the first one, the expired quarantine
+	// is left for the regular selection to probe
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	result, _ := client.hedgedExchange(context.Background(), client.resolvers[2], msg)
+	require.NoError(t, result.err)
+	require.Equal(t, "50ms", result.resolver.String())
+	require.Equal(t, uint64(1), client.HedgeStats().Fired)
+	require.Zero(t, atomic.LoadUint32(&client.serversIndex))
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	require.Equal(t, until, state.quarantinedUntil)
+}
+
+func TestHedgeDynamicDelay(t *testing.T) {
+	h := newHedger(Options{HedgeDynamicDelay: true})
+	require.Equal(t, DefaultHedgeDelay, h.hedgeDelay())
+	require.Equal(t, DefaultHedgeMaxRequests, h.maxRequests)
+
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	require.Equal(t, 95*time.Millisecond, h.hedgeDelay())
+
+	require.Nil(t, newHedger(Options{}))
+	require.ErrorIs(t, (&Options{BaseResolvers: []string{"1.1.1.1"}, MaxRetries: 1, HedgeDelay: -1}).Validate(), ErrInvalidHedge)
+}
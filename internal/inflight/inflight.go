@@ -0,0 +1,112 @@
+// Package inflight shares a single call between the concurrent callers asking for the same key
+package inflight
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Group runs a single call per key for all its concurrent callers. A call is detached
+// from the contexts of the callers, the context of a caller only stops its own wait.
+// The zero value is ready to use.
+type Group[V any] struct {
+	// Timeout bounds each call, zero means no bound
+	Timeout time.Duration
+	// Keep caches the successful results until Forget or Reset is called. Otherwise the
+	// next caller calls the key again, and a call is cancelled once every caller has
+	// stopped waiting on it.
+	Keep bool
+
+	mu    sync.Mutex
+	calls map[string]*call[V]
+}
+
+type call[V any] struct {
+	done    chan struct{}
+	val     V
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Do returns the result of fn for key, calling it unless a call for key is in flight
+// or kept. It returns ctx.Err() if ctx is done before the call completes.
+func (g *Group[V]) Do(ctx context.Context, key string, fn func(ctx context.Context) (V, error)) (V, error) {
+	g.mu.Lock()
+	c, ok := g.calls[key]
+	if !ok {
+		c = g.start(ctx, key, fn)
+	}
+	if !g.Keep {
+		c.waiters++
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		if !g.Keep {
+			g.mu.Lock()
+			c.waiters--
+			if c.waiters == 0 {
+				c.cancel()
+				g.forget(key, c)
+			}
+			g.mu.Unlock()
+		}
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+// start runs the call for key, it must be called with the lock held
+func (g *Group[V]) start(ctx context.Context, key string, fn func(ctx context.Context) (V, error)) *call[V] {
+	var (
+		callCtx context.Context
+		cancel  context.CancelFunc
+	)
+	if g.Timeout > 0 {
+		callCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), g.Timeout)
+	} else {
+		callCtx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+	}
+	c := &call[V]{done: make(chan struct{}), cancel: cancel}
+	if g.calls == nil {
+		g.calls = make(map[string]*call[V])
+	}
+	g.calls[key] = c
+	go func() {
+		c.val, c.err = fn(callCtx)
+		cancel()
+		if !g.Keep || c.err != nil {
+			g.mu.Lock()
+			g.forget(key, c)
+			g.mu.Unlock()
+		}
+		close(c.done)
+	}()
+	return c
+}
+
+// forget removes c unless it was already replaced, it must be called with the lock held
+func (g *Group[V]) forget(key string, c *call[V]) {
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
+
+// Forget drops the result kept for key, the next caller calls it again
+func (g *Group[V]) Forget(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.calls, key)
+}
+
+// Reset drops every kept result
+func (g *Group[V]) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	clear(g.calls)
+}
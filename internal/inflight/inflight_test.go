@@ -0,0 +1,102 @@
+package inflight
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupSharesCalls(t *testing.T) {
+	var (
+		g     Group[int]
+		calls atomic.Int32
+	)
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (int, error) {
+		calls.Add(1)
+		<-release
+		return 42, nil
+	}
+
+	// the first caller giving up doesn't fail the call shared with the others
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := g.Do(ctx, "key", fn)
+		first <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	second := make(chan int, 1)
+	go func() {
+		v, _ := g.Do(context.Background(), "key", fn)
+		second <- v
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-first, context.Canceled)
+	close(release)
+	require.Equal(t, 42, <-second)
+	require.Equal(t, int32(1), calls.Load())
+
+	// without Keep the next caller calls again
+	_, err := g.Do(context.Background(), "key", fn)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestGroupCancelsAbandonedCalls(t *testing.T) {
+	var g Group[int]
+	cancelled := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := g.Do(ctx, "key", func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return 0, ctx.Err()
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("abandoned call not cancelled")
+	}
+}
+
+func TestGroupKeep(t *testing.T) {
+	g := Group[int]{Keep: true, Timeout: 10 * time.Millisecond}
+	var calls atomic.Int32
+
+	// failures aren't kept
+	_, err := g.Do(context.Background(), "key", func(ctx context.Context) (int, error) {
+		calls.Add(1)
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	ok := func(ctx context.Context) (int, error) {
+		calls.Add(1)
+		return 1, nil
+	}
+	for i := 0; i < 3; i++ {
+		v, err := g.Do(context.Background(), "key", ok)
+		require.NoError(t, err)
+		require.Equal(t, 1, v)
+	}
+	require.Equal(t, int32(2), calls.Load())
+
+	g.Forget("key")
+	_, err = g.Do(context.Background(), "key", ok)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), calls.Load())
+
+	g.Reset()
+	_, err = g.Do(context.Background(), "key", func(ctx context.Context) (int, error) {
+		return 0, errors.New("failed")
+	})
+	require.Error(t, err)
+}
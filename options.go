@@ -4,12 +4,20 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"time"
+
+	"github.com/projectdiscovery/retryabledns/doh"
 )
 
 var (
 	ErrMaxRetriesZero = errors.New("retries must be at least 1")
 	ErrResolversEmpty = errors.New("resolvers list must not be empty")
+	ErrCacheTTLRange  = errors.New("cache min ttl must not exceed cache max ttl")
+	// ErrUnknownHTTPVersion is returned when the doh http version is not supported
+	ErrUnknownHTTPVersion = errors.New("unknown doh http version")
+	// ErrHTTP3Proxy is returned when HTTP/3 is used for doh along with a proxy
+	ErrHTTP3Proxy = errors.New("doh over http/3 can't be used through a proxy")
 
 	BaseResolvers = []string{
 		"1.1.1.1:53",
@@ -34,6 +42,58 @@ type Options struct {
 	ConnectionPoolThreads int
 	MaxPerCNAMEFollows    int
 	Proxy                 string
+	// CacheSize is the maximum number of responses kept in the cache, zero disables caching
+	CacheSize int
+	// CacheMinTTL and CacheMaxTTL clamp the time a response is kept in the cache
+	CacheMinTTL time.Duration
+	CacheMaxTTL time.Duration
+	// CoalesceQueries merges concurrent identical queries into a single exchange
+	CoalesceQueries bool
+	// SelectionStrategy picks the resolver for each attempt, round robin by default
+	SelectionStrategy SelectionStrategy
+	// QuarantineThreshold is the number of consecutive failures after which a resolver
+	// is taken out of rotation for QuarantineDuration, zero disables quarantine
+	QuarantineThreshold int
+	QuarantineDuration  time.Duration
+	// GlobalRateLimit limits the queries sent to all the resolvers together, its rate
+	// backs off when any resolver answers REFUSED or times out
+	GlobalRateLimit RateLimit
+	// ResolverRateLimit limits the queries sent to each resolver, unless
+	// overridden in ResolverRateLimits which is keyed by resolver address
+	ResolverRateLimit  RateLimit
+	ResolverRateLimits map[string]RateLimit
+	// RateLimitPolicy defines whether rate limited queries wait or fail fast
+	RateLimitPolicy RateLimitPolicy
+	// RetryPolicy defines the backoff between attempts
+	RetryPolicy RetryPolicy
+	// RetryClassifier decides which attempts are retried, DefaultClassifier if nil
+	RetryClassifier Classifier
+	// RecordAttempts stores the outcome of every attempt in DNSData.Attempts
+	RecordAttempts bool
+	// HedgeDelay enables hedging, the question is sent to the next resolver if no answer is received within the delay
+	HedgeDelay time.Duration
+	// HedgeDynamicDelay enables hedging using the p95 of the observed rtt as delay
+	HedgeDynamicDelay bool
+	// HedgeMaxRequests is the maximum number of concurrent exchanges of a hedged attempt
+	HedgeMaxRequests int
+	// ConsensusPolicy defines how many resolvers must agree in Consensus, majority by default
+	ConsensusPolicy ConsensusPolicy
+	// ConsensusResolvers is the number of resolvers queried by Consensus, all of them if zero
+	ConsensusResolvers int
+	// DoHHTTPVersion is the http version used by doh resolvers, HTTP/2 by default
+	DoHHTTPVersion doh.HTTPVersion
+	// DoHMaxIdleConns, DoHMaxIdleConnsPerHost and DoHIdleConnTimeout tune the reuse of doh connections
+	DoHMaxIdleConns        int
+	DoHMaxIdleConnsPerHost int
+	DoHIdleConnTimeout     time.Duration
+	// DoHHeaders are added to each doh request
+	DoHHeaders http.Header
+	// DoHUserAgent overrides the user agent of doh requests
+	DoHUserAgent string
+	// TLS configures the connections to dot, doh and doq resolvers, unless
+	// overridden in ResolverTLS which is keyed by resolver address
+	TLS         TLSOptions
+	ResolverTLS map[string]TLSOptions
 }
 
 // Returns a net.Addr of a UDP or TCP type depending on whats required
@@ -87,5 +147,75 @@ func (options *Options) Validate() error {
 	if len(options.BaseResolvers) == 0 {
 		return ErrResolversEmpty
 	}
-	return nil
+
+	resolvers, err := parseResolvers(options.BaseResolvers)
+	if err != nil {
+		return err
+	}
+	if options.Proxy != "" {
+		for _, resolver := range resolvers {
+			if r, ok := resolver.(*NetworkResolver); ok && r.Protocol == DOQ {
+				return ErrDOQProxyUnsupported
+			}
+		}
+	}
+
+	if options.CacheMaxTTL > 0 && options.CacheMinTTL > options.CacheMaxTTL {
+		return ErrCacheTTLRange
+	}
+
+	switch options.SelectionStrategy {
+	case "", RoundRobin, WeightedRandom, LowestLatency, PowerOfTwoChoices:
+	default:
+		return ErrUnknownSelectionStrategy
+	}
+
+	if err := options.GlobalRateLimit.validate(); err != nil {
+		return err
+	}
+	if err := options.ResolverRateLimit.validate(); err != nil {
+		return err
+	}
+	for _, limit := range options.ResolverRateLimits {
+		if err := limit.validate(); err != nil {
+			return err
+		}
+	}
+
+	switch options.RateLimitPolicy {
+	case "", RateLimitWait, RateLimitFailFast:
+	default:
+		return ErrUnknownRateLimitPolicy
+	}
+
+	switch options.ConsensusPolicy {
+	case "", ConsensusMajority, ConsensusUnanimous:
+	default:
+		return ErrUnknownConsensusPolicy
+	}
+
+	switch options.DoHHTTPVersion {
+	case "", doh.HTTP1, doh.HTTP2:
+	case doh.HTTP3:
+		if options.Proxy != "" {
+			return ErrHTTP3Proxy
+		}
+	default:
+		return ErrUnknownHTTPVersion
+	}
+
+	if err := options.TLS.validate(); err != nil {
+		return err
+	}
+	for _, tlsOptions := range options.ResolverTLS {
+		if err := tlsOptions.validate(); err != nil {
+			return err
+		}
+	}
+
+	if options.HedgeDelay < 0 || options.HedgeMaxRequests < 0 {
+		return ErrInvalidHedge
+	}
+
+	return options.RetryPolicy.validate()
 }
@@ -3,7 +3,9 @@ package retryabledns
 import (
 	"net"
 	"testing"
+	"time"
 
+	"github.com/projectdiscovery/retryabledns/doh"
 	stringsutil "github.com/projectdiscovery/utils/strings"
 	"github.com/stretchr/testify/require"
 )
@@ -52,4 +54,33 @@ func TestValidateOptions(t *testing.T) {
 		err := options.Validate()
 		require.ErrorIs(t, err, ErrResolversEmpty)
 	})
+	t.Run("cache min ttl errors if above max ttl", func(t *testing.T) {
+		options := Options{
+			MaxRetries:    1,
+			BaseResolvers: []string{"1.1.1.1:53"},
+			CacheMinTTL:   time.Minute,
+			CacheMaxTTL:   time.Second,
+		}
+		err := options.Validate()
+		require.ErrorIs(t, err, ErrCacheTTLRange)
+	})
+	t.Run("doh http version errors if unknown", func(t *testing.T) {
+		options := Options{
+			MaxRetries:     1,
+			BaseResolvers:  []string{"1.1.1.1:53"},
+			DoHHTTPVersion: "spdy",
+		}
+		err := options.Validate()
+		require.ErrorIs(t, err, ErrUnknownHTTPVersion)
+	})
+	t.Run("doh http3 errors with a proxy", func(t *testing.T) {
+		options := Options{
+			MaxRetries:     1,
+			BaseResolvers:  []string{"1.1.1.1:53"},
+			DoHHTTPVersion: doh.HTTP3,
+			Proxy:          "socks5://127.0.0.1:1080",
+		}
+		err := options.Validate()
+		require.ErrorIs(t, err, ErrHTTP3Proxy)
+	})
 }
@@ -0,0 +1,212 @@
+package retryabledns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitPolicy defines what happens to a query exceeding the rate limit
+type RateLimitPolicy string
+
+const (
+	// RateLimitWait blocks the query until a token is available or the context is done
+	RateLimitWait RateLimitPolicy = "wait"
+	// RateLimitFailFast fails the attempt with ErrRateLimited when no token is available
+	RateLimitFailFast RateLimitPolicy = "fail-fast"
+)
+
+func (p RateLimitPolicy) String() string {
+	return string(p)
+}
+
+var (
+	// ErrRateLimited is returned when an attempt is dropped by the fail fast rate limit policy
+	ErrRateLimited = errors.New("rate limit exceeded")
+	// ErrInvalidRateLimit is returned when a rate limit has a negative rate or burst
+	ErrInvalidRateLimit = errors.New("rate limit qps and burst must not be negative")
+	// ErrUnknownRateLimitPolicy is returned when the rate limit policy is not supported
+	ErrUnknownRateLimitPolicy = errors.New("unknown rate limit policy")
+)
+
+const (
+	// rateBackoffFactor is applied to the rate of a resolver returning REFUSED or timing out
+	rateBackoffFactor = 0.5
+	// rateRecoveryStep is the fraction of the configured rate restored on each success
+	rateRecoveryStep = 0.1
+	// rateFloorFactor is the lowest fraction of the configured rate a resolver can back off to
+	rateFloorFactor = 0.1
+)
+
+// RateLimit is a token bucket limit, zero QPS means unlimited
+type RateLimit struct {
+	QPS   float64
+	Burst int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.QPS > 0
+}
+
+func (l RateLimit) validate() error {
+	if l.QPS < 0 || l.Burst < 0 {
+		return ErrInvalidRateLimit
+	}
+	return nil
+}
+
+func (l RateLimit) newLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(l.QPS), max(l.Burst, 1))
+}
+
+// adaptiveLimiter is a limiter whose rate is halved when resolvers push back
+// and slowly restored as they answer again
+type adaptiveLimiter struct {
+	*rate.Limiter
+	mu   sync.Mutex
+	base rate.Limit
+}
+
+func (l *adaptiveLimiter) backoff() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.SetLimit(max(l.Limit()*rateBackoffFactor, l.base*rateFloorFactor))
+}
+
+func (l *adaptiveLimiter) recover() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if current := l.Limit(); current < l.base {
+		l.SetLimit(min(current+l.base*rateRecoveryStep, l.base))
+	}
+}
+
+type rateLimiter struct {
+	policy         RateLimitPolicy
+	global         *adaptiveLimiter
+	resolverLimit  RateLimit
+	resolverLimits map[string]RateLimit
+
+	mu        sync.Mutex
+	resolvers map[string]*adaptiveLimiter
+}
+
+// newRateLimiter returns nil if no limit is configured
+func newRateLimiter(options Options) *rateLimiter {
+	hasResolverLimits := false
+	for _, limit := range options.ResolverRateLimits {
+		hasResolverLimits = hasResolverLimits || limit.enabled()
+	}
+	if !options.GlobalRateLimit.enabled() && !options.ResolverRateLimit.enabled() && !hasResolverLimits {
+		return nil
+	}
+	rl := &rateLimiter{
+		policy:         options.RateLimitPolicy,
+		resolverLimit:  options.ResolverRateLimit,
+		resolverLimits: options.ResolverRateLimits,
+		resolvers:      make(map[string]*adaptiveLimiter),
+	}
+	if options.GlobalRateLimit.enabled() {
+		rl.global = &adaptiveLimiter{Limiter: options.GlobalRateLimit.newLimiter(), base: rate.Limit(options.GlobalRateLimit.QPS)}
+	}
+	return rl
+}
+
+// resolverLimiter returns the limiter of resolver, or nil if it's not limited
+func (rl *rateLimiter) resolverLimiter(resolver Resolver) *adaptiveLimiter {
+	key := resolver.String()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if limiter, ok := rl.resolvers[key]; ok {
+		return limiter
+	}
+	limit, ok := rl.resolverLimits[key]
+	if !ok {
+		limit = rl.resolverLimit
+	}
+	var limiter *adaptiveLimiter
+	if limit.enabled() {
+		limiter = &adaptiveLimiter{Limiter: limit.newLimiter(), base: rate.Limit(limit.QPS)}
+	}
+	rl.resolvers[key] = limiter
+	return limiter
+}
+
+// wait acquires a token from both the resolver and the global limiter according to the policy
+func (rl *rateLimiter) wait(ctx context.Context, resolver Resolver) error {
+	limiters := make([]*rate.Limiter, 0, 2)
+	if limiter := rl.resolverLimiter(resolver); limiter != nil {
+		limiters = append(limiters, limiter.Limiter)
+	}
+	if rl.global != nil {
+		limiters = append(limiters, rl.global.Limiter)
+	}
+
+	// tokens are reserved from every limiter upfront, so that none is used up
+	// unless all of them are granted
+	now := time.Now()
+	reservations := make([]*rate.Reservation, 0, len(limiters))
+	// reservations are cancelled as of their creation, as those due already
+	// wouldn't give their token back otherwise
+	cancel := func() {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+	var delay time.Duration
+	for _, limiter := range limiters {
+		reservation := limiter.ReserveN(now, 1)
+		reservations = append(reservations, reservation)
+		if !reservation.OK() || (rl.policy == RateLimitFailFast && reservation.DelayFrom(now) > 0) {
+			cancel()
+			return ErrRateLimited
+		}
+		delay = max(delay, reservation.DelayFrom(now))
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(delay)) {
+		cancel()
+		return fmt.Errorf("dns query aborted: %w", context.DeadlineExceeded)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return contextError(ctx)
+	}
+}
+
+// feedback adapts the rate of resolver to the outcome of an exchange
+func (rl *rateLimiter) feedback(resolver Resolver, resp *dns.Msg, err error) {
+	// the global limiter adapts too, so that a global only limit slows down as well
+	limiters := make([]*adaptiveLimiter, 0, 2)
+	if limiter := rl.resolverLimiter(resolver); limiter != nil {
+		limiters = append(limiters, limiter)
+	}
+	if rl.global != nil {
+		limiters = append(limiters, rl.global)
+	}
+	var netErr net.Error
+	for _, limiter := range limiters {
+		switch {
+		case err != nil && errors.As(err, &netErr) && netErr.Timeout():
+			limiter.backoff()
+		case resp != nil && resp.Rcode == dns.RcodeRefused:
+			limiter.backoff()
+		case err == nil:
+			limiter.recover()
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package retryabledns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimit(t *testing.T) {
+	refused := false
+	RegisterTransport("limited", func(client *Client, resolver Resolver) (Transport, error) {
+		return TransportFunc(func(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+			resp := new(dns.Msg)
+			resp.SetReply(msg)
+			if refused {
+				resp.Rcode = dns.RcodeRefused
+				return resp, 0, nil
+			}
+			rr, _ := dns.NewRR(msg.Question[0].Name + " 60 IN A 127.0.0.8")
+			resp.Answer = append(resp.Answer, rr)
+			return resp, 0, nil
+		}), nil
+	})
+	defer RegisterTransport("limited", nil)
+
+	t.Run("fail fast", func(t *testing.T) {
+		client, err := NewWithOptions(Options{
+			BaseResolvers:   []string{"limited:a"},
+			MaxRetries:      1,
+			GlobalRateLimit: RateLimit{QPS: 1, Burst: 2},
+			RateLimitPolicy: RateLimitFailFast,
+		})
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			_, err := client.A("example.com")
+			require.NoError(t, err)
+		}
+		_, err = client.A("example.com")
+		require.ErrorIs(t, err, ErrRateLimited)
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		client, err := NewWithOptions(Options{
+			BaseResolvers:     []string{"limited:a", "limited:b"},
+			MaxRetries:        1,
+			ResolverRateLimit: RateLimit{QPS: 1000},
+			ResolverRateLimits: map[string]RateLimit{
+				"b": {QPS: 20, Burst: 1},
+			},
+		})
+		require.NoError(t, err)
+		start := time.Now()
+		for i := 0; i < 10; i++ {
+			_, err := client.A("example.com")
+			require.NoError(t, err)
+		}
+		// five queries go to b which allows one every 50ms
+		require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		client.rateLimiter.resolverLimiter(&CustomResolver{Protocol: "limited", Address: "b"}).SetLimit(0.001)
+		_, err = client.QueryMultipleWithResolverContext(ctx, "example.com", []uint16{dns.TypeA}, &CustomResolver{Protocol: "limited", Address: "b"})
+		require.Error(t, err)
+	})
+
+	t.Run("wait cancelled", func(t *testing.T) {
+		client, err := NewWithOptions(Options{
+			BaseResolvers:     []string{"limited:a"},
+			MaxRetries:        1,
+			GlobalRateLimit:   RateLimit{QPS: 1, Burst: 1},
+			ResolverRateLimit: RateLimit{QPS: 1, Burst: 1},
+		})
+		require.NoError(t, err)
+		limiter := client.rateLimiter.resolverLimiter(client.resolvers[0])
+		require.True(t, client.rateLimiter.global.Allow())
+
+		// the resolver token isn't used up when waiting for the global one fails
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		require.ErrorIs(t, client.rateLimiter.wait(ctx, client.resolvers[0]), context.Canceled)
+		require.InDelta(t, 1, limiter.Tokens(), 0.1)
+	})
+
+	t.Run("adaptive backoff", func(t *testing.T) {
+		client, err := NewWithOptions(Options{
+			BaseResolvers:     []string{"limited:a"},
+			MaxRetries:        1,
+			ResolverRateLimit: RateLimit{QPS: 1000, Burst: 10},
+		})
+		require.NoError(t, err)
+		limiter := client.rateLimiter.resolverLimiter(client.resolvers[0])
+
+		refused = true
+		_, _ = client.A("example.com")
+		_, _ = client.A("example.com")
+		require.Equal(t, rate.Limit(250), limiter.Limit())
+
+		refused = false
+		_, err = client.A("example.com")
+		require.NoError(t, err)
+		require.Equal(t, rate.Limit(350), limiter.Limit())
+	})
+
+	t.Run("adaptive global backoff", func(t *testing.T) {
+		client, err := NewWithOptions(Options{
+			BaseResolvers:   []string{"limited:a"},
+			MaxRetries:      1,
+			GlobalRateLimit: RateLimit{QPS: 1000, Burst: 10},
+		})
+		require.NoError(t, err)
+		require.Nil(t, client.rateLimiter.resolverLimiter(client.resolvers[0]))
+
+		refused = true
+		_, _ = client.A("example.com")
+		_, _ = client.A("example.com")
+		require.Equal(t, rate.Limit(250), client.rateLimiter.global.Limit())
+
+		refused = false
+		_, err = client.A("example.com")
+		require.NoError(t, err)
+		require.Equal(t, rate.Limit(350), client.rateLimiter.global.Limit())
+	})
+
+	options := Options{BaseResolvers: []string{"1.1.1.1"}, MaxRetries: 1, GlobalRateLimit: RateLimit{QPS: -1}}
+	require.ErrorIs(t, options.Validate(), ErrInvalidRateLimit)
+	options = Options{BaseResolvers: []string{"1.1.1.1"}, MaxRetries: 1, RateLimitPolicy: "drop"}
+	require.ErrorIs(t, options.Validate(), ErrUnknownRateLimitPolicy)
+}
@@ -0,0 +1,283 @@
+package retryabledns
+
+import (
+	"maps"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Section is the section of a dns message a record was found in
+type Section string
+
+const (
+	SectionAnswer     Section = "answer"
+	SectionAuthority  Section = "authority"
+	SectionAdditional Section = "additional"
+)
+
+// Record is a resource record with its header and the section it was found in
+type Record struct {
+	Name    string  `json:"name,omitempty"`
+	Type    string  `json:"type,omitempty"`
+	Class   string  `json:"class,omitempty"`
+	TTL     uint32  `json:"ttl"`
+	Section Section `json:"section,omitempty"`
+	Data    string  `json:"data,omitempty"`
+}
+
+func newRecord(rr dns.RR, section Section) Record {
+	hdr := rr.Header()
+	return Record{
+		Name:    trimChars(hdr.Name),
+		Type:    dns.Type(hdr.Rrtype).String(),
+		Class:   dns.Class(hdr.Class).String(),
+		TTL:     hdr.Ttl,
+		Section: section,
+		Data:    strings.TrimPrefix(rr.String(), hdr.String()),
+	}
+}
+
+// Flags are the header flags of the responses parsed in a DNSData. With several responses,
+// e.g. A and AAAA, a flag is only set if all of them have it while TC is set if any has it.
+type Flags struct {
+	Authoritative      bool `json:"aa,omitempty"`
+	Truncated          bool `json:"tc,omitempty"`
+	RecursionDesired   bool `json:"rd,omitempty"`
+	RecursionAvailable bool `json:"ra,omitempty"`
+	AuthenticatedData  bool `json:"ad,omitempty"`
+	CheckingDisabled   bool `json:"cd,omitempty"`
+}
+
+func newFlags(msg *dns.Msg) *Flags {
+	return &Flags{
+		Authoritative:      msg.Authoritative,
+		Truncated:          msg.Truncated,
+		RecursionDesired:   msg.RecursionDesired,
+		RecursionAvailable: msg.RecursionAvailable,
+		AuthenticatedData:  msg.AuthenticatedData,
+		CheckingDisabled:   msg.CheckingDisabled,
+	}
+}
+
+// merge returns the flags common to the responses of f and other, TC is kept if any is truncated
+func (f *Flags) merge(other *Flags) *Flags {
+	if f == nil {
+		return other
+	}
+	return &Flags{
+		Authoritative:      f.Authoritative && other.Authoritative,
+		Truncated:          f.Truncated || other.Truncated,
+		RecursionDesired:   f.RecursionDesired && other.RecursionDesired,
+		RecursionAvailable: f.RecursionAvailable && other.RecursionAvailable,
+		AuthenticatedData:  f.AuthenticatedData && other.AuthenticatedData,
+		CheckingDisabled:   f.CheckingDisabled && other.CheckingDisabled,
+	}
+}
+
+// RecordsIn returns the records found in the section
+func (d *DNSData) RecordsIn(section Section) []Record {
+	var records []Record
+	for _, record := range d.Records {
+		if record.Section == section {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// IsReferral returns true if the response is a delegation to the name servers
+// of the authority section rather than an answer
+func (d *DNSData) IsReferral() bool {
+	if d.Flags == nil || d.Flags.Authoritative || len(d.RecordsIn(SectionAnswer)) > 0 {
+		return false
+	}
+	return slices.ContainsFunc(d.RecordsIn(SectionAuthority), func(record Record) bool {
+		return record.Type == "NS"
+	})
+}
+
+// SVCB is a service binding record (RFC 9460), HTTPS records share its format
+type SVCB struct {
+	Priority      uint16            `json:"priority"`
+	Target        string            `json:"target,omitempty"`
+	Mandatory     []string          `json:"mandatory,omitempty"`
+	ALPN          []string          `json:"alpn,omitempty"`
+	NoDefaultALPN bool              `json:"no_default_alpn,omitempty"`
+	Port          uint16            `json:"port,omitempty"`
+	IPv4Hint      []string          `json:"ipv4hint,omitempty"`
+	IPv6Hint      []string          `json:"ipv6hint,omitempty"`
+	ECHConfig     []byte            `json:"ech,omitempty"`
+	DoHPath       string            `json:"dohpath,omitempty"`
+	OHTTP         bool              `json:"ohttp,omitempty"`
+	Params        map[string]string `json:"params,omitempty"`
+	TTL           uint32            `json:"ttl,omitempty"`
+}
+
+// AliasMode returns true if the record aliases the name to its target
+func (s SVCB) AliasMode() bool {
+	return s.Priority == 0
+}
+
+// HasALPN returns true if the service advertises the protocol, e.g. "h3"
+func (s SVCB) HasALPN(protocol string) bool {
+	return slices.Contains(s.ALPN, protocol)
+}
+
+// HasECH returns true if the service publishes an ECH config list
+func (s SVCB) HasECH() bool {
+	return len(s.ECHConfig) > 0
+}
+
+// cloneSVCB returns a deep copy of the records
+func cloneSVCB(records []SVCB) []SVCB {
+	if records == nil {
+		return nil
+	}
+	c := make([]SVCB, len(records))
+	for i, record := range records {
+		c[i] = record.clone()
+	}
+	return c
+}
+
+func (s SVCB) clone() SVCB {
+	s.Mandatory = slices.Clone(s.Mandatory)
+	s.ALPN = slices.Clone(s.ALPN)
+	s.IPv4Hint = slices.Clone(s.IPv4Hint)
+	s.IPv6Hint = slices.Clone(s.IPv6Hint)
+	s.ECHConfig = slices.Clone(s.ECHConfig)
+	s.Params = maps.Clone(s.Params)
+	return s
+}
+
+// TLSA is a DANE certificate association record
+type TLSA struct {
+	Usage        uint8  `json:"usage"`
+	Selector     uint8  `json:"selector"`
+	MatchingType uint8  `json:"matching_type"`
+	Certificate  string `json:"certificate,omitempty"`
+	TTL          uint32 `json:"ttl,omitempty"`
+}
+
+// SSHFP is a ssh public key fingerprint record
+type SSHFP struct {
+	Algorithm   uint8  `json:"algorithm"`
+	Type        uint8  `json:"type"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	TTL         uint32 `json:"ttl,omitempty"`
+}
+
+// DS is a delegation signer record
+type DS struct {
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  uint8  `json:"algorithm"`
+	DigestType uint8  `json:"digest_type"`
+	Digest     string `json:"digest,omitempty"`
+	TTL        uint32 `json:"ttl,omitempty"`
+}
+
+// DNSKEY is a dnssec public key record
+type DNSKEY struct {
+	Flags     uint16 `json:"flags"`
+	Protocol  uint8  `json:"protocol"`
+	Algorithm uint8  `json:"algorithm"`
+	PublicKey string `json:"public_key,omitempty"`
+	KeyTag    uint16 `json:"key_tag"`
+	TTL       uint32 `json:"ttl,omitempty"`
+}
+
+// NAPTR is a naming authority pointer record
+type NAPTR struct {
+	Order       uint16 `json:"order"`
+	Preference  uint16 `json:"preference"`
+	Flags       string `json:"flags,omitempty"`
+	Service     string `json:"service,omitempty"`
+	Regexp      string `json:"regexp,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	TTL         uint32 `json:"ttl,omitempty"`
+}
+
+// URI is a uniform resource identifier record
+type URI struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Target   string `json:"target,omitempty"`
+	TTL      uint32 `json:"ttl,omitempty"`
+}
+
+// LOC is a location record, the coordinates are in degrees and the
+// altitude, size and precisions in meters
+type LOC struct {
+	Latitude            float64 `json:"latitude"`
+	Longitude           float64 `json:"longitude"`
+	Altitude            float64 `json:"altitude"`
+	Size                float64 `json:"size"`
+	HorizontalPrecision float64 `json:"horizontal_precision"`
+	VerticalPrecision   float64 `json:"vertical_precision"`
+	TTL                 uint32  `json:"ttl,omitempty"`
+}
+
+// HINFO is a host information record
+type HINFO struct {
+	CPU string `json:"cpu,omitempty"`
+	OS  string `json:"os,omitempty"`
+	TTL uint32 `json:"ttl,omitempty"`
+}
+
+func newSVCB(rr *dns.SVCB) SVCB {
+	s := SVCB{Priority: rr.Priority, Target: trimChars(rr.Target), TTL: rr.Hdr.Ttl}
+	for _, kv := range rr.Value {
+		switch value := kv.(type) {
+		case *dns.SVCBMandatory:
+			for _, key := range value.Code {
+				s.Mandatory = append(s.Mandatory, key.String())
+			}
+		case *dns.SVCBAlpn:
+			s.ALPN = append(s.ALPN, value.Alpn...)
+		case *dns.SVCBNoDefaultAlpn:
+			s.NoDefaultALPN = true
+		case *dns.SVCBPort:
+			s.Port = value.Port
+		case *dns.SVCBIPv4Hint:
+			for _, ip := range value.Hint {
+				s.IPv4Hint = append(s.IPv4Hint, ip.String())
+			}
+		case *dns.SVCBIPv6Hint:
+			for _, ip := range value.Hint {
+				s.IPv6Hint = append(s.IPv6Hint, ip.String())
+			}
+		case *dns.SVCBECHConfig:
+			s.ECHConfig = slices.Clone(value.ECH)
+		case *dns.SVCBDoHPath:
+			s.DoHPath = value.Template
+		case *dns.SVCBOhttp:
+			s.OHTTP = true
+		default:
+			if s.Params == nil {
+				s.Params = make(map[string]string)
+			}
+			s.Params[kv.Key().String()] = kv.String()
+		}
+	}
+	return s
+}
+
+func newLOC(rr *dns.LOC) LOC {
+	return LOC{
+		Latitude:            (float64(rr.Latitude) - dns.LOC_EQUATOR) / 3600000,
+		Longitude:           (float64(rr.Longitude) - dns.LOC_PRIMEMERIDIAN) / 3600000,
+		Altitude:            float64(rr.Altitude)/100 - dns.LOC_ALTITUDEBASE,
+		Size:                locMeters(rr.Size),
+		HorizontalPrecision: locMeters(rr.HorizPre),
+		VerticalPrecision:   locMeters(rr.VertPre),
+		TTL:                 rr.Hdr.Ttl,
+	}
+}
+
+// locMeters decodes the mantissa and power of ten of the centimeters of a LOC size
+func locMeters(x uint8) float64 {
+	return float64(x>>4) * math.Pow10(int(x&0x0f)) / 100
+}
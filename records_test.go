@@ -0,0 +1,194 @@
+package retryabledns
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordTypes(t *testing.T) {
+	records := map[uint16][]string{
+		dns.TypeHTTPS: {
+			`example.test. 300 IN HTTPS 1 . alpn="h3,h2" port=8443 ipv4hint=192.0.2.1 ipv6hint=2001:db8::1 ech="AEX+DQBBpQAgACDCEIlZnqUF3DpRKKVsdMGT3oUAAGwJc5j0KsaPAVrBqAAEAAEAAQASY2xvdWRmbGFyZS1lY2guY29tAAA=" key65000=foo`,
+			`example.test. 60 IN HTTPS 1 . alpn="h3,h2" port=8443 ipv4hint=192.0.2.1 ipv6hint=2001:db8::1 ech="AEX+DQBBpQAgACDCEIlZnqUF3DpRKKVsdMGT3oUAAGwJc5j0KsaPAVrBqAAEAAEAAQASY2xvdWRmbGFyZS1lY2guY29tAAA=" key65000=foo`,
+			`example.test. 300 IN HTTPS 0 cdn.example.test.`,
+		},
+		dns.TypeSVCB:   {`_dns.example.test. 300 IN SVCB 1 dns.example.test. mandatory=alpn alpn=h2 dohpath="/dns-query{?dns}"`},
+		dns.TypeTLSA:   {"_443._tcp.example.test. 300 IN TLSA 3 1 1 0C72AC70B745AC19998811B131D662C9AC69DBDBE7CB23E5B514B56664C5D3D6"},
+		dns.TypeSSHFP:  {"example.test. 300 IN SSHFP 4 2 123456789ABCDEF67890123456789ABCDEF67890123456789ABCDEF123456789"},
+		dns.TypeDS:     {"example.test. 300 IN DS 60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118"},
+		dns.TypeDNSKEY: {"example.test. 300 IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ=="},
+		dns.TypeNAPTR:  {`example.test. 300 IN NAPTR 100 10 "S" "SIP+D2U" "" _sip._udp.example.test.`},
+		dns.TypeURI:    {`_ftp._tcp.example.test. 300 IN URI 10 1 "ftp://ftp.example.test/public"`},
+		dns.TypeLOC:    {"example.test. 300 IN LOC 52 22 23.000 N 4 53 32.000 E -2.00m 10m 100m 5m"},
+		dns.TypeHINFO:  {`example.test. 300 IN HINFO "amd64" "linux"`},
+	}
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, record := range records[r.Question[0].Qtype] {
+			rr, err := dns.NewRR(record)
+			if err == nil {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		_ = w.WriteMsg(m)
+	})
+	client, err := New([]string{addr}, 1)
+	require.NoError(t, err)
+
+	data, err := client.HTTPS("example.test")
+	require.NoError(t, err)
+	// the same record with another ttl is a duplicate
+	require.Len(t, data.HTTPS, 2)
+	https := data.HTTPS[0]
+	require.Equal(t, []string{"h3", "h2"}, https.ALPN)
+	require.True(t, https.HasALPN("h3"))
+	require.Equal(t, uint16(8443), https.Port)
+	require.Equal(t, []string{"192.0.2.1"}, https.IPv4Hint)
+	require.Equal(t, []string{"2001:db8::1"}, https.IPv6Hint)
+	require.True(t, https.HasECH())
+	require.Equal(t, map[string]string{"key65000": "foo"}, https.Params)
+	require.Equal(t, uint32(300), https.TTL)
+	require.True(t, data.HTTPS[1].AliasMode())
+	require.Equal(t, "cdn.example.test", data.HTTPS[1].Target)
+
+	data, err = client.SVCB("_dns.example.test")
+	require.NoError(t, err)
+	require.Equal(t, []SVCB{{Priority: 1, Target: "dns.example.test", Mandatory: []string{"alpn"}, ALPN: []string{"h2"}, DoHPath: "/dns-query{?dns}", TTL: 300}}, data.SVCB)
+
+	data, err = client.TLSA("_443._tcp.example.test")
+	require.NoError(t, err)
+	require.Equal(t, []TLSA{{Usage: 3, Selector: 1, MatchingType: 1, Certificate: "0c72ac70b745ac19998811b131d662c9ac69dbdbe7cb23e5b514b56664c5d3d6", TTL: 300}}, data.TLSA)
+
+	data, err = client.SSHFP("example.test")
+	require.NoError(t, err)
+	require.Equal(t, []SSHFP{{Algorithm: 4, Type: 2, Fingerprint: "123456789abcdef67890123456789abcdef67890123456789abcdef123456789", TTL: 300}}, data.SSHFP)
+
+	data, err = client.DS("example.test")
+	require.NoError(t, err)
+	require.Equal(t, []DS{{KeyTag: 60485, Algorithm: 5, DigestType: 1, Digest: "2bb183af5f22588179a53b0a98631fad1a292118", TTL: 300}}, data.DS)
+
+	data, err = client.DNSKEY("example.test")
+	require.NoError(t, err)
+	require.Len(t, data.DNSKEY, 1)
+	require.Equal(t, uint16(257), data.DNSKEY[0].Flags)
+	require.Equal(t, uint8(13), data.DNSKEY[0].Algorithm)
+	require.NotZero(t, data.DNSKEY[0].KeyTag)
+
+	data, err = client.NAPTR("example.test")
+	require.NoError(t, err)
+	require.Equal(t, []NAPTR{{Order: 100, Preference: 10, Flags: "S", Service: "SIP+D2U", Replacement: "_sip._udp.example.test", TTL: 300}}, data.NAPTR)
+
+	data, err = client.URI("_ftp._tcp.example.test")
+	require.NoError(t, err)
+	require.Equal(t, []URI{{Priority: 10, Weight: 1, Target: "ftp://ftp.example.test/public", TTL: 300}}, data.URI)
+
+	data, err = client.LOC("example.test")
+	require.NoError(t, err)
+	require.Len(t, data.LOC, 1)
+	loc := data.LOC[0]
+	require.InDelta(t, 52.373055, loc.Latitude, 1e-5)
+	require.InDelta(t, 4.892222, loc.Longitude, 1e-5)
+	require.InDelta(t, -2, loc.Altitude, 1e-9)
+	require.InDelta(t, 10, loc.Size, 1e-9)
+	require.InDelta(t, 100, loc.HorizontalPrecision, 1e-9)
+	require.InDelta(t, 5, loc.VerticalPrecision, 1e-9)
+
+	data, err = client.HINFO("example.test")
+	require.NoError(t, err)
+	require.Equal(t, []HINFO{{CPU: "amd64", OS: "linux", TTL: 300}}, data.HINFO)
+
+}
+
+func TestRecordMetadata(t *testing.T) {
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch r.Question[0].Name {
+		case "referral.example.test.":
+			ns, _ := dns.NewRR("example.test. 172800 IN NS ns1.example.test.")
+			glue, _ := dns.NewRR("ns1.example.test. 3600 IN A 192.0.2.53")
+			m.Ns = append(m.Ns, ns)
+			m.Extra = append(m.Extra, glue)
+		default:
+			m.Authoritative = true
+			m.AuthenticatedData = true
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+			ns, _ := dns.NewRR("example.test. 86400 IN NS ns1.example.test.")
+			m.Answer = append(m.Answer, rr)
+			m.Ns = append(m.Ns, ns)
+		}
+		m.SetEdns0(1232, false)
+		_ = w.WriteMsg(m)
+	})
+	client, err := New([]string{addr}, 1)
+	require.NoError(t, err)
+
+	data, err := client.A("www.example.test")
+	require.NoError(t, err)
+	require.Equal(t, []Record{
+		{Name: "www.example.test", Type: "A", Class: "IN", TTL: 300, Section: SectionAnswer, Data: "192.0.2.1"},
+		{Name: "example.test", Type: "NS", Class: "IN", TTL: 86400, Section: SectionAuthority, Data: "ns1.example.test."},
+	}, data.Records)
+	require.Equal(t, &Flags{Authoritative: true, RecursionDesired: true, AuthenticatedData: true}, data.Flags)
+	require.Positive(t, data.RTT)
+	require.False(t, data.IsReferral())
+
+	data, err = client.A("referral.example.test")
+	require.NoError(t, err)
+	require.True(t, data.IsReferral())
+	require.Empty(t, data.RecordsIn(SectionAnswer))
+	require.Equal(t, []Record{{Name: "example.test", Type: "NS", Class: "IN", TTL: 172800, Section: SectionAuthority, Data: "ns1.example.test."}}, data.RecordsIn(SectionAuthority))
+	require.Equal(t, []Record{{Name: "ns1.example.test", Type: "A", Class: "IN", TTL: 3600, Section: SectionAdditional, Data: "192.0.2.53"}}, data.RecordsIn(SectionAdditional))
+}
+
+func TestRecordMetadataRetries(t *testing.T) {
+	var flaky atomic.Int32
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch r.Question[0].Name {
+		case "flaky.example.test.":
+			if flaky.Add(1) == 1 {
+				m.Rcode = dns.RcodeServerFailure
+				m.Truncated = true
+				ns, _ := dns.NewRR("example.test. 172800 IN NS ns1.example.test.")
+				m.Ns = append(m.Ns, ns)
+				break
+			}
+			m.Authoritative = true
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.2")
+			m.Answer = append(m.Answer, rr)
+		default:
+			if r.Question[0].Qtype == dns.TypeA {
+				m.Authoritative = true
+				rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.3")
+				m.Answer = append(m.Answer, rr)
+			} else {
+				soa, _ := dns.NewRR("example.test. 300 IN SOA ns1.example.test. admin.example.test. 1 7200 3600 86400 300")
+				m.Ns = append(m.Ns, soa)
+			}
+		}
+		_ = w.WriteMsg(m)
+	})
+	client, err := NewWithOptions(Options{BaseResolvers: []string{addr}, MaxRetries: 2, RecordAttempts: true})
+	require.NoError(t, err)
+
+	// the retried servfail doesn't add its records nor flags
+	data, err := client.A("flaky.example.test")
+	require.NoError(t, err)
+	require.Equal(t, []Record{{Name: "flaky.example.test", Type: "A", Class: "IN", TTL: 300, Section: SectionAnswer, Data: "192.0.2.2"}}, data.Records)
+	require.Equal(t, &Flags{Authoritative: true, RecursionDesired: true}, data.Flags)
+	require.Len(t, data.Attempts, 2)
+	require.Equal(t, data.Attempts[1].RTT, data.RTT)
+
+	// the flags of both responses are merged
+	data, err = client.Resolve("v4only.example.test")
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.0.2.3"}, data.A)
+	require.Equal(t, &Flags{RecursionDesired: true}, data.Flags)
+	require.Len(t, data.RecordsIn(SectionAuthority), 1)
+}
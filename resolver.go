@@ -1,12 +1,23 @@
 package retryabledns
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"net/url"
+	"strconv"
 	"strings"
 
+	"github.com/miekg/dns"
+
 	stringsutil "github.com/projectdiscovery/utils/strings"
 )
 
+var (
+	// ErrInvalidResolver is returned when a resolver can't be parsed
+	ErrInvalidResolver = errors.New("invalid resolver")
+)
+
 type Protocol string
 
 const (
@@ -14,6 +25,9 @@ const (
 	TCP Protocol = "tcp"
 	DOH Protocol = "doh"
 	DOT Protocol = "dot"
+	DOQ Protocol = "doq"
+	// DNSCrypt resolvers are parsed as DNSCryptResolver
+	DNSCrypt Protocol = "dnscrypt"
 )
 
 func (p Protocol) String() string {
@@ -30,6 +44,8 @@ const (
 	JsonAPI DohProtocol = "jsonapi"
 	GET     DohProtocol = "get"
 	POST    DohProtocol = "post"
+	// ODOH resolvers send oblivious queries (RFC 9230) to the target URL through the relay
+	ODOH DohProtocol = "odoh"
 )
 
 func (p DohProtocol) String() string {
@@ -48,6 +64,10 @@ type NetworkResolver struct {
 	Protocol Protocol
 	Host     string
 	Port     string
+	// ServerName overrides the tls server name of dot and doq resolvers
+	ServerName string
+	// CertificateHashes are the hashes of a dns stamp, a certificate of the chain must match one
+	CertificateHashes [][]byte
 }
 
 func (r NetworkResolver) String() string {
@@ -57,6 +77,15 @@ func (r NetworkResolver) String() string {
 type DohResolver struct {
 	Protocol DohProtocol
 	URL      string
+	// ServerName overrides the tls server name of the URL host
+	ServerName string
+	// Addr is dialed instead of resolving the URL host, e.g. the address of a dns stamp
+	Addr string
+	// CertificateHashes are the hashes of a dns stamp, a certificate of the chain must match one
+	CertificateHashes [][]byte
+	// Relay is the URL oblivious queries are sent through, the target configs
+	// are fetched directly from the target
+	Relay string
 }
 
 func (r DohResolver) Method() string {
@@ -71,7 +100,34 @@ func (r DohResolver) String() string {
 	return r.URL
 }
 
-func parseResolver(r string) (resolver Resolver) {
+// parseResolver parses a resolver in one of the supported forms:
+//   - host[:port], udp:host[:port], tcp:host[:port], dot:host[:port] and doq:host[:port]
+//   - doh:url[:get|:post|:jsonapi]
+//   - udp://, tcp://, tls://, quic:// and https:// urls
+//   - sdns:// stamps
+//   - dnscrypt:sdns:// and dnscrypt:host[:port]#provider-name/hex-public-key
+//   - odoh:target-url|relay-url
+//   - scheme:address for registered transports
+//
+// A '#' suffix carries the tls server name, e.g. dot:1.1.1.1#cloudflare-dns.com
+func parseResolver(r string) (Resolver, error) {
+	if customResolver, ok := parseCustomResolver(r); ok {
+		return customResolver, nil
+	}
+	if strings.HasPrefix(r, stampScheme) {
+		return parseStamp(r)
+	}
+	if strings.HasPrefix(r, DNSCrypt.StringWithSemicolon()) {
+		return parseDNSCryptResolver(strings.TrimPrefix(r, DNSCrypt.StringWithSemicolon()))
+	}
+	if strings.HasPrefix(r, ODOH.String()+":") {
+		return parseODoHResolver(strings.TrimPrefix(r, ODOH.String()+":"))
+	}
+	if strings.Contains(r, "://") && !strings.HasPrefix(r, DOH.StringWithSemicolon()) {
+		return parseResolverURL(r)
+	}
+
+	r, serverName, _ := strings.Cut(r, "#")
 	rNetworkTokens := trimProtocol(r)
 	protocol := UDP
 
@@ -82,43 +138,130 @@ func parseResolver(r string) (resolver Resolver) {
 			protocol = TCP
 		case "dot":
 			protocol = DOT
+		case "doq":
+			protocol = DOQ
 		case "doh":
-			protocol = DOH
 			isJsonApi, isGet := hasDohProtocol(r, JsonAPI.StringWithSemicolon()), hasDohProtocol(r, GET.StringWithSemicolon())
 			URL := trimDohProtocol(rNetworkTokens)
-			dohResolver := &DohResolver{URL: URL, Protocol: POST}
+			if err := validateDohURL(URL); err != nil {
+				return nil, err
+			}
+			dohResolver := &DohResolver{URL: URL, Protocol: POST, ServerName: serverName}
 			if isJsonApi {
 				dohResolver.Protocol = JsonAPI
 			} else if isGet {
 				dohResolver.Protocol = GET
 			}
-			resolver = dohResolver
-		default:
-			// unsupported protocol?
+			return dohResolver, nil
 		}
 	}
 
-	if protocol != DOH {
-		networkResolver := &NetworkResolver{Protocol: protocol}
-		parseHostPort(networkResolver, rNetworkTokens)
-		resolver = networkResolver
+	networkResolver := &NetworkResolver{Protocol: protocol, ServerName: serverName}
+	if err := parseHostPort(networkResolver, rNetworkTokens); err != nil {
+		return nil, err
 	}
+	return networkResolver, nil
+}
+
+// urlSchemes maps the schemes of url resolvers to their protocol
+var urlSchemes = map[string]Protocol{
+	"udp":   UDP,
+	"tcp":   TCP,
+	"tls":   DOT,
+	"quic":  DOQ,
+	"https": DOH,
+}
 
-	return
+// parseResolverURL parses resolvers such as tls://1.1.1.1:853#cloudflare-dns.com
+func parseResolverURL(r string) (Resolver, error) {
+	u, err := url.Parse(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResolver, err)
+	}
+	protocol, ok := urlSchemes[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported scheme %q", ErrInvalidResolver, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%w: missing host", ErrInvalidResolver)
+	}
+	if protocol == DOH {
+		URL, _, _ := strings.Cut(r, "#")
+		return &DohResolver{URL: URL, Protocol: POST, ServerName: u.Fragment}, nil
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return nil, fmt.Errorf("%w: unexpected path, query or user in %s url", ErrInvalidResolver, u.Scheme)
+	}
+	networkResolver := &NetworkResolver{Protocol: protocol, ServerName: u.Fragment}
+	if err := parseHostPort(networkResolver, u.Host); err != nil {
+		return nil, err
+	}
+	return networkResolver, nil
 }
 
-func parseHostPort(networkResolver *NetworkResolver, r string) {
+// defaultPort returns the port used by protocol if none is given
+func defaultPort(protocol Protocol) string {
+	switch protocol {
+	case DOT, DOQ:
+		return "853"
+	case DNSCrypt:
+		return "443"
+	default:
+		return "53"
+	}
+}
+
+func parseHostPort(networkResolver *NetworkResolver, r string) error {
 	if host, port, err := net.SplitHostPort(r); err == nil {
 		networkResolver.Host = host
 		networkResolver.Port = port
 	} else {
-		networkResolver.Host = r
-		if networkResolver.Protocol == DOT {
-			networkResolver.Port = "853"
-		} else {
-			networkResolver.Port = "53"
+		networkResolver.Host = strings.TrimSuffix(strings.TrimPrefix(r, "["), "]")
+		networkResolver.Port = defaultPort(networkResolver.Protocol)
+	}
+	return validateHostPort(networkResolver.Host, networkResolver.Port)
+}
+
+// validateHostPort checks that host is an ip or a hostname and port a valid port number
+func validateHostPort(host, port string) error {
+	if host == "" {
+		return fmt.Errorf("%w: missing host", ErrInvalidResolver)
+	}
+	if net.ParseIP(host) == nil {
+		if _, ok := dns.IsDomainName(host); !ok || strings.ContainsAny(host, ":/ ") {
+			return fmt.Errorf("%w: invalid host %q", ErrInvalidResolver, host)
 		}
 	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%w: invalid port %q", ErrInvalidResolver, port)
+	}
+	return nil
+}
+
+// parseODoHResolver parses target|relay, the relay is required as it hides the client address from the target
+func parseODoHResolver(r string) (*DohResolver, error) {
+	target, relay, _ := strings.Cut(r, "|")
+	if err := validateDohURL(target); err != nil {
+		return nil, err
+	}
+	if relay == "" {
+		return nil, fmt.Errorf("%w: missing oblivious doh relay", ErrInvalidResolver)
+	}
+	if err := validateDohURL(relay); err != nil {
+		return nil, err
+	}
+	return &DohResolver{Protocol: ODOH, URL: target, Relay: relay}, nil
+}
+
+func validateDohURL(URL string) error {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidResolver, err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%w: invalid doh url %q", ErrInvalidResolver, URL)
+	}
+	return nil
 }
 
 func hasDohProtocol(resolver, protocol string) bool {
@@ -126,17 +269,21 @@ func hasDohProtocol(resolver, protocol string) bool {
 }
 
 func trimProtocol(resolver string) string {
-	return stringsutil.TrimPrefixAny(resolver, TCP.StringWithSemicolon(), UDP.StringWithSemicolon(), DOH.StringWithSemicolon(), DOT.StringWithSemicolon())
+	return stringsutil.TrimPrefixAny(resolver, TCP.StringWithSemicolon(), UDP.StringWithSemicolon(), DOH.StringWithSemicolon(), DOT.StringWithSemicolon(), DOQ.StringWithSemicolon())
 }
 
 func trimDohProtocol(resolver string) string {
 	return stringsutil.TrimSuffixAny(resolver, GET.StringWithSemicolon(), POST.StringWithSemicolon(), JsonAPI.StringWithSemicolon())
 }
 
-func parseResolvers(resolvers []string) []Resolver {
+func parseResolvers(resolvers []string) ([]Resolver, error) {
 	var parsedResolvers []Resolver
 	for _, resolver := range resolvers {
-		parsedResolvers = append(parsedResolvers, parseResolver(resolver))
+		parsedResolver, err := parseResolver(resolver)
+		if err != nil {
+			return nil, fmt.Errorf("%w (%s)", err, resolver)
+		}
+		parsedResolvers = append(parsedResolvers, parsedResolver)
 	}
-	return parsedResolvers
+	return parsedResolvers, nil
 }
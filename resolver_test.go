@@ -0,0 +1,76 @@
+package retryabledns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseResolver(t *testing.T, r string) Resolver {
+	t.Helper()
+	resolver, err := parseResolver(r)
+	require.NoError(t, err)
+	return resolver
+}
+
+func TestParseResolver(t *testing.T) {
+	tests := []struct {
+		resolver string
+		expected Resolver
+	}{
+		{"1.1.1.1", &NetworkResolver{Protocol: UDP, Host: "1.1.1.1", Port: "53"}},
+		{"1.1.1.1:5353", &NetworkResolver{Protocol: UDP, Host: "1.1.1.1", Port: "5353"}},
+		{"2606:4700:4700::1111", &NetworkResolver{Protocol: UDP, Host: "2606:4700:4700::1111", Port: "53"}},
+		{"[2606:4700:4700::1111]:53", &NetworkResolver{Protocol: UDP, Host: "2606:4700:4700::1111", Port: "53"}},
+		{"tcp:8.8.8.8", &NetworkResolver{Protocol: TCP, Host: "8.8.8.8", Port: "53"}},
+		{"doh:https://dns.google/dns-query:get", &DohResolver{Protocol: GET, URL: "https://dns.google/dns-query"}},
+		{"udp://8.8.8.8", &NetworkResolver{Protocol: UDP, Host: "8.8.8.8", Port: "53"}},
+		{"tcp://8.8.8.8:5353", &NetworkResolver{Protocol: TCP, Host: "8.8.8.8", Port: "5353"}},
+		{"tls://1.1.1.1#cloudflare-dns.com", &NetworkResolver{Protocol: DOT, Host: "1.1.1.1", Port: "853", ServerName: "cloudflare-dns.com"}},
+		{"tls://[2606:4700:4700::1111]:853", &NetworkResolver{Protocol: DOT, Host: "2606:4700:4700::1111", Port: "853"}},
+		{"quic://dns.adguard-dns.com", &NetworkResolver{Protocol: DOQ, Host: "dns.adguard-dns.com", Port: "853"}},
+		{"https://1.1.1.1/dns-query#cloudflare-dns.com", &DohResolver{Protocol: POST, URL: "https://1.1.1.1/dns-query", ServerName: "cloudflare-dns.com"}},
+		{"odoh:https://odoh.cloudflare-dns.com/dns-query|https://odoh-relay.example.com/proxy", &DohResolver{Protocol: ODOH, URL: "https://odoh.cloudflare-dns.com/dns-query", Relay: "https://odoh-relay.example.com/proxy"}},
+		// stamps
+		{"sdns://AAcAAAAAAAAABzguOC44Ljg", &NetworkResolver{Protocol: UDP, Host: "8.8.8.8", Port: "53"}},
+		{"sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5", &DohResolver{Protocol: POST, URL: "https://dns.cloudflare.com/dns-query", Addr: "1.0.0.1:443"}},
+		{"sdns://AwcAAAAAAAAABzEuMS4xLjEAEmNsb3VkZmxhcmUtZG5zLmNvbQ", &NetworkResolver{Protocol: DOT, Host: "1.1.1.1", Port: "853", ServerName: "cloudflare-dns.com"}},
+		{"sdns://BAcAAAAAAAAAAAATZG5zLmFkZ3VhcmQtZG5zLmNvbQ", &NetworkResolver{Protocol: DOQ, Host: "dns.adguard-dns.com", Port: "853"}},
+	}
+	for _, test := range tests {
+		t.Run(test.resolver, func(t *testing.T) {
+			require.Equal(t, test.expected, mustParseResolver(t, test.resolver))
+		})
+	}
+}
+
+func TestParseResolverErrors(t *testing.T) {
+	tests := []struct {
+		resolver string
+		err      error
+	}{
+		{"foo:1.2.3.4", ErrInvalidResolver},
+		{"1.1.1.1:99999", ErrInvalidResolver},
+		{"", ErrInvalidResolver},
+		{"ftp://1.1.1.1", ErrInvalidResolver},
+		{"tls://", ErrInvalidResolver},
+		{"udp://8.8.8.8/path", ErrInvalidResolver},
+		{"doh:dns.google/dns-query", ErrInvalidResolver},
+		{"odoh:https://odoh.cloudflare-dns.com/dns-query|relay", ErrInvalidResolver},
+		{"odoh:https://odoh.cloudflare-dns.com/dns-query", ErrInvalidResolver},
+		{"sdns://!!", ErrInvalidStamp},
+		{"sdns://AAcAAAAA", ErrInvalidStamp},
+		{"sdns://BwcAAAAAAAAA", ErrUnsupportedStamp},
+	}
+	for _, test := range tests {
+		t.Run(test.resolver, func(t *testing.T) {
+			_, err := parseResolver(test.resolver)
+			require.ErrorIs(t, err, test.err)
+
+			options := Options{BaseResolvers: []string{"1.1.1.1", test.resolver}, MaxRetries: 1}
+			err = options.Validate()
+			require.ErrorIs(t, err, test.err)
+			require.Contains(t, err.Error(), test.resolver)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package retryabledns
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ErrInvalidRetryPolicy is returned when the retry policy has negative delays or a jitter outside [0, 1]
+var ErrInvalidRetryPolicy = errors.New("retry policy delays must not be negative and jitter must be between 0 and 1")
+
+// RetryPolicy defines the backoff between attempts and the resolver retries are sent to.
+// The zero value retries immediately on the next resolver.
+type RetryPolicy struct {
+	// BaseDelay is the delay before the first retry
+	BaseDelay time.Duration
+	// Multiplier grows the delay after each retry, values below 1 keep it constant
+	Multiplier float64
+	// MaxDelay caps the delay, zero means no cap
+	MaxDelay time.Duration
+	// Jitter is the fraction of the delay that is randomized, between 0 and 1
+	Jitter float64
+	// SameResolver sends retries to the resolver of the first attempt instead of the next one
+	SameResolver bool
+}
+
+func (p RetryPolicy) validate() error {
+	if p.BaseDelay < 0 || p.MaxDelay < 0 || p.Multiplier < 0 || p.Jitter < 0 || p.Jitter > 1 {
+		return ErrInvalidRetryPolicy
+	}
+	return nil
+}
+
+// Delay returns the time to wait before the given retry, starting from 1
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	if p.BaseDelay <= 0 || retry < 1 {
+		return 0
+	}
+	delay := float64(p.BaseDelay)
+	if p.Multiplier > 1 {
+		delay *= math.Pow(p.Multiplier, float64(retry-1))
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	// without a cap the delay can overflow, even to +Inf, which converts to a negative duration
+	if delay >= math.MaxInt64 {
+		delay = math.MaxInt64
+	}
+	delay -= delay * p.Jitter * rand.Float64()
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(delay)
+}
+
+// waitRetry sleeps before the given retry, returning early if ctx is done
+func (c *Client) waitRetry(ctx context.Context, retry int) error {
+	delay := c.options.RetryPolicy.Delay(retry)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
@@ -0,0 +1,80 @@
+package retryabledns
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 10 * time.Millisecond, Multiplier: 2, MaxDelay: 50 * time.Millisecond}
+	require.Zero(t, policy.Delay(0))
+	require.Equal(t, 10*time.Millisecond, policy.Delay(1))
+	require.Equal(t, 20*time.Millisecond, policy.Delay(2))
+	require.Equal(t, 40*time.Millisecond, policy.Delay(3))
+	require.Equal(t, 50*time.Millisecond, policy.Delay(4))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(2)
+		require.GreaterOrEqual(t, delay, 10*time.Millisecond)
+		require.LessOrEqual(t, delay, 20*time.Millisecond)
+	}
+
+	// large retry counts saturate instead of overflowing to a negative delay
+	policy = RetryPolicy{BaseDelay: time.Second, Multiplier: 10}
+	require.Equal(t, time.Duration(math.MaxInt64), policy.Delay(100))
+	require.Equal(t, time.Duration(math.MaxInt64), policy.Delay(100000))
+	policy.Jitter = 0.5
+	require.Positive(t, policy.Delay(100000))
+
+	require.Zero(t, RetryPolicy{}.Delay(3))
+	require.ErrorIs(t, RetryPolicy{Jitter: 2}.validate(), ErrInvalidRetryPolicy)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var mu sync.Mutex
+	var attempts []string
+	RegisterTransport("flaky", func(client *Client, resolver Resolver) (Transport, error) {
+		return TransportFunc(func(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+			mu.Lock()
+			attempts = append(attempts, resolver.String())
+			mu.Unlock()
+			return nil, 0, errors.New("connection reset")
+		}), nil
+	})
+	defer RegisterTransport("flaky", nil)
+
+	client, err := NewWithOptions(Options{
+		BaseResolvers: []string{"flaky:a", "flaky:b"},
+		MaxRetries:    4,
+		RetryPolicy:   RetryPolicy{BaseDelay: 20 * time.Millisecond, Multiplier: 2, SameResolver: true},
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = client.A("example.com")
+	require.ErrorIs(t, err, ErrRetriesExceeded)
+	// 20ms + 40ms + 80ms
+	require.GreaterOrEqual(t, time.Since(start), 140*time.Millisecond)
+	require.Len(t, attempts, 4)
+	for _, attempt := range attempts {
+		require.Equal(t, attempts[0], attempt)
+	}
+
+	// the delay is interrupted by the context deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	start = time.Now()
+	_, err = client.DoContext(ctx, msg)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+}
@@ -0,0 +1,357 @@
+package retryabledns
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SelectionStrategy defines how the next resolver is picked among the healthy ones
+type SelectionStrategy string
+
+const (
+	// RoundRobin cycles through resolvers in order
+	RoundRobin SelectionStrategy = "round-robin"
+	// WeightedRandom picks resolvers randomly, weighted by their score
+	WeightedRandom SelectionStrategy = "weighted-random"
+	// LowestLatency picks the resolver with the lowest average rtt
+	LowestLatency SelectionStrategy = "lowest-latency"
+	// PowerOfTwoChoices picks two random resolvers and keeps the one with the higher score
+	PowerOfTwoChoices SelectionStrategy = "power-of-two-choices"
+)
+
+func (s SelectionStrategy) String() string {
+	return string(s)
+}
+
+var (
+	// ErrUnknownSelectionStrategy is returned when the selection strategy is not supported
+	ErrUnknownSelectionStrategy = errors.New("unknown resolver selection strategy")
+
+	// DefaultQuarantineDuration is the default time a failing resolver is kept out of rotation
+	DefaultQuarantineDuration = 30 * time.Second
+)
+
+const (
+	// rttAlpha is the weight of the latest sample in the rtt moving average
+	rttAlpha = 0.3
+	// defaultFailurePenalty is the rtt failed exchanges are accounted for without a
+	// client timeout, it matches the default timeout of dns clients
+	defaultFailurePenalty = 2 * time.Second
+	// minLatencySuccessRate is the success rate below which a resolver is skipped
+	// by LowestLatency as long as some other resolver does better
+	minLatencySuccessRate = 0.5
+)
+
+// ResolverStats is a snapshot of the health of a resolver
+type ResolverStats struct {
+	Resolver    string
+	Successes   uint64
+	Failures    uint64
+	Timeouts    uint64
+	RTT         time.Duration
+	Score       float64
+	Quarantined bool
+}
+
+type resolverState struct {
+	mu                  sync.Mutex
+	successes           uint64
+	failures            uint64
+	timeouts            uint64
+	consecutiveFailures int
+	rtt                 float64
+	quarantinedUntil    time.Time
+	// probedAt is when an unsampled resolver was last sent a probe by LowestLatency
+	probedAt time.Time
+}
+
+// successRate returns the laplace smoothed ratio of successful exchanges
+func (s *resolverState) successRate() float64 {
+	return float64(s.successes+1) / float64(s.successes+s.failures+2)
+}
+
+// score ranks resolvers by success rate and latency, the higher the better
+func (s *resolverState) score() float64 {
+	return s.successRate() / (1 + s.rtt/float64(time.Millisecond))
+}
+
+// resolverHealth tracks the outcome of each exchange and selects resolvers accordingly.
+// The states are created upfront and each one has its own lock, so that exchanges with
+// different resolvers don't contend.
+type resolverHealth struct {
+	strategy   SelectionStrategy
+	roundRobin bool
+	// recording is false when neither the strategy nor the quarantine use the outcomes
+	recording bool
+	// quarantined counts the resolvers with a quarantine set, so that plain
+	// round robin picks without locking while none is
+	quarantined         atomic.Int32
+	quarantineThreshold int
+	quarantineDuration  time.Duration
+	failurePenalty      time.Duration
+	states              map[string]*resolverState
+}
+
+func newResolverHealth(options Options, resolvers []Resolver) *resolverHealth {
+	h := &resolverHealth{
+		strategy:            options.SelectionStrategy,
+		roundRobin:          !slices.Contains([]SelectionStrategy{WeightedRandom, LowestLatency, PowerOfTwoChoices}, options.SelectionStrategy),
+		quarantineThreshold: options.QuarantineThreshold,
+		quarantineDuration:  options.QuarantineDuration,
+		failurePenalty:      options.Timeout,
+		states:              make(map[string]*resolverState, len(resolvers)),
+	}
+	h.recording = !h.roundRobin || h.quarantineThreshold > 0
+	if h.failurePenalty <= 0 {
+		h.failurePenalty = defaultFailurePenalty
+	}
+	for _, resolver := range resolvers {
+		h.states[healthKey(resolver)] = &resolverState{}
+	}
+	return h
+}
+
+// healthKey identifies the state of resolver by its whole configuration, so that e.g.
+// the udp and tcp resolvers of a host are tracked apart
+func healthKey(resolver Resolver) string {
+	return transportKey(resolverScheme(resolver), resolver)
+}
+
+// pick selects a resolver out of resolvers, index is a monotonic counter used for round robin.
+// Quarantined resolvers are skipped until their quarantine expires, then they are selected
+// once to probe them and stay out of rotation until the probe succeeds.
+func (h *resolverHealth) pick(resolvers []Resolver, index uint32) Resolver {
+	if h.roundRobin && h.quarantined.Load() == 0 {
+		return resolvers[index%uint32(len(resolvers))]
+	}
+
+	now := time.Now()
+	eligible := make([]Resolver, 0, len(resolvers))
+	for _, resolver := range resolvers {
+		state, ok := h.states[healthKey(resolver)]
+		if !ok {
+			eligible = append(eligible, resolver)
+			continue
+		}
+		state.mu.Lock()
+		switch {
+		case state.quarantinedUntil.IsZero():
+			state.mu.Unlock()
+			eligible = append(eligible, resolver)
+			continue
+		case now.Before(state.quarantinedUntil):
+			state.mu.Unlock()
+			continue
+		}
+		// re-arm the quarantine so that a single probe is sent even if it never completes
+		state.quarantinedUntil = now.Add(h.quarantineDuration)
+		state.mu.Unlock()
+		return resolver
+	}
+	// every resolver is quarantined, keep going with all of them
+	if len(eligible) == 0 {
+		eligible = resolvers
+	}
+
+	switch h.strategy {
+	case WeightedRandom:
+		return h.pickWeightedRandom(eligible)
+	case LowestLatency:
+		return h.pickLowestLatency(eligible, index)
+	case PowerOfTwoChoices:
+		return h.pickPowerOfTwo(eligible)
+	default:
+		return eligible[index%uint32(len(eligible))]
+	}
+}
+
+// isQuarantined returns true if resolver is quarantined, including when its quarantine
+// expired and the probe is still to be sent
+func (h *resolverHealth) isQuarantined(resolver Resolver) bool {
+	if h.quarantined.Load() == 0 {
+		return false
+	}
+	state, ok := h.states[healthKey(resolver)]
+	if !ok {
+		return false
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return !state.quarantinedUntil.IsZero()
+}
+
+func (h *resolverHealth) stateScore(resolver Resolver) float64 {
+	if state, ok := h.states[healthKey(resolver)]; ok {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		return state.score()
+	}
+	return (&resolverState{}).score()
+}
+
+func (h *resolverHealth) pickWeightedRandom(resolvers []Resolver) Resolver {
+	var total float64
+	scores := make([]float64, len(resolvers))
+	for i, resolver := range resolvers {
+		scores[i] = h.stateScore(resolver)
+		total += scores[i]
+	}
+	target := rand.Float64() * total
+	for i, score := range scores {
+		target -= score
+		if target <= 0 {
+			return resolvers[i]
+		}
+	}
+	return resolvers[len(resolvers)-1]
+}
+
+// pickLowestLatency picks the resolver with the lowest rtt among the ones with a decent
+// success rate, a resolver failing fast must not win on latency alone. The latency of
+// unsampled resolvers is unknown, each of them is sent a single probe first, again if
+// no outcome is recorded within the failure penalty.
+func (h *resolverHealth) pickLowestLatency(resolvers []Resolver, index uint32) Resolver {
+	var (
+		now         = time.Now()
+		best        Resolver
+		bestRTT     float64
+		bestHealthy bool
+	)
+	for _, resolver := range resolvers {
+		state, ok := h.states[healthKey(resolver)]
+		if !ok {
+			continue
+		}
+		state.mu.Lock()
+		if state.successes+state.failures == 0 {
+			probe := now.Sub(state.probedAt) >= h.failurePenalty
+			if probe {
+				state.probedAt = now
+			}
+			state.mu.Unlock()
+			if probe {
+				return resolver
+			}
+			continue
+		}
+		rtt, healthy := state.rtt, state.successRate() >= minLatencySuccessRate
+		state.mu.Unlock()
+		switch {
+		case best == nil, healthy && !bestHealthy, healthy == bestHealthy && rtt < bestRTT:
+			best, bestRTT, bestHealthy = resolver, rtt, healthy
+		}
+	}
+	// nothing sampled yet, spread the queries while the probes are pending
+	if best == nil {
+		return resolvers[index%uint32(len(resolvers))]
+	}
+	return best
+}
+
+func (h *resolverHealth) pickPowerOfTwo(resolvers []Resolver) Resolver {
+	if len(resolvers) == 1 {
+		return resolvers[0]
+	}
+	i := rand.Intn(len(resolvers))
+	j := rand.Intn(len(resolvers) - 1)
+	if j >= i {
+		j++
+	}
+	if h.stateScore(resolvers[j]) > h.stateScore(resolvers[i]) {
+		return resolvers[j]
+	}
+	return resolvers[i]
+}
+
+// record updates the health of resolver with the outcome of an exchange
+func (h *resolverHealth) record(resolver Resolver, rtt time.Duration, resp *dns.Msg, err error) {
+	if !h.recording {
+		return
+	}
+	state, ok := h.states[healthKey(resolver)]
+	if !ok {
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	failed := err != nil || resp == nil || resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused
+	if !failed {
+		state.successes++
+		state.consecutiveFailures = 0
+		if !state.quarantinedUntil.IsZero() {
+			state.quarantinedUntil = time.Time{}
+			h.quarantined.Add(-1)
+		}
+		state.updateRTT(rtt)
+		return
+	}
+
+	state.failures++
+	state.consecutiveFailures++
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			state.timeouts++
+		}
+		// failed exchanges are accounted as slow as the timeout to push the resolver down the ranking
+		rtt = max(rtt, h.failurePenalty)
+	}
+	state.updateRTT(rtt)
+	if h.quarantineThreshold > 0 && state.consecutiveFailures >= h.quarantineThreshold {
+		if state.quarantinedUntil.IsZero() {
+			h.quarantined.Add(1)
+		}
+		state.quarantinedUntil = time.Now().Add(h.quarantineDuration)
+	}
+}
+
+func (s *resolverState) updateRTT(rtt time.Duration) {
+	if s.rtt == 0 {
+		s.rtt = float64(rtt)
+		return
+	}
+	s.rtt = rttAlpha*float64(rtt) + (1-rttAlpha)*s.rtt
+}
+
+func (h *resolverHealth) stats(resolvers []Resolver) []ResolverStats {
+	now := time.Now()
+	stats := make([]ResolverStats, 0, len(resolvers))
+	for _, resolver := range resolvers {
+		state, ok := h.states[healthKey(resolver)]
+		if !ok {
+			continue
+		}
+		state.mu.Lock()
+		stats = append(stats, ResolverStats{
+			Resolver:    resolver.String(),
+			Successes:   state.successes,
+			Failures:    state.failures,
+			Timeouts:    state.timeouts,
+			RTT:         time.Duration(state.rtt),
+			Score:       state.score(),
+			Quarantined: now.Before(state.quarantinedUntil),
+		})
+		state.mu.Unlock()
+	}
+	return stats
+}
+
+// nextResolver returns the resolver to use for the next attempt
+func (c *Client) nextResolver() Resolver {
+	index := atomic.AddUint32(&c.serversIndex, 1)
+	return c.health.pick(c.resolvers, index)
+}
+
+// ResolverStats returns the health statistics of the client resolvers, they are only
+// recorded with a selection strategy other than round robin or a quarantine threshold
+func (c *Client) ResolverStats() []ResolverStats {
+	return c.health.stats(c.resolvers)
+}
@@ -0,0 +1,200 @@
+package retryabledns
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// registerFakeTransport registers a transport for scheme that answers after the delay
+// encoded in the resolver address, or fails if the address is "fail"
+func registerFakeTransport(t *testing.T, scheme string, hits map[string]int, mu *sync.Mutex) {
+	t.Helper()
+	RegisterTransport(scheme, func(client *Client, resolver Resolver) (Transport, error) {
+		return TransportFunc(func(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+			mu.Lock()
+			hits[resolver.String()]++
+			mu.Unlock()
+			if resolver.String() == "fail" {
+				return nil, time.Millisecond, errors.New("connection refused")
+			}
+			delay, err := time.ParseDuration(resolver.String())
+			if err != nil {
+				return nil, 0, err
+			}
+			resp := new(dns.Msg)
+			resp.SetReply(msg)
+			rr, _ := dns.NewRR(msg.Question[0].Name + " 60 IN A 127.0.0.7")
+			resp.Answer = append(resp.Answer, rr)
+			return resp, delay, nil
+		}), nil
+	})
+	t.Cleanup(func() { RegisterTransport(scheme, nil) })
+}
+
+func TestResolverQuarantine(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	registerFakeTransport(t, "health", hits, &mu)
+
+	client, err := NewWithOptions(Options{
+		BaseResolvers:       []string{"health:fail", "health:1ms"},
+		MaxRetries:          2,
+		Timeout:             time.Second,
+		QuarantineThreshold: 2,
+		QuarantineDuration:  100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, err := client.A("example.com")
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, hits["fail"])
+
+	stats := client.ResolverStats()
+	require.Len(t, stats, 2)
+	require.Equal(t, "fail", stats[0].Resolver)
+	require.True(t, stats[0].Quarantined)
+	require.EqualValues(t, 2, stats[0].Failures)
+	require.Less(t, stats[0].Score, stats[1].Score)
+
+	for i := 0; i < 10; i++ {
+		_, err := client.A("example.com")
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, hits["fail"])
+
+	// once the quarantine expires a single probe is sent
+	time.Sleep(150 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		_, err := client.A("example.com")
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, hits["fail"])
+}
+
+func TestRoundRobinFastPath(t *testing.T) {
+	resolvers := []Resolver{&NetworkResolver{Protocol: UDP, Host: "127.0.0.1", Port: "53"}, &NetworkResolver{Protocol: UDP, Host: "127.0.0.2", Port: "53"}}
+	h := newResolverHealth(Options{QuarantineThreshold: 1, QuarantineDuration: time.Hour}, resolvers)
+	// plain round robin doesn't lock nor allocate while no resolver is quarantined
+	require.Zero(t, testing.AllocsPerRun(100, func() { h.pick(resolvers, 1) }))
+	require.Equal(t, resolvers[1], h.pick(resolvers, 1))
+
+	h.record(resolvers[1], time.Millisecond, nil, errors.New("connection refused"))
+	require.Equal(t, int32(1), h.quarantined.Load())
+	require.Equal(t, resolvers[0], h.pick(resolvers, 1))
+
+	resp := new(dns.Msg)
+	h.record(resolvers[1], time.Millisecond, resp, nil)
+	require.Zero(t, h.quarantined.Load())
+	require.Equal(t, resolvers[1], h.pick(resolvers, 1))
+}
+
+func TestSelectionStrategies(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	registerFakeTransport(t, "strategy", hits, &mu)
+
+	for _, strategy := range []SelectionStrategy{LowestLatency, WeightedRandom, PowerOfTwoChoices} {
+		t.Run(strategy.String(), func(t *testing.T) {
+			clear(hits)
+			client, err := NewWithOptions(Options{
+				BaseResolvers:     []string{"strategy:200ms", "strategy:1ms", "strategy:100ms"},
+				MaxRetries:        1,
+				SelectionStrategy: strategy,
+			})
+			require.NoError(t, err)
+			for i := 0; i < 200; i++ {
+				_, err := client.A("example.com")
+				require.NoError(t, err)
+			}
+			require.Greater(t, hits["1ms"], hits["100ms"])
+			require.Greater(t, hits["1ms"], hits["200ms"])
+		})
+	}
+
+	options := Options{BaseResolvers: []string{"1.1.1.1"}, MaxRetries: 1, SelectionStrategy: "random"}
+	require.ErrorIs(t, options.Validate(), ErrUnknownSelectionStrategy)
+}
+
+func TestLowestLatencySkipsFailingResolvers(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	registerFakeTransport(t, "latency", hits, &mu)
+
+	// without a timeout failures are still accounted as slow
+	client, err := NewWithOptions(Options{
+		BaseResolvers:     []string{"latency:fail", "latency:5ms"},
+		MaxRetries:        1,
+		SelectionStrategy: LowestLatency,
+	})
+	require.NoError(t, err)
+	var failed int
+	for i := 0; i < 20; i++ {
+		if _, err := client.A("example.com"); err != nil {
+			failed++
+		}
+	}
+	require.Equal(t, 1, failed)
+	require.Equal(t, 1, hits["fail"])
+
+	// a resolver failing instantly doesn't win on rtt alone
+	resolvers := []Resolver{&NetworkResolver{Protocol: UDP, Host: "127.0.0.1", Port: "53"}, &NetworkResolver{Protocol: UDP, Host: "127.0.0.2", Port: "53"}}
+	h := newResolverHealth(Options{SelectionStrategy: LowestLatency}, resolvers)
+	require.Equal(t, defaultFailurePenalty, h.failurePenalty)
+	h.failurePenalty = time.Microsecond
+	for i := 0; i < 5; i++ {
+		h.record(resolvers[0], time.Microsecond, nil, errors.New("connection refused"))
+		h.record(resolvers[1], time.Millisecond, new(dns.Msg), nil)
+	}
+	require.Equal(t, resolvers[1], h.pick(resolvers, 0))
+}
+
+func TestResolverHealthRecording(t *testing.T) {
+	resolvers := []Resolver{&NetworkResolver{Protocol: UDP, Host: "127.0.0.1", Port: "53"}}
+	// plain round robin without quarantine doesn't use the outcomes
+	h := newResolverHealth(Options{}, resolvers)
+	h.record(resolvers[0], time.Millisecond, new(dns.Msg), nil)
+	require.Zero(t, h.stats(resolvers)[0].Successes)
+
+	h = newResolverHealth(Options{SelectionStrategy: WeightedRandom}, resolvers)
+	h.record(resolvers[0], time.Millisecond, new(dns.Msg), nil)
+	require.EqualValues(t, 1, h.stats(resolvers)[0].Successes)
+}
+
+func TestResolverHealthPerProtocol(t *testing.T) {
+	resolvers := []Resolver{&NetworkResolver{Protocol: UDP, Host: "127.0.0.1", Port: "53"}, &NetworkResolver{Protocol: TCP, Host: "127.0.0.1", Port: "53"}}
+	h := newResolverHealth(Options{QuarantineThreshold: 1, QuarantineDuration: time.Hour}, resolvers)
+	h.record(resolvers[0], time.Millisecond, nil, errors.New("connection refused"))
+
+	stats := h.stats(resolvers)
+	require.True(t, stats[0].Quarantined)
+	require.EqualValues(t, 1, stats[0].Failures)
+	require.False(t, stats[1].Quarantined)
+	require.Zero(t, stats[1].Failures)
+	require.Equal(t, resolvers[1], h.pick(resolvers, 0))
+}
+
+func TestLowestLatencyProbesUnsampledResolvers(t *testing.T) {
+	resolvers := []Resolver{
+		&NetworkResolver{Protocol: UDP, Host: "127.0.0.1", Port: "53"},
+		&NetworkResolver{Protocol: UDP, Host: "127.0.0.2", Port: "53"},
+		&NetworkResolver{Protocol: UDP, Host: "127.0.0.3", Port: "53"},
+	}
+	h := newResolverHealth(Options{SelectionStrategy: LowestLatency}, resolvers)
+	// each unsampled resolver is probed once instead of the first one taking every query
+	var picked []Resolver
+	for i := 0; i < len(resolvers); i++ {
+		picked = append(picked, h.pick(resolvers, uint32(i)))
+	}
+	require.ElementsMatch(t, resolvers, picked)
+
+	h.record(resolvers[2], time.Millisecond, new(dns.Msg), nil)
+	require.Equal(t, resolvers[2], h.pick(resolvers, 0))
+}
@@ -0,0 +1,85 @@
+package retryabledns
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/projectdiscovery/retryabledns/internal/inflight"
+)
+
+// queryGroup merges concurrent identical queries into a single exchange
+type queryGroup struct {
+	queries inflight.Group[*DNSData]
+}
+
+func newQueryGroup() *queryGroup {
+	return &queryGroup{}
+}
+
+func queryGroupKey(host string, requestTypes []uint16) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(host))
+	for _, requestType := range requestTypes {
+		sb.WriteByte('|')
+		sb.WriteString(strconv.Itoa(int(requestType)))
+	}
+	return sb.String()
+}
+
+// do runs fn once for all the concurrent callers with the same key and returns each
+// of them a copy of the result. The shared query is detached from the callers
+// contexts and is only cancelled once every caller has given up waiting on it.
+func (g *queryGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (*DNSData, error)) (*DNSData, error) {
+	data, err := g.queries.Do(ctx, key, fn)
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return nil, contextError(ctx)
+	}
+	return data.clone(), err
+}
+
+// clone returns a deep copy of the dns data
+func (d *DNSData) clone() *DNSData {
+	if d == nil {
+		return nil
+	}
+	c := *d
+	c.Resolver = slices.Clone(d.Resolver)
+	c.A = slices.Clone(d.A)
+	c.AAAA = slices.Clone(d.AAAA)
+	c.CNAME = slices.Clone(d.CNAME)
+	c.MX = slices.Clone(d.MX)
+	c.PTR = slices.Clone(d.PTR)
+	c.SOA = slices.Clone(d.SOA)
+	c.NS = slices.Clone(d.NS)
+	c.TXT = slices.Clone(d.TXT)
+	c.SRV = slices.Clone(d.SRV)
+	c.CAA = slices.Clone(d.CAA)
+	c.MXRecords = slices.Clone(d.MXRecords)
+	c.SRVRecords = slices.Clone(d.SRVRecords)
+	c.CAARecords = slices.Clone(d.CAARecords)
+	c.HTTPS = cloneSVCB(d.HTTPS)
+	c.SVCB = cloneSVCB(d.SVCB)
+	c.TLSA = slices.Clone(d.TLSA)
+	c.SSHFP = slices.Clone(d.SSHFP)
+	c.DS = slices.Clone(d.DS)
+	c.DNSKEY = slices.Clone(d.DNSKEY)
+	c.NAPTR = slices.Clone(d.NAPTR)
+	c.URI = slices.Clone(d.URI)
+	c.LOC = slices.Clone(d.LOC)
+	c.HINFO = slices.Clone(d.HINFO)
+	c.Records = slices.Clone(d.Records)
+	if d.Flags != nil {
+		flags := *d.Flags
+		c.Flags = &flags
+	}
+	c.AllRecords = slices.Clone(d.AllRecords)
+	c.InternalIPs = slices.Clone(d.InternalIPs)
+	c.Attempts = slices.Clone(d.Attempts)
+	if d.RawResp != nil {
+		c.RawResp = d.RawResp.Copy()
+	}
+	return &c
+}
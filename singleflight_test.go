@@ -0,0 +1,81 @@
+package retryabledns
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalesceQueries(t *testing.T) {
+	var queries atomic.Int32
+	release := make(chan struct{})
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		<-release
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 127.0.0.6")
+		m.Answer = append(m.Answer, rr)
+		_ = w.WriteMsg(m)
+	})
+	client, err := NewWithOptions(Options{BaseResolvers: []string{addr}, MaxRetries: 1, Timeout: 5 * time.Second, CoalesceQueries: true})
+	require.NoError(t, err)
+
+	// a caller giving up must not affect the others
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := client.QueryContext(ctx, "example.com", dns.TypeA)
+		cancelled <- err
+	}()
+
+	var wg sync.WaitGroup
+	results := make([]*DNSData, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d, err := client.A("example.com")
+			assert.NoError(t, err)
+			results[i] = d
+		}(i)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-cancelled, context.Canceled)
+	close(release)
+	wg.Wait()
+
+	require.EqualValues(t, 1, queries.Load())
+	for _, d := range results {
+		require.Equal(t, []string{"127.0.0.6"}, d.A)
+	}
+	results[0].A[0] = "modified"
+	require.Equal(t, "127.0.0.6", results[1].A[0])
+}
+
+func TestCoalesceQueriesAllCallersCancelled(t *testing.T) {
+	group := newQueryGroup()
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := group.do(ctx, "key", func(ctx context.Context) (*DNSData, error) {
+		close(started)
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, <-stopped, context.Canceled)
+}
@@ -0,0 +1,236 @@
+package retryabledns
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	// ErrInvalidStamp is returned when a sdns:// stamp can't be decoded
+	ErrInvalidStamp = errors.New("invalid dns stamp")
+	// ErrUnsupportedStamp is returned for stamps of protocols without a transport
+	ErrUnsupportedStamp = errors.New("unsupported dns stamp protocol")
+)
+
+const stampScheme = "sdns://"
+
+// stampProtocol is the first byte of a stamp, see https://dnscrypt.info/stamps-specifications
+type stampProtocol byte
+
+const (
+	stampPlain         stampProtocol = 0x00
+	stampDNSCrypt      stampProtocol = 0x01
+	stampDOH           stampProtocol = 0x02
+	stampDOT           stampProtocol = 0x03
+	stampDOQ           stampProtocol = 0x04
+	stampODOHTarget    stampProtocol = 0x05
+	stampDNSCryptRelay stampProtocol = 0x81
+	stampODOHRelay     stampProtocol = 0x85
+)
+
+// stampPropertiesSize is the size of the little endian properties of a stamp
+const stampPropertiesSize = 8
+
+// stamp is a decoded sdns:// stamp
+type stamp struct {
+	protocol     stampProtocol
+	props        uint64
+	addr         string
+	hashes       [][]byte
+	hostname     string
+	path         string
+	publicKey    []byte
+	providerName string
+}
+
+// stampReader reads the length prefixed fields of a stamp
+type stampReader struct {
+	data []byte
+	err  error
+}
+
+func (r *stampReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: %s", ErrInvalidStamp, fmt.Sprintf(format, args...))
+	}
+}
+
+func (r *stampReader) props() uint64 {
+	if len(r.data) < stampPropertiesSize {
+		r.fail("truncated properties")
+		return 0
+	}
+	props := binary.LittleEndian.Uint64(r.data)
+	r.data = r.data[stampPropertiesSize:]
+	return props
+}
+
+// bytes reads a field prefixed by its length
+func (r *stampReader) bytes() []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < 1 || len(r.data) < 1+int(r.data[0]) {
+		r.fail("truncated field")
+		return nil
+	}
+	n := int(r.data[0])
+	field := r.data[1 : 1+n]
+	r.data = r.data[1+n:]
+	return field
+}
+
+func (r *stampReader) string() string {
+	return string(r.bytes())
+}
+
+// set reads a set of fields whose lengths have the high bit set while more follow
+func (r *stampReader) set() [][]byte {
+	var fields [][]byte
+	for r.err == nil {
+		if len(r.data) < 1 {
+			r.fail("truncated set")
+			return nil
+		}
+		more := r.data[0]&0x80 != 0
+		n := int(r.data[0] & 0x7f)
+		if len(r.data) < 1+n {
+			r.fail("truncated set")
+			return nil
+		}
+		if n > 0 {
+			fields = append(fields, r.data[1:1+n])
+		}
+		r.data = r.data[1+n:]
+		if !more {
+			break
+		}
+	}
+	return fields
+}
+
+// decodeStamp decodes a sdns:// stamp
+func decodeStamp(s string) (*stamp, error) {
+	encoded := strings.TrimRight(strings.TrimPrefix(s, stampScheme), "=")
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidStamp, err)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: empty stamp", ErrInvalidStamp)
+	}
+
+	st := &stamp{protocol: stampProtocol(data[0])}
+	r := &stampReader{data: data[1:]}
+	switch st.protocol {
+	case stampPlain:
+		st.props = r.props()
+		st.addr = r.string()
+	case stampDNSCrypt:
+		st.props = r.props()
+		st.addr = r.string()
+		st.publicKey = r.bytes()
+		st.providerName = r.string()
+	case stampDOH, stampODOHRelay:
+		st.props = r.props()
+		st.addr = r.string()
+		st.hashes = r.set()
+		st.hostname = r.string()
+		st.path = r.string()
+	case stampDOT, stampDOQ:
+		st.props = r.props()
+		st.addr = r.string()
+		st.hashes = r.set()
+		st.hostname = r.string()
+	case stampODOHTarget:
+		st.props = r.props()
+		st.hostname = r.string()
+		st.path = r.string()
+	case stampDNSCryptRelay:
+		st.addr = r.string()
+	default:
+		return nil, fmt.Errorf("%w: 0x%02x", ErrUnsupportedStamp, byte(st.protocol))
+	}
+	// the optional bootstrap resolvers that may follow are ignored
+	if r.err != nil {
+		return nil, r.err
+	}
+	return st, nil
+}
+
+// parseStamp returns the resolver described by a sdns:// stamp
+func parseStamp(s string) (Resolver, error) {
+	st, err := decodeStamp(s)
+	if err != nil {
+		return nil, err
+	}
+	switch st.protocol {
+	case stampPlain:
+		return st.networkResolver(UDP, "")
+	case stampDNSCrypt:
+		return newDNSCryptResolver(st.addr, st.providerName, st.publicKey)
+	case stampDOT:
+		return st.networkResolver(DOT, st.hostname)
+	case stampDOQ:
+		return st.networkResolver(DOQ, st.hostname)
+	case stampDOH:
+		if st.hostname == "" {
+			return nil, fmt.Errorf("%w: missing hostname", ErrInvalidStamp)
+		}
+		// the address is dialed while the URL keeps the hostname for the sni and host header
+		addr, err := st.dohAddress()
+		if err != nil {
+			return nil, err
+		}
+		return &DohResolver{Protocol: POST, URL: "https://" + st.hostname + st.path, Addr: addr, CertificateHashes: st.hashes}, nil
+	default:
+		return nil, fmt.Errorf("%w: 0x%02x", ErrUnsupportedStamp, byte(st.protocol))
+	}
+}
+
+// networkResolver returns a resolver reaching the stamp address, or the hostname if
+// the address is empty or only carries a port
+func (st *stamp) networkResolver(protocol Protocol, serverName string) (*NetworkResolver, error) {
+	addr := st.addr
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort(st.hostname, port)
+	} else if addr == "" {
+		addr = st.hostname
+	}
+	resolver := &NetworkResolver{Protocol: protocol, ServerName: serverName, CertificateHashes: st.hashes}
+	if err := parseHostPort(resolver, addr); err != nil {
+		return nil, err
+	}
+	// the server name is only needed when it differs from the dialed host
+	if resolver.ServerName == resolver.Host {
+		resolver.ServerName = ""
+	}
+	return resolver, nil
+}
+
+// dohAddress returns the address dialed to reach a doh stamp, empty to resolve the
+// hostname. The default port is 443.
+func (st *stamp) dohAddress() (string, error) {
+	if st.addr == "" {
+		return "", nil
+	}
+	host, port, err := net.SplitHostPort(st.addr)
+	if err != nil {
+		host, port = strings.Trim(st.addr, "[]"), "443"
+	}
+	if host == "" {
+		hostname, _, err := net.SplitHostPort(st.hostname)
+		if err != nil {
+			hostname = st.hostname
+		}
+		host = hostname
+	}
+	if err := validateHostPort(host, port); err != nil {
+		return "", fmt.Errorf("%w: invalid address %q", ErrInvalidStamp, st.addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
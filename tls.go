@@ -0,0 +1,138 @@
+package retryabledns
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidSPKIPin is returned when a pin is not a base64 encoded sha256 digest
+	ErrInvalidSPKIPin = errors.New("spki pin must be a base64 encoded sha256 digest")
+	// ErrSPKIPinMismatch is returned when no certificate presented by a resolver matches the pins
+	ErrSPKIPinMismatch = errors.New("no certificate matches the spki pins")
+	// ErrCertificateHashMismatch is returned when no certificate of the chain matches the hashes of a dns stamp
+	ErrCertificateHashMismatch = errors.New("no certificate matches the stamp hashes")
+)
+
+// TLSOptions configures the tls connections to dot, doh and doq resolvers
+type TLSOptions struct {
+	// InsecureSkipVerify disables the verification of the certificate chain and
+	// name, SPKI pins are still enforced
+	InsecureSkipVerify bool
+	// ServerName is sent as SNI and verified against the certificate instead of
+	// the resolver host, the "#name" suffix of a resolver takes precedence
+	ServerName string
+	// SPKIPins are the base64 encoded sha256 digests of the accepted public keys
+	// (RFC 7858 section 4.2), any certificate of the chain may match
+	SPKIPins []string
+	// RootCAs verifies the certificates of the resolvers, the system pool if nil
+	RootCAs *x509.CertPool
+	// Certificates are presented to resolvers requesting client authentication
+	Certificates []tls.Certificate
+}
+
+// SPKIHash returns the pin of cert, the base64 encoded sha256 digest of its subject public key info
+func SPKIHash(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func (o TLSOptions) validate() error {
+	for _, pin := range o.SPKIPins {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("%w: %s", ErrInvalidSPKIPin, pin)
+		}
+	}
+	return nil
+}
+
+// config returns the tls config of a connection to a resolver with the given server name,
+// if empty the one of the options is used and otherwise the host being dialed
+func (o TLSOptions) config(serverName string) *tls.Config {
+	if serverName == "" {
+		serverName = o.ServerName
+	}
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+		RootCAs:            o.RootCAs,
+		Certificates:       o.Certificates,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if len(o.SPKIPins) > 0 {
+		pins := make(map[string]struct{}, len(o.SPKIPins))
+		for _, pin := range o.SPKIPins {
+			pins[pin] = struct{}{}
+		}
+		// VerifyConnection also runs when the chain verification is skipped
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				if _, ok := pins[SPKIHash(cert)]; ok {
+					return nil
+				}
+			}
+			return ErrSPKIPinMismatch
+		}
+	}
+	return config
+}
+
+// tlsOptions returns the tls options of resolver
+func (c *Client) tlsOptions(resolver Resolver) (TLSOptions, bool) {
+	if options, ok := c.options.ResolverTLS[resolver.String()]; ok {
+		return options, true
+	}
+	return c.options.TLS, false
+}
+
+// tlsConfig returns the tls config used to reach resolver
+func (c *Client) tlsConfig(resolver Resolver) *tls.Config {
+	options, _ := c.tlsOptions(resolver)
+	var (
+		serverName string
+		hashes     [][]byte
+	)
+	switch r := resolver.(type) {
+	case *NetworkResolver:
+		serverName, hashes = r.ServerName, r.CertificateHashes
+	case *DohResolver:
+		serverName, hashes = r.ServerName, r.CertificateHashes
+	}
+	config := options.config(serverName)
+	if len(hashes) > 0 {
+		verifyCertificateHashes(config, hashes)
+	}
+	return config
+}
+
+// verifyCertificateHashes requires a certificate of the chain to match one of the hashes,
+// the sha256 digests of the tbs certificates of dns stamps. The spki pins are still enforced.
+func verifyCertificateHashes(config *tls.Config, hashes [][]byte) {
+	verifyPins := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if verifyPins != nil {
+			if err := verifyPins(state); err != nil {
+				return err
+			}
+		}
+		certs := state.PeerCertificates
+		for _, chain := range state.VerifiedChains {
+			certs = append(certs[:len(certs):len(certs)], chain...)
+		}
+		for _, cert := range certs {
+			digest := sha256.Sum256(cert.RawTBSCertificate)
+			for _, hash := range hashes {
+				if bytes.Equal(digest[:], hash) {
+					return nil
+				}
+			}
+		}
+		return ErrCertificateHashMismatch
+	}
+}
@@ -0,0 +1,245 @@
+package retryabledns
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// runDOTServer starts a local DoT server answering every A query with 127.0.0.7
+func runDOTServer(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          listener,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 127.0.0.7")
+			m.Answer = append(m.Answer, rr)
+			_ = w.WriteMsg(m)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return listener.Addr().String()
+}
+
+func TestParseServerName(t *testing.T) {
+	require.Equal(t, &NetworkResolver{Protocol: DOT, Host: "1.1.1.1", Port: "853", ServerName: "cloudflare-dns.com"}, mustParseResolver(t, "dot:1.1.1.1#cloudflare-dns.com"))
+	require.Equal(t, &NetworkResolver{Protocol: DOQ, Host: "94.140.14.14", Port: "8853", ServerName: "dns.adguard-dns.com"}, mustParseResolver(t, "doq:94.140.14.14:8853#dns.adguard-dns.com"))
+	require.Equal(t, &DohResolver{Protocol: GET, URL: "https://1.1.1.1/dns-query", ServerName: "cloudflare-dns.com"}, mustParseResolver(t, "doh:https://1.1.1.1/dns-query:get#cloudflare-dns.com"))
+	require.Equal(t, &NetworkResolver{Protocol: DOT, Host: "1.1.1.1", Port: "853"}, mustParseResolver(t, "dot:1.1.1.1"))
+}
+
+func TestDOTVerification(t *testing.T) {
+	cert, pool := generateTestCertificate(t)
+	addr := runDOTServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	_, port, _ := net.SplitHostPort(addr)
+
+	resolve := func(resolver string, tlsOptions TLSOptions) error {
+		t.Helper()
+		client, err := NewWithOptions(Options{BaseResolvers: []string{resolver}, MaxRetries: 1, Timeout: 2 * time.Second, TLS: tlsOptions})
+		require.NoError(t, err)
+		defer client.Close()
+		data, err := client.A("example.com")
+		if err == nil {
+			require.Equal(t, []string{"127.0.0.7"}, data.A)
+		}
+		return err
+	}
+
+	// certificates are verified by default
+	err := resolve("dot:"+addr, TLSOptions{})
+	var resolveErr *ResolveError
+	require.ErrorAs(t, err, &resolveErr)
+	require.Equal(t, CategoryTLS, resolveErr.Attempts[0].Category)
+	require.NoError(t, resolve("dot:"+addr, TLSOptions{InsecureSkipVerify: true}))
+	require.NoError(t, resolve("dot:"+addr, TLSOptions{RootCAs: pool}))
+
+	// the server name is verified in place of the dialed address
+	require.NoError(t, resolve("dot:127.0.0.1:"+port+"#localhost", TLSOptions{RootCAs: pool}))
+	require.Error(t, resolve("dot:127.0.0.1:"+port+"#dns.example.com", TLSOptions{RootCAs: pool}))
+	require.Error(t, resolve("dot:"+addr, TLSOptions{RootCAs: pool, ServerName: "dns.example.com"}))
+
+	// pins are enforced even without verification
+	pin := SPKIHash(cert.Leaf)
+	otherCert, _ := generateTestCertificate(t)
+	require.NoError(t, resolve("dot:"+addr, TLSOptions{InsecureSkipVerify: true, SPKIPins: []string{pin}}))
+	err = resolve("dot:"+addr, TLSOptions{InsecureSkipVerify: true, SPKIPins: []string{SPKIHash(otherCert.Leaf)}})
+	require.ErrorIs(t, err, ErrSPKIPinMismatch)
+	require.ErrorAs(t, err, &resolveErr)
+	require.Equal(t, CategoryTLS, resolveErr.Attempts[0].Category)
+
+	_, err = NewWithOptions(Options{BaseResolvers: []string{"dot:" + addr}, MaxRetries: 1, TLS: TLSOptions{SPKIPins: []string{"not a pin"}}})
+	require.ErrorIs(t, err, ErrInvalidSPKIPin)
+}
+
+func TestDOTClientCertificate(t *testing.T) {
+	cert, pool := generateTestCertificate(t)
+	addr := runDOTServer(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+
+	client, err := NewWithOptions(Options{
+		BaseResolvers: []string{"dot:" + addr},
+		MaxRetries:    1,
+		Timeout:       2 * time.Second,
+		TLS:           TLSOptions{RootCAs: pool},
+	})
+	require.NoError(t, err)
+	_, err = client.A("example.com")
+	require.Error(t, err)
+
+	// per resolver settings override the defaults
+	client, err = NewWithOptions(Options{
+		BaseResolvers: []string{"dot:" + addr},
+		MaxRetries:    1,
+		Timeout:       2 * time.Second,
+		ResolverTLS:   map[string]TLSOptions{addr: {RootCAs: pool, Certificates: []tls.Certificate{cert}}},
+	})
+	require.NoError(t, err)
+	data, err := client.A("example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.7"}, data.A)
+}
+
+func TestDOHVerification(t *testing.T) {
+	cert, pool := generateTestCertificate(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.8")
+		resp.Answer = append(resp.Answer, rr)
+		packed, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(packed)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+
+	resolve := func(resolver string, options Options) error {
+		t.Helper()
+		options.BaseResolvers = []string{resolver}
+		options.MaxRetries = 1
+		options.Timeout = 2 * time.Second
+		client, err := NewWithOptions(options)
+		require.NoError(t, err)
+		defer client.Close()
+		data, err := client.A("example.com")
+		if err == nil {
+			require.Equal(t, []string{"127.0.0.8"}, data.A)
+		}
+		return err
+	}
+
+	resolver := "doh:" + server.URL + "/dns-query"
+	err := resolve(resolver, Options{})
+	var certErr *tls.CertificateVerificationError
+	require.ErrorAs(t, err, &certErr)
+	require.NoError(t, resolve(resolver, Options{TLS: TLSOptions{InsecureSkipVerify: true}}))
+	require.NoError(t, resolve(resolver, Options{TLS: TLSOptions{RootCAs: pool}}))
+	require.NoError(t, resolve(resolver, Options{ResolverTLS: map[string]TLSOptions{server.URL + "/dns-query": {RootCAs: pool}}}))
+
+	// the server name overrides the host of the url
+	require.NoError(t, resolve(resolver+"#localhost", Options{TLS: TLSOptions{RootCAs: pool}}))
+	var hostnameErr x509.HostnameError
+	require.ErrorAs(t, resolve(resolver+"#dns.example.com", Options{TLS: TLSOptions{RootCAs: pool}}), &hostnameErr)
+
+	err = resolve(resolver, Options{TLS: TLSOptions{RootCAs: pool, SPKIPins: []string{SPKIHash(server.Certificate())}}})
+	require.NoError(t, err)
+	otherCert, _ := generateTestCertificate(t)
+	err = resolve(resolver, Options{TLS: TLSOptions{RootCAs: pool, SPKIPins: []string{SPKIHash(otherCert.Leaf)}}})
+	require.ErrorIs(t, err, ErrSPKIPinMismatch)
+}
+
+// testStamp encodes a dot or doh stamp with a single certificate hash
+func testStamp(protocol stampProtocol, addr string, hash []byte, hostname, path string) string {
+	data := []byte{byte(protocol), 0, 0, 0, 0, 0, 0, 0, 0}
+	data = append(append(data, byte(len(addr))), addr...)
+	data = append(append(data, byte(len(hash))), hash...)
+	data = append(append(data, byte(len(hostname))), hostname...)
+	if protocol == stampDOH {
+		data = append(append(data, byte(len(path))), path...)
+	}
+	return stampScheme + base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestStampVerification(t *testing.T) {
+	cert, pool := generateTestCertificate(t)
+	otherCert, _ := generateTestCertificate(t)
+	hash := sha256.Sum256(cert.Leaf.RawTBSCertificate)
+	otherHash := sha256.Sum256(otherCert.Leaf.RawTBSCertificate)
+
+	resolve := func(resolver string) ([]string, error) {
+		t.Helper()
+		client, err := NewWithOptions(Options{BaseResolvers: []string{resolver}, MaxRetries: 1, Timeout: 2 * time.Second, TLS: TLSOptions{RootCAs: pool}})
+		require.NoError(t, err)
+		defer client.Close()
+		data, err := client.A("example.com")
+		if err != nil {
+			return nil, err
+		}
+		return data.A, nil
+	}
+
+	dotAddr := runDOTServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	a, err := resolve(testStamp(stampDOT, dotAddr, hash[:], "localhost", ""))
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.7"}, a)
+	_, err = resolve(testStamp(stampDOT, dotAddr, otherHash[:], "localhost", ""))
+	require.ErrorIs(t, err, ErrCertificateHashMismatch)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.8")
+		resp.Answer = append(resp.Answer, rr)
+		packed, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(packed)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+
+	// the stamp address is dialed in place of the hostname, on the default port
+	dohAddr := server.Listener.Addr().String()
+	a, err = resolve(testStamp(stampDOH, dohAddr, hash[:], "localhost", "/dns-query"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.8"}, a)
+	_, err = resolve(testStamp(stampDOH, dohAddr, otherHash[:], "localhost", "/dns-query"))
+	require.ErrorIs(t, err, ErrCertificateHashMismatch)
+
+	_, err = parseResolver(testStamp(stampDOH, "not an address", hash[:], "localhost", "/dns-query"))
+	require.ErrorIs(t, err, ErrInvalidStamp)
+}
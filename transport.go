@@ -0,0 +1,450 @@
+package retryabledns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/projectdiscovery/retryabledns/doh"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	// ErrUnknownTransport is returned when no transport is registered for the resolver scheme
+	ErrUnknownTransport = errors.New("no transport registered for resolver scheme")
+)
+
+// Transport exchanges a dns message with a single upstream resolver
+type Transport interface {
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error)
+}
+
+// TransportFactory creates the transport used by client to reach resolver
+type TransportFactory func(client *Client, resolver Resolver) (Transport, error)
+
+// TransportFunc is an adapter to allow the use of ordinary functions as transports
+type TransportFunc func(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error)
+
+// Exchange calls f(ctx, msg)
+func (f TransportFunc) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	return f(ctx, msg)
+}
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]TransportFactory{
+		UDP.String():      newUDPTransport,
+		TCP.String():      newTCPTransport,
+		DOT.String():      newDOTTransport,
+		DOH.String():      newDOHTransport,
+		DOQ.String():      newDOQTransport,
+		DNSCrypt.String(): newDNSCryptTransport,
+	}
+)
+
+// RegisterTransport makes a transport available for resolvers with the given scheme.
+// Registering a builtin scheme replaces the default implementation, while any other
+// scheme can then be used in resolver strings as "scheme:address".
+func RegisterTransport(scheme string, factory TransportFactory) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if factory == nil {
+		delete(transports, scheme)
+		return
+	}
+	transports[scheme] = factory
+}
+
+func getTransportFactory(scheme string) (TransportFactory, bool) {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	factory, ok := transports[scheme]
+	return factory, ok
+}
+
+// resolverScheme returns the registry key of the resolver
+func resolverScheme(resolver Resolver) string {
+	switch r := resolver.(type) {
+	case *NetworkResolver:
+		return r.Protocol.String()
+	case *DohResolver:
+		return DOH.String()
+	case interface{ Scheme() string }:
+		return r.Scheme()
+	default:
+		return UDP.String()
+	}
+}
+
+// transportKey identifies the transport of resolver by its whole configuration, so that
+// resolvers sharing an address, e.g. a post and a jsonapi doh resolver, don't share it
+func transportKey(scheme string, resolver Resolver) string {
+	// the local types drop the String method, so that every field is formatted
+	var config any
+	switch r := resolver.(type) {
+	case *NetworkResolver:
+		type fields NetworkResolver
+		config = fields(*r)
+	case *DohResolver:
+		type fields DohResolver
+		config = fields(*r)
+	case *DNSCryptResolver:
+		type fields DNSCryptResolver
+		config = fields(*r)
+	default:
+		return scheme + ":" + resolver.String()
+	}
+	return fmt.Sprintf("%s:%+v", scheme, config)
+}
+
+// transport returns the transport for resolver, creating and caching it on first use
+func (c *Client) transport(resolver Resolver) (Transport, error) {
+	scheme := resolverScheme(resolver)
+	key := transportKey(scheme, resolver)
+	if t, ok := c.transports.Load(key); ok {
+		return t.(Transport), nil
+	}
+	factory, ok := getTransportFactory(scheme)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTransport, scheme)
+	}
+	t, err := factory(c, resolver)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := c.transports.LoadOrStore(key, t)
+	return actual.(Transport), nil
+}
+
+// exchange sends msg to resolver through its transport, falling back to tcp
+// for truncated responses if enabled
+func (c *Client) exchange(ctx context.Context, resolver Resolver, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	t, err := c.transport(resolver)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.rateLimiter != nil {
+		if err := c.rateLimiter.wait(ctx, resolver); err != nil {
+			return nil, 0, err
+		}
+	}
+	resp, rtt, err := t.Exchange(ctx, msg)
+	if ctx.Err() != nil {
+		return nil, rtt, contextError(ctx)
+	}
+	c.health.record(resolver, rtt, resp, err)
+	if c.rateLimiter != nil {
+		c.rateLimiter.feedback(resolver, resp, err)
+	}
+	if err != nil {
+		return nil, rtt, err
+	}
+
+	// https://github.com/projectdiscovery/retryabledns/issues/25
+	// the tcp variant of the resolver goes through the registry, limits and health as well
+	if resp != nil && resp.Truncated && c.TCPFallback {
+		if r, ok := resolver.(*NetworkResolver); ok && r.Protocol == UDP {
+			tcpResolver := *r
+			tcpResolver.Protocol = TCP
+			return c.exchange(ctx, &tcpResolver, msg)
+		}
+	}
+	return resp, rtt, nil
+}
+
+// CustomResolver is a resolver whose scheme is served by a transport registered with RegisterTransport
+type CustomResolver struct {
+	Protocol string
+	Address  string
+}
+
+// Scheme returns the transport registry key of the resolver
+func (r CustomResolver) Scheme() string {
+	return r.Protocol
+}
+
+func (r CustomResolver) String() string {
+	return r.Address
+}
+
+// isCustomScheme returns true if scheme has a registered non builtin transport
+func isCustomScheme(scheme string) bool {
+	switch Protocol(scheme) {
+	case UDP, TCP, DOT, DOH, DOQ, DNSCrypt:
+		return false
+	}
+	_, ok := getTransportFactory(scheme)
+	return ok
+}
+
+// parseCustomResolver parses resolvers in the form "scheme:address" for registered schemes
+func parseCustomResolver(r string) (*CustomResolver, bool) {
+	scheme, address, ok := strings.Cut(r, ":")
+	if !ok || !isCustomScheme(scheme) {
+		return nil, false
+	}
+	return &CustomResolver{Protocol: scheme, Address: address}, true
+}
+
+type udpTransport struct {
+	client *Client
+	addr   string
+}
+
+func newUDPTransport(client *Client, resolver Resolver) (Transport, error) {
+	return &udpTransport{client: client, addr: resolver.String()}, nil
+}
+
+func (t *udpTransport) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	c := t.client
+	if c.options.ConnectionPoolThreads > 1 {
+		if udpConnPool, ok := c.udpConnPool.Get(t.addr); ok {
+			return udpConnPool.Exchange(ctx, c.udpClient, msg)
+		}
+	}
+	if c.udpProxy != nil {
+		udpConn, err := c.dialWithProxy(ctx, c.udpProxy, "udp", t.addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer udpConn.Close()
+		return exchangeWithConnContext(ctx, c.udpClient, msg, udpConn)
+	}
+	return exchangeContext(ctx, c.udpClient, msg, t.addr)
+}
+
+type tcpTransport struct {
+	client *Client
+	addr   string
+}
+
+func newTCPTransport(client *Client, resolver Resolver) (Transport, error) {
+	return &tcpTransport{client: client, addr: resolver.String()}, nil
+}
+
+func (t *tcpTransport) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	c := t.client
+	if c.tcpProxy != nil {
+		tcpConn, err := c.dialWithProxy(ctx, c.tcpProxy, "tcp", t.addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer tcpConn.Close()
+		return exchangeWithConnContext(ctx, c.tcpClient, msg, tcpConn)
+	}
+	return exchangeContext(ctx, c.tcpClient, msg, t.addr)
+}
+
+type dotTransport struct {
+	dnsClient *dns.Client
+	addr      string
+}
+
+func newDOTTransport(client *Client, resolver Resolver) (Transport, error) {
+	return &dotTransport{dnsClient: client.dotClientFor(resolver), addr: resolver.String()}, nil
+}
+
+func (t *dotTransport) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	return exchangeContext(ctx, t.dnsClient, msg, t.addr)
+}
+
+// dotClientFor returns a dot client using the tls config of resolver
+func (c *Client) dotClientFor(resolver Resolver) *dns.Client {
+	dnsClient := *c.dotClient
+	dnsClient.TLSConfig = c.tlsConfig(resolver)
+	return &dnsClient
+}
+
+type dohTransport struct {
+	dohClient  *doh.Client
+	httpClient *http.Client
+	resolver   doh.Resolver
+	method     doh.Method
+	protocol   DohProtocol
+}
+
+func newDOHTransport(client *Client, resolver Resolver) (Transport, error) {
+	r, ok := resolver.(*DohResolver)
+	if !ok {
+		return nil, fmt.Errorf("invalid doh resolver: %s", resolver.String())
+	}
+	method := doh.MethodPost
+	if r.Protocol == GET {
+		method = doh.MethodGet
+	}
+	dohResolver := doh.Resolver{
+		URL:       r.URL,
+		Headers:   client.options.DoHHeaders,
+		UserAgent: client.options.DoHUserAgent,
+		Relay:     r.Relay,
+	}
+	t := &dohTransport{dohClient: client.dohClient, resolver: dohResolver, method: method, protocol: r.Protocol}
+	// resolvers with their own tls or dial settings can't share the connections of the others
+	if _, ok := client.tlsOptions(r); ok || r.ServerName != "" || r.Addr != "" || len(r.CertificateHashes) > 0 {
+		var dialAddress doh.ClientOption
+		if r.Addr != "" {
+			hostport, err := dohHostPort(r.URL)
+			if err != nil {
+				return nil, err
+			}
+			dialAddress = doh.WithDialAddress(hostport, r.Addr)
+		}
+		t.httpClient = newDOHHTTPClient(client.options, client.tlsConfig(r), dialAddress)
+		t.dohClient = doh.NewWithOptions(doh.Options{HttpClient: t.httpClient})
+	}
+	return t, nil
+}
+
+// dohHostPort returns the host and port dialed to reach URL
+func dohHostPort(URL string) (string, error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// newDOHHTTPClient returns the http client used to reach doh resolvers with tlsConfig,
+// extra options are applied last
+func newDOHHTTPClient(options Options, tlsConfig *tls.Config, extra ...doh.ClientOption) *http.Client {
+	opts := []doh.ClientOption{
+		doh.WithTimeout(options.Timeout),
+		doh.WithTLSConfig(tlsConfig),
+		doh.WithProxy(options.Proxy), // no-op if empty
+		doh.WithIdleConns(options.DoHMaxIdleConns, options.DoHMaxIdleConnsPerHost, options.DoHIdleConnTimeout),
+		doh.WithHTTPVersion(options.DoHHTTPVersion),
+	}
+	for _, opt := range extra {
+		if opt != nil {
+			opts = append(opts, opt)
+		}
+	}
+	return doh.NewHttpClient(opts...)
+}
+
+// Close closes the idle connections of resolvers with a dedicated http client
+func (t *dohTransport) Close() error {
+	if t.httpClient != nil {
+		t.httpClient.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (t *dohTransport) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	var (
+		resp  *dns.Msg
+		err   error
+		start = time.Now()
+	)
+	switch t.protocol {
+	case JsonAPI:
+		resp, err = t.dohClient.QueryWithJsonAPIMsgContext(ctx, t.resolver, msg)
+	case ODOH:
+		resp, err = t.dohClient.QueryWithODoHMsgContext(ctx, t.resolver, msg)
+	default:
+		resp, err = t.dohClient.QueryWithDOHMsgContext(ctx, t.method, t.resolver, msg)
+	}
+	return resp, time.Since(start), err
+}
+
+func (c *Client) dialWithProxy(ctx context.Context, dialer proxy.Dialer, network, addr string) (*dns.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+		conn, err = contextDialer.DialContext(ctx, network, addr)
+	} else {
+		conn, err = dialer.Dial(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// exchangeContext dials addr and performs the exchange, both bound to ctx
+func exchangeContext(ctx context.Context, client *dns.Client, msg *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	conn, err := client.DialContext(ctx, addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, contextError(ctx)
+		}
+		return nil, 0, err
+	}
+	defer conn.Close()
+	return exchangeWithConnContext(ctx, client, msg, conn)
+}
+
+// exchangeWithConnContext performs the exchange over conn and interrupts any
+// pending read or write as soon as ctx is done
+func exchangeWithConnContext(ctx context.Context, client *dns.Client, msg *dns.Msg, conn *dns.Conn) (*dns.Msg, time.Duration, error) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	resp, rtt, err := client.ExchangeWithConnContext(ctx, msg, conn)
+	if err != nil && ctx.Err() != nil {
+		return nil, rtt, contextError(ctx)
+	}
+	return resp, rtt, err
+}
+
+// contextError wraps the error of a done context so that it can be matched with errors.Is
+func contextError(ctx context.Context) error {
+	return fmt.Errorf("dns query aborted: %w", ctx.Err())
+}
+
+// transfer starts a zone transfer of msg with resolver over a dedicated connection.
+// The transfer resets the read deadline for each envelope, so closing the
+// connection is the only way to interrupt it once ctx is done.
+func (c *Client) transfer(ctx context.Context, resolver Resolver, msg *dns.Msg) (chan *dns.Envelope, error) {
+	r, ok := resolver.(*NetworkResolver)
+	if !ok {
+		return nil, fmt.Errorf("zone transfer not supported by resolver: %s", resolver.String())
+	}
+	var dnsClient *dns.Client
+	switch r.Protocol {
+	case UDP:
+		dnsClient = c.udpClient
+	case DOT:
+		dnsClient = c.dotClientFor(r)
+	default:
+		dnsClient = c.tcpClient
+	}
+	dnsconn, err := dnsClient.DialContext(ctx, r.String())
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = dnsconn.Close()
+	})
+	dnsTransfer := &dns.Transfer{Conn: dnsconn}
+	envelopes, err := dnsTransfer.In(msg, r.String())
+	if err != nil {
+		stop()
+		_ = dnsconn.Close()
+		return nil, err
+	}
+	out := make(chan *dns.Envelope)
+	go func() {
+		defer close(out)
+		defer stop()
+		for envelope := range envelopes {
+			out <- envelope
+		}
+	}()
+	return out, nil
+}
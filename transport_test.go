@@ -0,0 +1,174 @@
+package retryabledns
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterTransport(t *testing.T) {
+	var exchanged []string
+	RegisterTransport("mem", func(client *Client, resolver Resolver) (Transport, error) {
+		return TransportFunc(func(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+			exchanged = append(exchanged, resolver.String())
+			resp := new(dns.Msg)
+			resp.SetReply(msg)
+			rr, err := dns.NewRR(msg.Question[0].Name + " 300 IN A 10.0.0.1")
+			if err != nil {
+				return nil, 0, err
+			}
+			resp.Answer = append(resp.Answer, rr)
+			return resp, 0, nil
+		}), nil
+	})
+	defer RegisterTransport("mem", nil)
+
+	client, err := New([]string{"mem:fake-upstream"}, 2)
+	require.NoError(t, err)
+	require.IsType(t, &CustomResolver{}, client.resolvers[0])
+
+	d, err := client.QueryMultiple("example.com", []uint16{dns.TypeA})
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, d.A)
+	require.Equal(t, []string{"fake-upstream"}, d.Resolver)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	resp, err := client.Do(msg)
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+	require.Equal(t, []string{"fake-upstream", "fake-upstream"}, exchanged)
+}
+
+func TestUnknownTransport(t *testing.T) {
+	client, err := New([]string{"127.0.0.1:53"}, 1)
+	require.NoError(t, err)
+
+	_, err = client.QueryMultipleWithResolver("example.com", []uint16{dns.TypeA}, &CustomResolver{Protocol: "unregistered", Address: "nowhere"})
+	require.ErrorIs(t, err, ErrUnknownTransport)
+}
+
+func TestTransportPerResolverConfiguration(t *testing.T) {
+	client, err := New([]string{"127.0.0.1:53"}, 1)
+	require.NoError(t, err)
+
+	post, err := client.transport(&DohResolver{Protocol: POST, URL: "https://dns.example.com/dns-query"})
+	require.NoError(t, err)
+	jsonAPI, err := client.transport(&DohResolver{Protocol: JsonAPI, URL: "https://dns.example.com/dns-query"})
+	require.NoError(t, err)
+	require.NotSame(t, post, jsonAPI)
+	require.Equal(t, POST, post.(*dohTransport).protocol)
+	require.Equal(t, JsonAPI, jsonAPI.(*dohTransport).protocol)
+
+	relayed, err := client.transport(&DohResolver{Protocol: POST, URL: "https://dns.example.com/dns-query", Relay: "https://relay.example.com/proxy"})
+	require.NoError(t, err)
+	require.NotSame(t, post, relayed)
+
+	again, err := client.transport(&DohResolver{Protocol: POST, URL: "https://dns.example.com/dns-query"})
+	require.NoError(t, err)
+	require.Same(t, post, again)
+
+	dot, err := client.transport(&NetworkResolver{Protocol: DOT, Host: "127.0.0.1", Port: "853"})
+	require.NoError(t, err)
+	pinned, err := client.transport(&NetworkResolver{Protocol: DOT, Host: "127.0.0.1", Port: "853", CertificateHashes: [][]byte{{1, 2, 3}}})
+	require.NoError(t, err)
+	require.NotSame(t, dot, pinned)
+}
+
+func TestTruncatedFallbackUsesRegistry(t *testing.T) {
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Truncated = true
+		_ = w.WriteMsg(m)
+	})
+	var fallbacks []string
+	RegisterTransport(TCP.String(), func(client *Client, resolver Resolver) (Transport, error) {
+		return TransportFunc(func(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+			fallbacks = append(fallbacks, resolver.String())
+			resp := new(dns.Msg)
+			resp.SetReply(msg)
+			rr, _ := dns.NewRR(msg.Question[0].Name + " 60 IN A 127.0.0.4")
+			resp.Answer = append(resp.Answer, rr)
+			return resp, 0, nil
+		}), nil
+	})
+	defer RegisterTransport(TCP.String(), newTCPTransport)
+
+	client, err := New([]string{"udp:" + addr}, 1)
+	require.NoError(t, err)
+	client.TCPFallback = true
+	d, err := client.A("example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.4"}, d.A)
+	require.Equal(t, []string{addr}, fallbacks)
+}
+
+func TestTransportUDPAndTCP(t *testing.T) {
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 127.0.0.3")
+		m.Answer = append(m.Answer, rr)
+		_ = w.WriteMsg(m)
+	}
+	udpAddr := runLocalDNSServer(t, "udp", handler)
+	tcpAddr := runLocalDNSServer(t, "tcp", handler)
+
+	for _, resolver := range []string{"udp:" + udpAddr, "tcp:" + tcpAddr} {
+		client, err := New([]string{resolver}, 1)
+		require.NoError(t, err)
+		d, err := client.A("example.com")
+		require.NoError(t, err, resolver)
+		require.Equal(t, []string{"127.0.0.3"}, d.A, resolver)
+	}
+}
+
+func TestDOHJsonAPI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/dns-json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		name, qtype := r.URL.Query().Get("name"), r.URL.Query().Get("type")
+		w.Header().Set("Content-Type", "application/dns-json")
+		switch name {
+		case "www.example.com.":
+			fmt.Fprintf(w, `{"Status":0,"RD":true,"RA":true,"Question":[{"name":"www.example.com.","type":%d}],
+				"Answer":[{"name":"www.example.com.","type":5,"TTL":120,"data":"example.com."},
+				{"name":"example.com.","type":1,"TTL":60,"data":"93.184.216.34"}]}`, dns.StringToType[qtype])
+		default:
+			fmt.Fprint(w, `{"Status":3,"RD":true,"RA":true,"Question":[{"name":"missing.example.com.","type":1}],
+				"Authority":[{"name":"example.com.","type":6,"TTL":900,"data":"ns.icann.org. noc.dns.icann.org. 2024 7200 3600 1209600 300"}]}`)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewWithOptions(Options{BaseResolvers: []string{"doh:" + server.URL + ":jsonapi"}, MaxRetries: 1, CacheSize: 10})
+	require.NoError(t, err)
+
+	d, err := client.A("www.example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"93.184.216.34"}, d.A)
+	require.Equal(t, []string{"example.com"}, d.CNAME)
+	require.Equal(t, uint32(120), d.TTL)
+	require.Equal(t, "NOERROR", d.StatusCode)
+
+	d, err = client.A("missing.example.com")
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, d.StatusCodeRaw)
+	require.Len(t, d.SOA, 1)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("missing.example.com.", dns.TypeA)
+	resp, err := client.Do(msg)
+	require.NoError(t, err)
+	require.Equal(t, msg.Id, resp.Id)
+	require.Equal(t, dns.RcodeNameError, resp.Rcode)
+}
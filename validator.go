@@ -0,0 +1,294 @@
+package retryabledns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RejectionReason explains why a resolver failed validation
+type RejectionReason string
+
+const (
+	// RejectInvalid is used for resolvers that can't be parsed
+	RejectInvalid RejectionReason = "invalid"
+	// RejectUnreachable is used for resolvers that don't answer
+	RejectUnreachable RejectionReason = "unreachable"
+	// RejectErrorRcode is used for resolvers answering known names with an error rcode
+	RejectErrorRcode RejectionReason = "error-rcode"
+	// RejectWrongAnswer is used for resolvers returning unexpected records for known names
+	RejectWrongAnswer RejectionReason = "wrong-answer"
+	// RejectSinkhole is used for resolvers returning internal, loopback or unspecified
+	// addresses for public names
+	RejectSinkhole RejectionReason = "sinkhole"
+	// RejectNXDomainHijack is used for resolvers answering non existent names
+	RejectNXDomainHijack RejectionReason = "nxdomain-hijack"
+	// RejectBadTTL is used for resolvers returning ttls out of the accepted range
+	RejectBadTTL RejectionReason = "bad-ttl"
+)
+
+func (r RejectionReason) String() string {
+	return string(r)
+}
+
+// ValidationProbe is a known name along with the addresses it's expected to resolve to
+type ValidationProbe struct {
+	Name string
+	// Expected lists the accepted A records, if empty any public address is accepted.
+	// Internal addresses are rejected either way.
+	Expected []string
+}
+
+// ValidatorOptions configures ValidateResolvers
+type ValidatorOptions struct {
+	// KnownGood are the names each resolver must resolve correctly
+	KnownGood []ValidationProbe
+	// NXDomains are the zones under which random non existent names are probed
+	NXDomains []string
+	// MinTTL is the lowest accepted ttl, forged answers often come with a zero ttl
+	MinTTL uint32
+	// MaxTTL is the highest accepted ttl
+	MaxTTL uint32
+	// Timeout is the timeout of each query
+	Timeout time.Duration
+	// MaxRetries is the number of attempts of each query
+	MaxRetries int
+	// Concurrency is the number of resolvers validated at the same time
+	Concurrency int
+}
+
+// DefaultValidatorOptions probes well known public resolver names and example zones
+var DefaultValidatorOptions = ValidatorOptions{
+	KnownGood: []ValidationProbe{
+		{Name: "one.one.one.one", Expected: []string{"1.1.1.1", "1.0.0.1"}},
+		{Name: "dns.google", Expected: []string{"8.8.8.8", "8.8.4.4"}},
+	},
+	NXDomains:   []string{"example.com", "google.com"},
+	MinTTL:      1,
+	MaxTTL:      604800,
+	Timeout:     3 * time.Second,
+	MaxRetries:  2,
+	Concurrency: 10,
+}
+
+// ValidatedResolver is the outcome of the validation of a resolver
+type ValidatedResolver struct {
+	Resolver string          `json:"resolver"`
+	RTT      time.Duration   `json:"rtt,omitempty"`
+	Reason   RejectionReason `json:"reason,omitempty"`
+	Details  string          `json:"details,omitempty"`
+}
+
+// Rejected returns true if the resolver failed validation
+func (v ValidatedResolver) Rejected() bool {
+	return v.Reason != ""
+}
+
+// ValidationReport contains the resolvers that passed validation, ranked by rtt, and the rejected ones
+type ValidationReport struct {
+	Accepted []ValidatedResolver `json:"accepted,omitempty"`
+	Rejected []ValidatedResolver `json:"rejected,omitempty"`
+}
+
+// Resolvers returns the accepted resolvers, fastest first, ready for Options.BaseResolvers
+func (r *ValidationReport) Resolvers() []string {
+	resolvers := make([]string, 0, len(r.Accepted))
+	for _, accepted := range r.Accepted {
+		resolvers = append(resolvers, accepted.Resolver)
+	}
+	return resolvers
+}
+
+// ValidateResolvers probes each resolver with the A and AAAA records of known good names
+// and with non existent names, and rejects the ones returning wrong answers, rewriting
+// NXDOMAIN or returning insane ttls.
+// Zero values in options are replaced with the ones of DefaultValidatorOptions.
+func ValidateResolvers(ctx context.Context, resolvers []string, options ValidatorOptions) (*ValidationReport, error) {
+	if options.KnownGood == nil {
+		options.KnownGood = DefaultValidatorOptions.KnownGood
+	}
+	if options.NXDomains == nil {
+		options.NXDomains = DefaultValidatorOptions.NXDomains
+	}
+	if options.MinTTL == 0 {
+		options.MinTTL = DefaultValidatorOptions.MinTTL
+	}
+	if options.MaxTTL == 0 {
+		options.MaxTTL = DefaultValidatorOptions.MaxTTL
+	}
+	if options.Timeout == 0 {
+		options.Timeout = DefaultValidatorOptions.Timeout
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = DefaultValidatorOptions.MaxRetries
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = DefaultValidatorOptions.Concurrency
+	}
+
+	results := make([]ValidatedResolver, len(resolvers))
+	sem := make(chan struct{}, options.Concurrency)
+	var wg sync.WaitGroup
+	for i, resolver := range resolvers {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, resolver string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = validateResolver(ctx, resolver, options)
+		}(i, resolver)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, contextError(ctx)
+	}
+
+	report := &ValidationReport{}
+	for _, result := range results {
+		if result.Rejected() {
+			report.Rejected = append(report.Rejected, result)
+		} else {
+			report.Accepted = append(report.Accepted, result)
+		}
+	}
+	slices.SortStableFunc(report.Accepted, func(a, b ValidatedResolver) int {
+		return int(a.RTT - b.RTT)
+	})
+	return report, nil
+}
+
+func validateResolver(ctx context.Context, resolver string, options ValidatorOptions) ValidatedResolver {
+	result := ValidatedResolver{Resolver: resolver}
+	reject := func(reason RejectionReason, format string, args ...any) ValidatedResolver {
+		result.Reason = reason
+		result.Details = fmt.Sprintf(format, args...)
+		return result
+	}
+
+	client, err := NewWithOptions(Options{
+		BaseResolvers: []string{resolver},
+		MaxRetries:    options.MaxRetries,
+		Timeout:       options.Timeout,
+	})
+	if err != nil {
+		return reject(RejectInvalid, "%v", err)
+	}
+	defer client.Close()
+
+	var (
+		total   time.Duration
+		queries int
+	)
+	query := func(name string, qtype uint16) (*DNSData, error) {
+		start := time.Now()
+		data, err := client.QueryContext(ctx, name, qtype)
+		total += time.Since(start)
+		queries++
+		return data, err
+	}
+
+	for _, probe := range options.KnownGood {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			data, err := query(probe.Name, qtype)
+			if err != nil {
+				var rcodeErr *RcodeError
+				if errors.As(err, &rcodeErr) {
+					return reject(RejectErrorRcode, "%s: %s", probe.Name, dns.RcodeToString[rcodeErr.Rcode])
+				}
+				return reject(RejectUnreachable, "%s: %v", probe.Name, err)
+			}
+			// known good names may have no ipv6 address
+			ips := data.AAAA
+			if qtype == dns.TypeA {
+				if data.StatusCodeRaw != dns.RcodeSuccess || len(data.A) == 0 {
+					return reject(RejectWrongAnswer, "%s: no records (%s)", probe.Name, data.StatusCode)
+				}
+				ips = data.A
+			}
+			for _, ip := range ips {
+				if isSinkholeIP(ip) {
+					return reject(RejectSinkhole, "%s: internal record %s", probe.Name, ip)
+				}
+				if qtype == dns.TypeA && len(probe.Expected) > 0 && !slices.Contains(probe.Expected, ip) {
+					return reject(RejectWrongAnswer, "%s: unexpected record %s", probe.Name, ip)
+				}
+			}
+			if ttl, ok := checkTTL(data, options.MinTTL, options.MaxTTL); !ok {
+				return reject(RejectBadTTL, "%s: ttl %d out of [%d, %d]", probe.Name, ttl, options.MinTTL, options.MaxTTL)
+			}
+		}
+	}
+
+	for _, zone := range options.NXDomains {
+		name := randomLabel() + "." + zone
+		data, err := query(name, dns.TypeA)
+		if err != nil {
+			var rcodeErr *RcodeError
+			if errors.As(err, &rcodeErr) {
+				return reject(RejectErrorRcode, "%s: %s", name, dns.RcodeToString[rcodeErr.Rcode])
+			}
+			return reject(RejectUnreachable, "%s: %v", name, err)
+		}
+		if data.StatusCodeRaw != dns.RcodeNameError {
+			return reject(RejectNXDomainHijack, "%s: answered %s with %d records", name, data.StatusCode, len(data.A))
+		}
+	}
+
+	if queries > 0 {
+		result.RTT = total / time.Duration(queries)
+	}
+	return result
+}
+
+// isSinkholeIP returns true if ip is an address public names never resolve to
+func isSinkholeIP(ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	if parsedIP.IsUnspecified() || parsedIP.IsLoopback() {
+		return true
+	}
+	if internalRangeCheckerInstance == nil {
+		return false
+	}
+	if parsedIP.To4() != nil {
+		return internalRangeCheckerInstance.ContainsIPv4(parsedIP)
+	}
+	return internalRangeCheckerInstance.ContainsIPv6(parsedIP)
+}
+
+// checkTTL returns the first answer ttl out of [minTTL, maxTTL], if any
+func checkTTL(data *DNSData, minTTL, maxTTL uint32) (uint32, bool) {
+	if data.RawResp == nil {
+		return 0, true
+	}
+	for _, rr := range data.RawResp.Answer {
+		if ttl := rr.Header().Ttl; ttl < minTTL || ttl > maxTTL {
+			return ttl, false
+		}
+	}
+	return 0, true
+}
+
+// randomLabel returns a random dns label unlikely to exist
+func randomLabel() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
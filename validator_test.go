@@ -0,0 +1,115 @@
+package retryabledns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// runValidatorServer starts a stub resolver for the "test" zone misbehaving according to mode
+func runValidatorServer(t *testing.T, mode string) string {
+	return runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		name := r.Question[0].Name
+		// answer only adds the addresses of the queried family
+		answer := func(ttl, ip string) {
+			qtype := "A"
+			if net.ParseIP(ip).To4() == nil {
+				qtype = "AAAA"
+			}
+			if dns.TypeToString[r.Question[0].Qtype] != qtype {
+				return
+			}
+			rr, _ := dns.NewRR(name + " " + ttl + " IN " + qtype + " " + ip)
+			m.Answer = append(m.Answer, rr)
+		}
+		switch {
+		case mode == "refused":
+			m.Rcode = dns.RcodeRefused
+		case name == "good.test.":
+			switch mode {
+			case "poisoned":
+				answer("60", "6.6.6.6")
+			case "bad-ttl":
+				answer("2147483647", "93.184.216.34")
+			case "zero-ttl":
+				answer("0", "93.184.216.34")
+			case "loopback":
+				answer("60", "127.0.0.1")
+			case "sinkhole-aaaa":
+				answer("60", "93.184.216.34")
+				answer("60", "::")
+			default:
+				answer("60", "93.184.216.34")
+				answer("60", "2606:2800:220:1::1")
+			}
+		case name == "public.test.":
+			if mode == "sinkhole" {
+				answer("60", "10.0.0.1")
+			} else {
+				answer("60", "93.184.216.35")
+			}
+		case mode == "hijack":
+			answer("60", "6.6.6.6")
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+		_ = w.WriteMsg(m)
+	})
+}
+
+func TestValidateResolvers(t *testing.T) {
+	servers := make(map[string]string)
+	for _, mode := range []string{"honest", "poisoned", "bad-ttl", "zero-ttl", "sinkhole", "loopback", "sinkhole-aaaa", "hijack", "refused"} {
+		servers[mode] = runValidatorServer(t, mode)
+	}
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	servers["unreachable"] = listener.LocalAddr().String()
+
+	resolvers := []string{servers["honest"], servers["poisoned"], servers["bad-ttl"], servers["zero-ttl"], servers["sinkhole"],
+		servers["loopback"], servers["sinkhole-aaaa"], servers["hijack"], servers["refused"], servers["unreachable"]}
+	report, err := ValidateResolvers(context.Background(), resolvers, ValidatorOptions{
+		KnownGood: []ValidationProbe{
+			{Name: "good.test", Expected: []string{"93.184.216.34"}},
+			{Name: "public.test"},
+		},
+		NXDomains:  []string{"test"},
+		Timeout:    200 * time.Millisecond,
+		MaxRetries: 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{servers["honest"]}, report.Resolvers())
+	require.Positive(t, report.Accepted[0].RTT)
+
+	reasons := make(map[string]RejectionReason)
+	for _, rejected := range report.Rejected {
+		require.True(t, rejected.Rejected())
+		require.NotEmpty(t, rejected.Details)
+		reasons[rejected.Resolver] = rejected.Reason
+	}
+	// internal addresses are rejected even where other records are expected
+	require.Equal(t, map[string]RejectionReason{
+		servers["poisoned"]:      RejectWrongAnswer,
+		servers["bad-ttl"]:       RejectBadTTL,
+		servers["zero-ttl"]:      RejectBadTTL,
+		servers["sinkhole"]:      RejectSinkhole,
+		servers["loopback"]:      RejectSinkhole,
+		servers["sinkhole-aaaa"]: RejectSinkhole,
+		servers["hijack"]:        RejectNXDomainHijack,
+		servers["refused"]:       RejectErrorRcode,
+		servers["unreachable"]:   RejectUnreachable,
+	}, reasons)
+
+	for _, rejected := range report.Rejected {
+		if rejected.Reason == RejectWrongAnswer {
+			require.Contains(t, rejected.Details, "6.6.6.6")
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package retryabledns
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/projectdiscovery/retryabledns/internal/inflight"
+)
+
+// DefaultWildcardProbes is the default number of random names resolved for each level
+var DefaultWildcardProbes = 3
+
+// WildcardAnswer is the set of records returned by a wildcard for a parent domain
+type WildcardAnswer struct {
+	Parent string
+	IPs    map[string]struct{}
+	CNAMEs map[string]struct{}
+}
+
+// IsWildcard returns true if the parent domain has a wildcard record
+func (w *WildcardAnswer) IsWildcard() bool {
+	return len(w.IPs) > 0 || len(w.CNAMEs) > 0
+}
+
+// matches returns true if all the records of data come from the wildcard. A CNAME based
+// wildcard matches on the alias targets, as the addresses they point to may rotate.
+func (w *WildcardAnswer) matches(data *DNSData) bool {
+	if len(data.CNAME) > 0 && len(w.CNAMEs) > 0 {
+		return containsAll(w.CNAMEs, data.CNAME)
+	}
+	ips := append(append([]string{}, data.A...), data.AAAA...)
+	return len(ips) > 0 && containsAll(w.IPs, ips)
+}
+
+func containsAll(set map[string]struct{}, values []string) bool {
+	for _, value := range values {
+		if _, ok := set[strings.ToLower(value)]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// WildcardDetector detects answers generated by wildcard records in a domain. The
+// wildcard answer of each parent domain is resolved once and cached.
+type WildcardDetector struct {
+	// Probes is the number of random names resolved for each parent domain
+	Probes int
+	// ProbeTimeout bounds the probe of a parent domain, by default it's derived from the
+	// client timeout, retry policy and hedging, but not from the rate limits
+	ProbeTimeout time.Duration
+
+	client  *Client
+	domain  string
+	answers inflight.Group[*WildcardAnswer]
+}
+
+// NewWildcardDetector returns a wildcard detector for the names under domain
+func NewWildcardDetector(client *Client, domain string) *WildcardDetector {
+	return &WildcardDetector{
+		Probes:  DefaultWildcardProbes,
+		client:  client,
+		domain:  normalizeName(domain),
+		answers: inflight.Group[*WildcardAnswer]{Keep: true},
+	}
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// parents returns the parent domains of host up to the detector domain, closest first
+func (w *WildcardDetector) parents(host string) []string {
+	host = normalizeName(host)
+	if host != w.domain && !strings.HasSuffix(host, "."+w.domain) {
+		return nil
+	}
+	var parents []string
+	for name := host; name != w.domain; {
+		_, parent, _ := strings.Cut(name, ".")
+		parents = append(parents, parent)
+		name = parent
+	}
+	return parents
+}
+
+// IsWildcard returns true if the answer of data only contains records returned by a
+// wildcard of one of the parent domains of its host
+func (w *WildcardDetector) IsWildcard(data *DNSData) (bool, error) {
+	return w.IsWildcardContext(context.Background(), data)
+}
+
+// IsWildcardContext is like IsWildcard but honors the cancellation and deadline of ctx
+func (w *WildcardDetector) IsWildcardContext(ctx context.Context, data *DNSData) (bool, error) {
+	if data == nil || (len(data.A) == 0 && len(data.AAAA) == 0 && len(data.CNAME) == 0) {
+		return false, nil
+	}
+	for _, parent := range w.parents(data.Host) {
+		answer, err := w.WildcardAnswerContext(ctx, parent)
+		if err != nil {
+			return false, err
+		}
+		if answer.IsWildcard() && answer.matches(data) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// WildcardAnswer returns the records a wildcard of parent resolves to, if any
+func (w *WildcardDetector) WildcardAnswer(parent string) (*WildcardAnswer, error) {
+	return w.WildcardAnswerContext(context.Background(), parent)
+}
+
+// WildcardAnswerContext is like WildcardAnswer but honors the cancellation and deadline of ctx.
+// The probe is shared by the concurrent callers and isn't cancelled with ctx, which only
+// stops the wait of this caller.
+func (w *WildcardDetector) WildcardAnswerContext(ctx context.Context, parent string) (*WildcardAnswer, error) {
+	parent = normalizeName(parent)
+	// failures are not kept so that the next caller probes again
+	answer, err := w.answers.Do(ctx, parent, func(ctx context.Context) (*WildcardAnswer, error) {
+		ctx, cancel := context.WithTimeout(ctx, w.probeTimeout())
+		defer cancel()
+		return w.probe(ctx, parent)
+	})
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return nil, contextError(ctx)
+	}
+	return answer, err
+}
+
+// wildcardProbeTypes are the record types resolved for each probe
+var wildcardProbeTypes = []uint16{dns.TypeA, dns.TypeAAAA}
+
+// probeTimeout returns ProbeTimeout, or the time the queries of a probe take when every
+// attempt times out after the longest hedging and retry delays
+func (w *WildcardDetector) probeTimeout() time.Duration {
+	if w.ProbeTimeout > 0 {
+		return w.ProbeTimeout
+	}
+	options := w.client.options
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = DefaultOptions.Timeout
+	}
+	attempt := float64(timeout)
+	if h := w.client.hedger; h != nil {
+		// the dynamic delay is the p95 of the rtt, which is at most the timeout
+		delay := h.delay
+		if h.dynamic || delay <= 0 {
+			delay = timeout
+		}
+		attempt += float64(h.maxRequests-1) * float64(delay)
+	}
+	policy := options.RetryPolicy
+	policy.Jitter = 0
+	query := attempt
+	for retry := 1; retry < max(options.MaxRetries, 1); retry++ {
+		query += attempt + float64(policy.Delay(retry))
+	}
+	total := query * float64(len(wildcardProbeTypes)*max(w.Probes, 1))
+	if total >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(total)
+}
+
+// probe resolves random labels under parent and collects the records they resolve to
+func (w *WildcardDetector) probe(ctx context.Context, parent string) (*WildcardAnswer, error) {
+	answer := &WildcardAnswer{
+		Parent: parent,
+		IPs:    make(map[string]struct{}),
+		CNAMEs: make(map[string]struct{}),
+	}
+	for i := 0; i < max(w.Probes, 1); i++ {
+		data, err := w.client.QueryMultipleContext(ctx, randomLabel()+"."+parent, wildcardProbeTypes)
+		if err != nil {
+			return nil, err
+		}
+		// a non existent name means there is no wildcard, no need to probe further
+		if data.StatusCodeRaw == dns.RcodeNameError {
+			break
+		}
+		for _, ip := range append(data.A, data.AAAA...) {
+			answer.IPs[strings.ToLower(ip)] = struct{}{}
+		}
+		for _, cname := range data.CNAME {
+			answer.CNAMEs[strings.ToLower(cname)] = struct{}{}
+		}
+	}
+	return answer, nil
+}
+
+// Purge removes the cached wildcard answers
+func (w *WildcardDetector) Purge() {
+	w.answers.Reset()
+}
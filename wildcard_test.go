@@ -0,0 +1,150 @@
+package retryabledns
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// runWildcardServer serves a zone with a wildcard on example.test and a CNAME
+// wildcard on cdn.example.test, while nowild.test has no wildcard
+func runWildcardServer(t *testing.T) (string, *atomic.Int32) {
+	var queries, rotate atomic.Int32
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		name := r.Question[0].Name
+		add := func(s string) {
+			rr, _ := dns.NewRR(s)
+			m.Answer = append(m.Answer, rr)
+		}
+		switch {
+		case r.Question[0].Qtype != dns.TypeA:
+		case name == "real.example.test." || name == "real.nowild.test.":
+			add(name + " 60 IN A 192.0.2.50")
+		case name == "www.example.test.":
+			add(name + " 60 IN A 192.0.2.10")
+		case strings.HasSuffix(name, ".cdn.example.test."):
+			// the cname target resolves to a different address each time
+			add(name + " 60 IN CNAME lb.provider.test.")
+			add("lb.provider.test. 60 IN A 198.51.100." + strconv.Itoa(int(rotate.Add(1))))
+		case strings.HasSuffix(name, ".example.test."):
+			add(name + " 60 IN A 192.0.2.10")
+			add(name + " 60 IN A 192.0.2.11")
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+		_ = w.WriteMsg(m)
+	})
+	return addr, &queries
+}
+
+func TestWildcardDetector(t *testing.T) {
+	addr, queries := runWildcardServer(t)
+	client, err := New([]string{addr}, 1)
+	require.NoError(t, err)
+
+	detector := NewWildcardDetector(client, "example.test")
+	isWildcard := func(host string) bool {
+		t.Helper()
+		data, err := client.Resolve(host)
+		require.NoError(t, err)
+		wildcard, err := detector.IsWildcard(data)
+		require.NoError(t, err)
+		return wildcard
+	}
+
+	require.False(t, isWildcard("real.example.test"))
+	require.True(t, isWildcard("www.example.test"))
+	require.True(t, isWildcard("random.example.test"))
+
+	// the wildcard answer of example.test is cached
+	before := queries.Load()
+	require.True(t, isWildcard("other.example.test"))
+	require.Equal(t, before+2, queries.Load())
+
+	// multi level names fall under the wildcard of each parent
+	require.True(t, isWildcard("a.b.example.test"))
+	answer, err := detector.WildcardAnswer("b.example.test")
+	require.NoError(t, err)
+	require.True(t, answer.IsWildcard())
+
+	// cname wildcards match on the alias target even if the addresses rotate
+	require.True(t, isWildcard("host.cdn.example.test"))
+	answer, err = detector.WildcardAnswer("cdn.example.test")
+	require.NoError(t, err)
+	require.Contains(t, answer.CNAMEs, "lb.provider.test")
+
+	detector = NewWildcardDetector(client, "nowild.test")
+	require.False(t, isWildcard("real.nowild.test"))
+	answer, err = detector.WildcardAnswer("nowild.test")
+	require.NoError(t, err)
+	require.False(t, answer.IsWildcard())
+
+	// names outside of the detector domain are never wildcards
+	require.False(t, isWildcard("www.example.test"))
+}
+
+func TestWildcardProbeCancellation(t *testing.T) {
+	addr := runLocalDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(50 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.10")
+			m.Answer = append(m.Answer, rr)
+		}
+		_ = w.WriteMsg(m)
+	})
+	client, err := NewWithOptions(Options{BaseResolvers: []string{addr}, MaxRetries: 1, Timeout: 2 * time.Second})
+	require.NoError(t, err)
+	detector := NewWildcardDetector(client, "example.test")
+	detector.Probes = 1
+
+	// the first caller giving up doesn't fail the probe shared with the others
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := detector.WildcardAnswerContext(ctx, "example.test")
+		first <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	second := make(chan error, 1)
+	go func() {
+		answer, err := detector.WildcardAnswerContext(context.Background(), "example.test")
+		if err == nil && !answer.IsWildcard() {
+			err = errors.New("no wildcard answer")
+		}
+		second <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-first, context.Canceled)
+	require.NoError(t, <-second)
+}
+
+func TestWildcardProbeTimeout(t *testing.T) {
+	client, err := NewWithOptions(Options{
+		BaseResolvers: []string{"127.0.0.1:53"},
+		MaxRetries:    3,
+		Timeout:       time.Second,
+		RetryPolicy:   RetryPolicy{BaseDelay: time.Second, Multiplier: 2, Jitter: 0.5},
+	})
+	require.NoError(t, err)
+	detector := NewWildcardDetector(client, "example.test")
+	detector.Probes = 2
+
+	// 3 attempts of 1s after retry delays of 1s and 2s, for A and AAAA of both probes
+	require.Equal(t, 4*(3*time.Second+3*time.Second), detector.probeTimeout())
+
+	detector.ProbeTimeout = time.Minute
+	require.Equal(t, time.Minute, detector.probeTimeout())
+}